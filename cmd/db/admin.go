@@ -0,0 +1,304 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// maintenanceRetryAfter is how many seconds clients are asked to wait with
+// writes in maintenance mode.
+const maintenanceRetryAfter = "30"
+
+// startTime is when the process started, for its uptime.
+var startTime = time.Now()
+
+// maintenance is set in maintenance mode, which refuses writes from clients
+// and keeps serving reads. The stores are read-only then, so their files
+// don't change and a replica catches up with its primary once maintenance is
+// over. A node of a cluster can't enter it, as it has to keep applying the
+// entries committed by the others. With -read-only it is on for good.
+var maintenance atomic.Bool
+
+// writeBlock tells why writes are refused, if they are: the process is a
+// replica or is in maintenance mode.
+func writeBlock() (string, error) {
+	switch {
+	case follower.isFollowing():
+		return codeReadOnly, errReadOnly
+	case maintenance.Load():
+		return codeMaintenance, errMaintenance
+	}
+	return "", nil
+}
+
+// rejectWrites replies 503 to a write if writes are refused, and reports
+// whether it did.
+func rejectWrites(w http.ResponseWriter) bool {
+	code, err := writeBlock()
+	if err == nil {
+		return false
+	}
+	if code == codeMaintenance {
+		w.Header().Set("Retry-After", maintenanceRetryAfter)
+	}
+	httpError(w, http.StatusServiceUnavailable, code, err.Error())
+	return true
+}
+
+// rejectMaintenance replies 503 to a change of the namespaces in maintenance
+// mode, and reports whether it did.
+func rejectMaintenance(w http.ResponseWriter) bool {
+	if !maintenance.Load() {
+		return false
+	}
+	w.Header().Set("Retry-After", maintenanceRetryAfter)
+	httpError(w, http.StatusServiceUnavailable, codeMaintenance, errMaintenance.Error())
+	return true
+}
+
+// setReadOnly switches the default store and all the namespaces to or from
+// read-only mode. If one of them fails to switch, the ones switched already
+// are switched back, so they stay in the mode maintenance tells.
+func setReadOnly(readOnly bool) error {
+	if err := store.SetReadOnly(readOnly); err != nil {
+		return err
+	}
+	switched := []*datastore.Db{store}
+	var err error
+	if namespaces != nil {
+		for _, info := range namespaces.list() {
+			db, getErr := namespaces.get(info.Name)
+			if getErr != nil {
+				// Dropped since it was listed.
+				continue
+			}
+			if err = db.SetReadOnly(readOnly); err != nil {
+				err = fmt.Errorf("namespace %s: %w", info.Name, err)
+				break
+			}
+			switched = append(switched, db)
+		}
+	}
+	if err != nil {
+		for _, db := range switched {
+			if undoErr := db.SetReadOnly(!readOnly); undoErr != nil {
+				log.Printf("Failed to switch a store back: %s", undoErr)
+			}
+		}
+	}
+	return err
+}
+
+type segmentStatus struct {
+	Path  string `json:"path"`
+	Bytes int64  `json:"bytes"`
+	Keys  int    `json:"keys"`
+}
+
+type mergeStatus struct {
+	Running    bool `json:"running"`
+	Compacting bool `json:"compacting"`
+	// The last merge, if there was one.
+	LastStarted         *time.Time `json:"last_started,omitempty"`
+	LastDurationSeconds float64    `json:"last_duration_seconds"`
+	LastError           string     `json:"last_error,omitempty"`
+}
+
+// storeStatus describes the files of the default store or a namespace, which
+// is empty for the default store.
+type storeStatus struct {
+	Namespace    string          `json:"namespace"`
+	SegmentLimit int64           `json:"segment_limit"`
+	Segments     []segmentStatus `json:"segments"`
+	CurrentPath  string          `json:"current_path"`
+	OutOffset    int64           `json:"out_offset"`
+	CurrentKeys  int             `json:"current_keys"`
+	Merge        mergeStatus     `json:"merge"`
+	Quota        datastore.Usage `json:"quota"`
+}
+
+// limitsStatus is the configuration the stores run with.
+type limitsStatus struct {
+	SegmentSize    int64   `json:"segment_size"`
+	MaxSegments    int     `json:"max_segments"`
+	MergeThreshold int     `json:"merge_threshold"`
+	MaxValueSize   int64   `json:"max_value_size"`
+	MaxKeySize     int     `json:"max_key_size"`
+	MaxKeys        int64   `json:"max_keys"`
+	MaxBytes       int64   `json:"max_bytes"`
+	RateLimit      float64 `json:"rate_limit"`
+	RateBurst      int     `json:"rate_burst"`
+	Durability     string  `json:"durability"`
+	SyncInterval   string  `json:"sync_interval,omitempty"`
+}
+
+type statusRes struct {
+	Started       time.Time     `json:"started"`
+	UptimeSeconds float64       `json:"uptime_seconds"`
+	Maintenance   bool          `json:"maintenance"`
+	Limits        limitsStatus  `json:"limits"`
+	Stores        []storeStatus `json:"stores"`
+}
+
+func statusOf(namespace string, segmentLimit int64, db *datastore.Db) storeStatus {
+	stats := db.Stats()
+	res := storeStatus{
+		Namespace:    namespace,
+		SegmentLimit: segmentLimit,
+		Segments:     make([]segmentStatus, 0, len(stats.Segments)),
+		CurrentPath:  stats.CurrentPath,
+		OutOffset:    stats.CurrentBytes,
+		CurrentKeys:  stats.CurrentKeys,
+		Merge:        mergeStatus{Running: stats.Merging, Compacting: stats.Compacting},
+		Quota:        db.Quota(),
+	}
+	for _, seg := range stats.Segments {
+		res.Segments = append(res.Segments, segmentStatus{Path: seg.Path, Bytes: seg.Bytes, Keys: seg.Keys})
+	}
+	if last := stats.LastMerge; !last.At.IsZero() {
+		res.Merge.LastStarted = &last.At
+		res.Merge.LastDurationSeconds = last.Duration.Seconds()
+		if last.Err != nil {
+			res.Merge.LastError = last.Err.Error()
+		}
+	}
+	return res
+}
+
+func configuredLimits() limitsStatus {
+	res := limitsStatus{
+		SegmentSize:    *segmentSize,
+		MaxSegments:    *maxSegments,
+		MergeThreshold: *mergeAt,
+		MaxValueSize:   *maxValue,
+		MaxKeySize:     *maxKeySize,
+		MaxKeys:        *maxKeys,
+		MaxBytes:       *maxBytes,
+		Durability:     *durability,
+	}
+	if limiter != nil {
+		res.RateLimit = limiter.rate
+		res.RateBurst = int(limiter.burst)
+	}
+	if *durability == durabilityInterval {
+		res.SyncInterval = syncInterval.String()
+	}
+	return res
+}
+
+// statusHandler reports the uptime, the configuration and the files of all
+// the stores.
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	res := statusRes{
+		Started:       startTime,
+		UptimeSeconds: time.Since(startTime).Seconds(),
+		Maintenance:   maintenance.Load(),
+		Limits:        configuredLimits(),
+		Stores:        []storeStatus{statusOf("", *segmentSize, store)},
+	}
+	if namespaces != nil {
+		for _, info := range namespaces.list() {
+			db, err := namespaces.get(info.Name)
+			if err != nil {
+				// Dropped since it was listed.
+				continue
+			}
+			res.Stores = append(res.Stores, statusOf(info.Name, info.SegmentLimit, db))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// adminStore returns the store of the namespace query parameter, or the
+// default store without it. If there's no such namespace, it responds with
+// an error and returns nil.
+func adminStore(w http.ResponseWriter, r *http.Request) (string, int64, *datastore.Db) {
+	name := r.URL.Query().Get("namespace")
+	if name == "" {
+		return "", *segmentSize, store
+	}
+	ns, err := namespaces.lookup(name)
+	switch {
+	case err == errNamespacesOff:
+		httpError(w, http.StatusNotImplemented, codeNotImplemented, err.Error())
+		return "", 0, nil
+	case err != nil:
+		httpError(w, http.StatusNotFound, codeNotFound, err.Error())
+		return "", 0, nil
+	}
+	return name, ns.SegmentLimit, ns.db
+}
+
+// storeAction runs an action on the store of a request and replies with the
+// status of the store.
+func storeAction(status int, action func(*datastore.Db, context.Context) error) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name, segmentLimit, db := adminStore(w, r)
+		if db == nil {
+			return
+		}
+		// Sealing the current data file waits while too many segments are
+		// waiting to be merged.
+		ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+		defer cancel()
+		if err := action(db, ctx); err != nil {
+			writeError(w, ctx, err)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		_ = json.NewEncoder(w).Encode(statusOf(name, segmentLimit, db))
+	}
+}
+
+// compactHandler starts a compaction of a store, which goes on in the
+// background.
+var compactHandler = storeAction(http.StatusAccepted, (*datastore.Db).CompactContext)
+
+// rotateHandler seals the current data file of a store as a segment.
+var rotateHandler = storeAction(http.StatusOK, (*datastore.Db).RotateContext)
+
+type maintenanceReq struct {
+	Enabled bool `json:"enabled"`
+}
+
+// maintenanceHandler turns maintenance mode on or off with a JSON body like
+// {"enabled": true}. It is refused in a cluster, and can't be turned off with
+// -read-only.
+func maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	var req maintenanceReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		httpError(w, http.StatusBadRequest, codeBadRequest, "Failed to parse JSON")
+		return
+	}
+	if cluster != nil {
+		httpError(w, http.StatusConflict, codeConflict, "Maintenance mode isn't available in a cluster")
+		return
+	}
+	if *readOnly && !req.Enabled {
+		httpError(w, http.StatusConflict, codeConflict, "The stores are opened with -read-only")
+		return
+	}
+	// Merges in progress finish before the stores turn read-only.
+	if err := setReadOnly(req.Enabled); err != nil {
+		writeError(w, r.Context(), err)
+		return
+	}
+	if maintenance.Swap(req.Enabled) != req.Enabled {
+		if req.Enabled {
+			log.Println("Entered maintenance mode, writes are refused")
+		} else {
+			log.Println("Left maintenance mode")
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(req)
+}
@@ -0,0 +1,194 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/roman-mazur/design-practice-2-template/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func getStatus(t *testing.T, url string) statusRes {
+	resp := request(t, "GET", url+"/admin/status", "")
+	defer resp.Body.Close()
+	var res statusRes
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+	return res
+}
+
+func TestAdmin(t *testing.T) {
+	store = newTestDb(t)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusAccepted, requestStatus(t, "POST", srv.URL+"/db/a", `{"value": "1"}`))
+	status := getStatus(t, srv.URL)
+	assert.False(t, status.Maintenance)
+	assert.Equal(t, *segmentSize, status.Limits.SegmentSize)
+	if assert.Len(t, status.Stores, 1) {
+		assert.Empty(t, status.Stores[0].Segments)
+		assert.Equal(t, int64(50), status.Stores[0].OutOffset)
+		assert.Nil(t, status.Stores[0].Merge.LastStarted)
+	}
+
+	t.Run("rotate", func(t *testing.T) {
+		resp := request(t, "POST", srv.URL+"/admin/rotate", "")
+		var res storeStatus
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, int64(0), res.OutOffset)
+		if assert.Len(t, res.Segments, 1) {
+			assert.Equal(t, segmentStatus{Path: res.Segments[0].Path, Bytes: 50, Keys: 1}, res.Segments[0])
+		}
+	})
+
+	t.Run("compact", func(t *testing.T) {
+		assert.Equal(t, http.StatusAccepted, requestStatus(t, "DELETE", srv.URL+"/db/a", ""))
+		assert.Equal(t, http.StatusAccepted, requestStatus(t, "POST", srv.URL+"/admin/compact", ""))
+		assert.Eventually(t, func() bool {
+			return !getStatus(t, srv.URL).Stores[0].Merge.Compacting
+		}, time.Second, 10*time.Millisecond)
+		merge := getStatus(t, srv.URL).Stores[0].Merge
+		assert.NotNil(t, merge.LastStarted)
+		assert.Empty(t, merge.LastError)
+		assert.Equal(t, http.StatusNotFound, requestStatus(t, "GET", srv.URL+"/db/a", ""))
+		assert.Equal(t, http.StatusNotImplemented, requestStatus(t, "POST", srv.URL+"/admin/compact?namespace=team", ""))
+	})
+
+	t.Run("maintenance", func(t *testing.T) {
+		defer maintenance.Store(false)
+		assert.Equal(t, http.StatusAccepted, requestStatus(t, "POST", srv.URL+"/db/b", `{"value": "1"}`))
+		assert.Equal(t, http.StatusOK, requestStatus(t, "POST", srv.URL+"/admin/maintenance", `{"enabled": true}`))
+		assert.True(t, getStatus(t, srv.URL).Maintenance)
+		assert.True(t, store.ReadOnly(), "the store is read-only outside a cluster")
+
+		resp := request(t, "POST", srv.URL+"/db/b", `{"value": "2"}`)
+		var res errorRes
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+		assert.Equal(t, codeMaintenance, res.Code)
+		assert.Equal(t, maintenanceRetryAfter, resp.Header.Get("Retry-After"))
+		assert.Equal(t, http.StatusServiceUnavailable, requestStatus(t, "DELETE", srv.URL+"/db/b", ""))
+		assert.Equal(t, http.StatusOK, requestStatus(t, "GET", srv.URL+"/db/b", ""), "reads are served")
+
+		assert.Equal(t, http.StatusOK, requestStatus(t, "POST", srv.URL+"/admin/maintenance", `{"enabled": false}`))
+		assert.False(t, store.ReadOnly())
+		assert.Equal(t, http.StatusAccepted, requestStatus(t, "POST", srv.URL+"/db/b", `{"value": "2"}`))
+	})
+
+	t.Run("maintenance rolled back", func(t *testing.T) {
+		var err error
+		namespaces, err = openNamespaces(t.TempDir())
+		if !assert.Nil(t, err, err) {
+			return
+		}
+		defer func() {
+			namespaces.close()
+			namespaces = nil
+		}()
+		for _, name := range []string{"a", "b"} {
+			assert.Nil(t, namespaces.create(namespaceInfo{Name: name, SegmentLimit: 1000}))
+		}
+		a, _ := namespaces.get("a")
+		b, _ := namespaces.get("b")
+		assert.Nil(t, b.Close())
+
+		assert.Equal(t, http.StatusServiceUnavailable, requestStatus(t, "POST", srv.URL+"/admin/maintenance", `{"enabled": true}`))
+		assert.False(t, getStatus(t, srv.URL).Maintenance)
+		assert.False(t, store.ReadOnly(), "the stores switched already are switched back")
+		assert.False(t, a.ReadOnly())
+	})
+
+	t.Run("maintenance in a cluster", func(t *testing.T) {
+		cluster = &raft.Node{}
+		defer func() { cluster = nil }()
+		assert.Equal(t, http.StatusConflict, requestStatus(t, "POST", srv.URL+"/admin/maintenance", `{"enabled": true}`))
+		assert.False(t, getStatus(t, srv.URL).Maintenance)
+		assert.False(t, store.ReadOnly())
+	})
+
+	t.Run("store files in maintenance", func(t *testing.T) {
+		defer func(db *datastore.Db) { store = db }(store)
+		defer maintenance.Store(false)
+		dir := t.TempDir()
+		db, err := datastore.NewDb(dir, 1000)
+		if !assert.Nil(t, err, err) {
+			return
+		}
+		defer db.Close()
+		store = db
+		assert.Equal(t, http.StatusAccepted, requestStatus(t, "POST", srv.URL+"/db/b", `{"value": "1"}`))
+		assert.Equal(t, http.StatusOK, requestStatus(t, "POST", srv.URL+"/admin/maintenance", `{"enabled": true}`))
+		assert.Nil(t, db.Sync())
+		before := dirFiles(t, dir)
+
+		assertMaintenance(t, request(t, "POST", srv.URL+"/db/b", `{"value": "2"}`))
+		assertMaintenance(t, request(t, "DELETE", srv.URL+"/db/b", ""))
+		assert.Nil(t, db.Sync())
+		assert.Equal(t, before, dirFiles(t, dir), "the store files are unchanged")
+		assert.Equal(t, http.StatusOK, requestStatus(t, "POST", srv.URL+"/admin/maintenance", `{"enabled": false}`))
+	})
+
+	t.Run("read-only flag", func(t *testing.T) {
+		defer func(db *datastore.Db) { store = db }(store)
+		defer restoreFlags()
+		defer maintenance.Store(false)
+		dir := t.TempDir()
+		db, err := datastore.NewDb(dir, 1000)
+		if !assert.Nil(t, err, err) {
+			return
+		}
+		assert.Nil(t, db.Put("b", "1"))
+		assert.Nil(t, db.Close())
+		before := dirFiles(t, dir)
+
+		*readOnly = true
+		db, err = datastore.NewDb(dir, 1000, storeOptions()...)
+		if !assert.Nil(t, err, err) {
+			return
+		}
+		defer db.Close()
+		store = db
+		maintenance.Store(true)
+
+		assertMaintenance(t, request(t, "POST", srv.URL+"/db/b", `{"value": "2"}`))
+		assert.Equal(t, http.StatusOK, requestStatus(t, "GET", srv.URL+"/db/b", ""), "reads are served")
+		assert.Equal(t, http.StatusConflict, requestStatus(t, "POST", srv.URL+"/admin/maintenance", `{"enabled": false}`))
+		assert.True(t, getStatus(t, srv.URL).Maintenance)
+		assert.Nil(t, db.Sync())
+		assert.Equal(t, before, dirFiles(t, dir), "the store files are unchanged")
+	})
+}
+
+// assertMaintenance checks that a write was refused in maintenance mode.
+func assertMaintenance(t *testing.T, resp *http.Response) {
+	t.Helper()
+	defer resp.Body.Close()
+	var res errorRes
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+	assert.Equal(t, http.StatusServiceUnavailable, resp.StatusCode)
+	assert.Equal(t, codeMaintenance, res.Code)
+	assert.Equal(t, maintenanceRetryAfter, resp.Header.Get("Retry-After"))
+}
+
+// dirFiles returns the contents of the files in dir by name.
+func dirFiles(t *testing.T, dir string) map[string]string {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err, err)
+	res := make(map[string]string)
+	for _, entry := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		assert.Nil(t, err, err)
+		res[entry.Name()] = string(data)
+	}
+	return res
+}
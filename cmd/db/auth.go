@@ -0,0 +1,208 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+
+	"github.com/gorilla/mux"
+)
+
+// access is a set of operations a token may do with keys.
+type access int
+
+const (
+	accessRead access = 1 << iota
+	accessWrite
+)
+
+// anyNamespace in a grant matches the default store and every namespace.
+const anyNamespace = "*"
+
+const forbiddenMessage = "Token has no access to this resource"
+
+// grant lets a token read or write the keys with a prefix in a namespace.
+// The empty namespace is the default store and the empty prefix is every
+// key.
+type grant struct {
+	Namespace string `json:"namespace"`
+	Prefix    string `json:"prefix"`
+	// Access is read, write or readwrite.
+	Access string `json:"access"`
+
+	access access
+}
+
+// tokenConfig is a token of the auth file. Admin tokens can do anything,
+// including managing namespaces, replication and the cluster.
+type tokenConfig struct {
+	Name   string  `json:"name"`
+	Token  string  `json:"token"`
+	Admin  bool    `json:"admin"`
+	Grants []grant `json:"grants"`
+}
+
+// authConfig is the auth file, like
+//
+//	{"tokens": [{"name": "server", "token": "s3cret",
+//	  "grants": [{"prefix": "users/", "access": "readwrite"}]}]}
+type authConfig struct {
+	Tokens []tokenConfig `json:"tokens"`
+}
+
+// principal is who sent a request.
+type principal struct {
+	name   string
+	admin  bool
+	grants []grant
+}
+
+// can tells whether p may do a with key in namespace. Passing a scan prefix
+// as the key checks that every key it matches is allowed.
+func (p *principal) can(a access, namespace, key string) bool {
+	if p.admin {
+		return true
+	}
+	for _, g := range p.grants {
+		if g.access&a == a && (g.Namespace == anyNamespace || g.Namespace == namespace) && strings.HasPrefix(key, g.Prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// tokens maps the SHA-256 sums of the tokens to their principals. It is nil
+// when authentication is off, and every request is allowed.
+var tokens map[[sha256.Size]byte]*principal
+
+// loadAuth reads the tokens from the auth file at path.
+func loadAuth(path string) (map[[sha256.Size]byte]*principal, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var config authConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("corrupted auth file: %w", err)
+	}
+	res := make(map[[sha256.Size]byte]*principal, len(config.Tokens))
+	for i, t := range config.Tokens {
+		if t.Name == "" {
+			t.Name = fmt.Sprintf("token %d", i+1)
+		}
+		if t.Token == "" {
+			return nil, fmt.Errorf("%s has no token", t.Name)
+		}
+		sum := sha256.Sum256([]byte(t.Token))
+		if _, ok := res[sum]; ok {
+			return nil, fmt.Errorf("%s repeats the token of another one", t.Name)
+		}
+		for j := range t.Grants {
+			g := &t.Grants[j]
+			switch g.Access {
+			case "read":
+				g.access = accessRead
+			case "write":
+				g.access = accessWrite
+			case "readwrite":
+				g.access = accessRead | accessWrite
+			default:
+				return nil, fmt.Errorf("%s has unknown access %q, expected read, write or readwrite", t.Name, g.Access)
+			}
+			if g.Namespace != "" && g.Namespace != anyNamespace && !namespaceName.MatchString(g.Namespace) {
+				return nil, fmt.Errorf("%s has invalid namespace %q", t.Name, g.Namespace)
+			}
+		}
+		res[sum] = &principal{name: t.Name, admin: t.Admin, grants: t.Grants}
+	}
+	return res, nil
+}
+
+type principalKey struct{}
+
+// authenticate finds the principal of the bearer token of a request,
+// replying 401 if there's none.
+func authenticate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if tokens == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		p := tokens[sha256.Sum256([]byte(token))]
+		if !ok || p == nil {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="db"`)
+			httpError(w, http.StatusUnauthorized, codeUnauthorized, "Missing or invalid token")
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), principalKey{}, p)))
+	})
+}
+
+// authorized tells whether the request may do a with key in the namespace
+// of its route.
+func authorized(r *http.Request, a access, key string) bool {
+	if tokens == nil {
+		return true
+	}
+	p, ok := r.Context().Value(principalKey{}).(*principal)
+	return ok && p.can(a, mux.Vars(r)["namespace"], key)
+}
+
+// requireAccess lets requests through if they may do a with the key of the
+// route. Routes without a key, like _scan and _changes, are checked against
+// the prefix query parameter, which is empty for the whole namespace.
+func requireAccess(a access, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key, ok := mux.Vars(r)["key"]
+		if !ok {
+			key = r.URL.Query().Get("prefix")
+		}
+		if !authorized(r, a, key) {
+			httpError(w, http.StatusForbidden, codeForbidden, forbiddenMessage)
+			return
+		}
+		h(w, r)
+	}
+}
+
+// adminOnly lets through the requests of admin tokens.
+func adminOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if tokens != nil {
+			p, _ := r.Context().Value(principalKey{}).(*principal)
+			if p == nil || !p.admin {
+				httpError(w, http.StatusForbidden, codeForbidden, forbiddenMessage)
+				return
+			}
+		}
+		h(w, r)
+	}
+}
+
+// tokenTransport adds a bearer token to the requests to other nodes.
+type tokenTransport struct {
+	token string
+	next  http.RoundTripper
+}
+
+func (t tokenTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	r = r.Clone(r.Context())
+	r.Header.Set("Authorization", "Bearer "+t.token)
+	return t.next.RoundTrip(r)
+}
+
+// peerClient is the client of the requests to the primary and the cluster
+// peers. It authenticates with -peer-token, which must be an admin token on
+// the other nodes, and with the -peer TLS certificate.
+func peerClient() *http.Client {
+	transport := peerTransport()
+	if *peerToken == "" {
+		return &http.Client{Transport: transport}
+	}
+	return &http.Client{Transport: tokenTransport{token: *peerToken, next: transport}}
+}
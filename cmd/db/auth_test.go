@@ -0,0 +1,142 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/dbclient"
+	"github.com/stretchr/testify/assert"
+)
+
+const testAuthFile = `{"tokens": [
+	{"name": "admin", "token": "admin-token", "admin": true},
+	{"name": "users", "token": "users-token", "grants": [
+		{"prefix": "users/", "access": "readwrite"},
+		{"prefix": "public/", "access": "read"}
+	]}
+]}`
+
+func TestAuth(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "auth.json")
+	assert.Nil(t, os.WriteFile(path, []byte(testAuthFile), 0o600))
+	loaded, err := loadAuth(path)
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	tokens = loaded
+	defer func() { tokens = nil }()
+	store = newTestDb(t)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	ctx := context.Background()
+	admin := dbclient.New(srv.URL, dbclient.WithToken("admin-token"))
+	users := dbclient.New(srv.URL, dbclient.WithToken("users-token"))
+
+	status, res := requestError(t, "GET", srv.URL+"/db/users/1", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.Equal(t, codeUnauthorized, res.Code)
+	_, err = dbclient.New(srv.URL, dbclient.WithToken("wrong")).Get(ctx, "users/1")
+	assertAPIError(t, http.StatusUnauthorized, codeUnauthorized, err)
+
+	assert.Nil(t, users.Put(ctx, "users/1", "alice"))
+	value, err := users.Get(ctx, "users/1")
+	assert.Nil(t, err, err)
+	assert.Equal(t, "alice", value)
+	assertAPIError(t, http.StatusForbidden, codeForbidden, users.Put(ctx, "public/1", "x"))
+	assert.Nil(t, admin.Put(ctx, "public/1", "x"))
+	_, err = users.Get(ctx, "public/1")
+	assert.Nil(t, err, err)
+	_, err = users.Get(ctx, "secret")
+	assertAPIError(t, http.StatusForbidden, codeForbidden, err)
+
+	_, err = users.Scan(ctx, "users/", "", 0)
+	assert.Nil(t, err, err)
+	_, err = users.Scan(ctx, "", "", 0)
+	assertAPIError(t, http.StatusForbidden, codeForbidden, err)
+
+	req, _ := http.NewRequest("POST", srv.URL+"/db/_mget", strings.NewReader(`{"keys": ["users/1", "secret"]}`))
+	req.Header.Set("Authorization", "Bearer users-token")
+	resp, err := http.DefaultClient.Do(req)
+	if assert.Nil(t, err, err) {
+		var batch batchRes
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&batch))
+		resp.Body.Close()
+		assert.Equal(t, []keyResult{
+			{Key: "users/1", Value: "alice"},
+			{Key: "secret", Error: forbiddenMessage, Code: codeForbidden},
+		}, batch.Results)
+	}
+	req, _ = http.NewRequest("POST", srv.URL+"/db/_mput", strings.NewReader(`{"values": {"users/2": "bob", "secret": "x"}}`))
+	req.Header.Set("Authorization", "Bearer users-token")
+	resp, err = http.DefaultClient.Do(req)
+	if assert.Nil(t, err, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+	_, err = users.Get(ctx, "users/2")
+	assert.Equal(t, dbclient.ErrNotFound, err, "the batch is not written")
+
+	assert.Nil(t, admin.Put(ctx, "secret", "x"))
+	req, _ = http.NewRequest("GET", srv.URL+"/db/_changes?prefix=users/&timeout=0", nil)
+	req.Header.Set("Authorization", "Bearer users-token")
+	resp, err = http.DefaultClient.Do(req)
+	if assert.Nil(t, err, err) {
+		var changes changesRes
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&changes))
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, store.Seq(), changes.LastSeq)
+		var keys []string
+		for _, rec := range changes.Results {
+			keys = append(keys, rec.Key)
+		}
+		assert.Equal(t, []string{"users/1"}, keys, "keys outside the grants are left out")
+	}
+	req, _ = http.NewRequest("GET", srv.URL+"/db/_changes?timeout=0", nil)
+	req.Header.Set("Authorization", "Bearer users-token")
+	resp, err = http.DefaultClient.Do(req)
+	if assert.Nil(t, err, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+
+	req, _ = http.NewRequest("GET", srv.URL+"/_replication/status", nil)
+	req.Header.Set("Authorization", "Bearer users-token")
+	resp, err = http.DefaultClient.Do(req)
+	if assert.Nil(t, err, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusForbidden, resp.StatusCode)
+	}
+}
+
+func TestLoadAuth(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"not json":          `tokens`,
+		"no token":          `{"tokens": [{"name": "a"}]}`,
+		"repeated token":    `{"tokens": [{"token": "a"}, {"token": "a"}]}`,
+		"unknown access":    `{"tokens": [{"token": "a", "grants": [{"access": "all"}]}]}`,
+		"invalid namespace": `{"tokens": [{"token": "a", "grants": [{"namespace": "a/b", "access": "read"}]}]}`,
+	} {
+		path := filepath.Join(dir, "auth.json")
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err := loadAuth(path)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func assertAPIError(t *testing.T, status int, code string, err error) {
+	t.Helper()
+	var apiErr *dbclient.Error
+	if assert.True(t, errors.As(err, &apiErr), "unexpected error: %v", err) {
+		assert.Equal(t, status, apiErr.StatusCode)
+		assert.Equal(t, code, apiErr.Code)
+	}
+}
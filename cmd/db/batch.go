@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// maxBatchKeys bounds the number of keys in a multi-get or multi-put.
+const maxBatchKeys = 1000
+
+type mgetReq struct {
+	Keys []string `json:"keys"`
+}
+
+type mputReq struct {
+	Values map[string]string `json:"values"`
+}
+
+// keyResult is the outcome for one key of a batch request. Error and Code
+// are empty when it succeeded.
+type keyResult struct {
+	Key   string `json:"key"`
+	Value string `json:"value,omitempty"`
+	Error string `json:"error,omitempty"`
+	Code  string `json:"code,omitempty"`
+}
+
+type batchRes struct {
+	Results []keyResult `json:"results"`
+}
+
+// decodeBody parses the JSON body of a batch into v, reading at most limit
+// bytes of it. It replies with an error and returns false if that fails.
+func decodeBody(w http.ResponseWriter, r *http.Request, limit int64, v any) bool {
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body, limit)).Decode(v)
+	var tooLarge *http.MaxBytesError
+	switch {
+	case errors.As(err, &tooLarge):
+		writeError(w, r.Context(), err)
+		return false
+	case err != nil:
+		httpError(w, http.StatusBadRequest, codeBadRequest, "Failed to parse JSON")
+		return false
+	}
+	return true
+}
+
+// mgetValues reads the keys listed in the body, in their order.
+func mgetValues(w http.ResponseWriter, r *http.Request) {
+	db := requestStore(w, r)
+	if db == nil {
+		return
+	}
+	var req mgetReq
+	// Every key may take twice its size escaped in JSON.
+	limit := maxBatchKeys*(2*int64(*maxKeySize)+8) + 1024
+	if !decodeBody(w, r, limit, &req) {
+		return
+	}
+	if len(req.Keys) > maxBatchKeys {
+		httpError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("At most %d keys are allowed", maxBatchKeys))
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	if err := syncRead(ctx); err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+
+	res := batchRes{Results: make([]keyResult, len(req.Keys))}
+	for i, key := range req.Keys {
+		res.Results[i].Key = key
+		if !authorized(r, accessRead, key) {
+			res.Results[i].Error, res.Results[i].Code = forbiddenMessage, codeForbidden
+			continue
+		}
+		value, err := db.GetContext(ctx, key)
+		if ctx.Err() != nil {
+			writeError(w, ctx, err)
+			return
+		}
+		if err != nil {
+			_, code, err := errorStatus(w, ctx, err)
+			res.Results[i].Error, res.Results[i].Code = err.Error(), code
+		} else {
+			res.Results[i].Value = value
+		}
+	}
+	log.Printf("MGET %d keys from db", len(req.Keys))
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// mputValues writes the values in the body atomically: either all of them
+// are stored or none.
+func mputValues(w http.ResponseWriter, r *http.Request) {
+	if rejectWrites(w) {
+		return
+	}
+	db := requestStore(w, r)
+	if db == nil {
+		return
+	}
+	var req mputReq
+	// A batch may be as large as a single value, escaped in JSON.
+	if !decodeBody(w, r, 2*db.MaxValueSize()+1024, &req) {
+		return
+	}
+	if len(req.Values) > maxBatchKeys {
+		httpError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("At most %d keys are allowed", maxBatchKeys))
+		return
+	}
+
+	pairs := make([]datastore.KeyValue, 0, len(req.Values))
+	for key, value := range req.Values {
+		pairs = append(pairs, datastore.KeyValue{Key: key, Value: value})
+	}
+	sort.Slice(pairs, func(i, j int) bool { return pairs[i].Key < pairs[j].Key })
+	res := batchRes{Results: make([]keyResult, len(pairs))}
+	invalid, forbidden := 0, 0
+	for i, kv := range pairs {
+		res.Results[i].Key = kv.Key
+		if kv.Key == "" {
+			res.Results[i].Error, res.Results[i].Code = "empty key", codeBadRequest
+			invalid++
+		} else if !authorized(r, accessWrite, kv.Key) {
+			res.Results[i].Error, res.Results[i].Code = forbiddenMessage, codeForbidden
+			forbidden++
+		}
+	}
+
+	status, code := http.StatusAccepted, ""
+	var batchErr error
+	if invalid > 0 {
+		status, code = http.StatusBadRequest, codeBadRequest
+		batchErr = fmt.Errorf("not written, %d keys of the batch are invalid", invalid)
+	} else if forbidden > 0 {
+		status, code = http.StatusForbidden, codeForbidden
+		batchErr = fmt.Errorf("not written, %d keys of the batch are forbidden", forbidden)
+	} else {
+		ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+		defer cancel()
+		if err := writeBatch(ctx, db, pairs); err != nil {
+			status, code, batchErr = errorStatus(w, ctx, err)
+		} else {
+			log.Printf("MPUT %d keys into db", len(pairs))
+		}
+	}
+	// The batch is atomic, so an error affects all the keys.
+	if batchErr != nil {
+		for i := range res.Results {
+			if res.Results[i].Error == "" {
+				res.Results[i].Error = batchErr.Error()
+			}
+			if res.Results[i].Code == "" {
+				res.Results[i].Code = code
+			}
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(res)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func postBatch(t *testing.T, url, body string) (int, batchRes) {
+	resp := request(t, "POST", url, body)
+	defer resp.Body.Close()
+	var res batchRes
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+	return resp.StatusCode, res
+}
+
+func TestBatch(t *testing.T) {
+	store = newTestDb(t)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	status, res := postBatch(t, srv.URL+"/db/_mput", `{"values": {"b": "2", "a": "1"}}`)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, []keyResult{{Key: "a"}, {Key: "b"}}, res.Results)
+
+	status, res = postBatch(t, srv.URL+"/db/_mget", `{"keys": ["b", "missing", "a"]}`)
+	assert.Equal(t, http.StatusOK, status)
+	assert.Equal(t, []keyResult{
+		{Key: "b", Value: "2"},
+		{Key: "missing", Error: "record does not exist", Code: codeNotFound},
+		{Key: "a", Value: "1"},
+	}, res.Results)
+
+	t.Run("invalid key rejects the batch", func(t *testing.T) {
+		status, res := postBatch(t, srv.URL+"/db/_mput", `{"values": {"": "x", "c": "3"}}`)
+		assert.Equal(t, http.StatusBadRequest, status)
+		if assert.Len(t, res.Results, 2) {
+			assert.Equal(t, "empty key", res.Results[0].Error)
+			assert.NotEmpty(t, res.Results[1].Error)
+		}
+		_, err := store.Get("c")
+		assert.NotNil(t, err)
+	})
+
+	assert.Equal(t, http.StatusBadRequest, requestStatus(t, "POST", srv.URL+"/db/_mget", `{"keys": "a"}`))
+
+	t.Run("body too large", func(t *testing.T) {
+		keys := `{"keys": ["` + strings.Repeat("k", 3<<20) + `"]}`
+		status, res := requestError(t, "POST", srv.URL+"/db/_mget", keys)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+		assert.Equal(t, codeBodyTooLarge, res.Code)
+
+		store = newTestDb(t, datastore.WithMaxValueSize(100))
+		values := `{"values": {"a": "` + strings.Repeat("v", 2000) + `"}}`
+		status, res = requestError(t, "POST", srv.URL+"/db/_mput", values)
+		assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+		assert.Equal(t, codeBodyTooLarge, res.Code)
+	})
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+const (
+	defaultPollTimeout = 20 * time.Second
+	maxPollTimeout     = 60 * time.Second
+	changesBatchSize   = 1000
+)
+
+type changesRes struct {
+	Results []datastore.Record `json:"results"`
+	LastSeq uint64             `json:"last_seq"`
+}
+
+// parseSince reads the sequence number a consumer has already seen from the
+// since query parameter or, when resuming an event stream, from the
+// Last-Event-ID header. since=now skips all existing changes.
+func parseSince(r *http.Request, db *datastore.Db) (uint64, error) {
+	since := r.URL.Query().Get("since")
+	if id := r.Header.Get("Last-Event-ID"); id != "" {
+		since = id
+	}
+	switch since {
+	case "":
+		return 0, nil
+	case "now":
+		return db.Seq(), nil
+	}
+	return strconv.ParseUint(since, 10, 64)
+}
+
+// changesHandler serves the writes made after the since sequence number,
+// either as a long-poll JSON response or as Server-Sent Events when the
+// client accepts text/event-stream. Only the writes to the keys with the
+// prefix query parameter are served, which is what its access is checked
+// against.
+func changesHandler(w http.ResponseWriter, r *http.Request) {
+	db := requestStore(w, r)
+	if db == nil {
+		return
+	}
+	since, err := parseSince(r, db)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, codeBadRequest, "Invalid since sequence number")
+		return
+	}
+	prefix := r.URL.Query().Get("prefix")
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		streamChanges(w, r, db, since, prefix)
+	} else {
+		pollChanges(w, r, db, since, prefix)
+	}
+}
+
+// pollTimeout reads how long a long poll may wait from the timeout query
+// parameter in seconds.
+func pollTimeout(r *http.Request) (time.Duration, error) {
+	t := r.URL.Query().Get("timeout")
+	if t == "" {
+		return defaultPollTimeout, nil
+	}
+	sec, err := strconv.Atoi(t)
+	if err != nil || sec < 0 {
+		return 0, fmt.Errorf("invalid timeout %q", t)
+	}
+	timeout := time.Duration(sec) * time.Second
+	if timeout > maxPollTimeout {
+		timeout = maxPollTimeout
+	}
+	return timeout, nil
+}
+
+// pollChanges waits for the writes to the keys with prefix. LastSeq moves
+// past the other writes read meanwhile, so they aren't read again.
+func pollChanges(w http.ResponseWriter, r *http.Request, db *datastore.Db, since uint64, prefix string) {
+	timeout, err := pollTimeout(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, codeBadRequest, "Invalid timeout")
+		return
+	}
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Now().Add(timeout + storeTimeout))
+
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
+	res := changesRes{Results: []datastore.Record{}, LastSeq: since}
+	for len(res.Results) == 0 {
+		records, err := db.ReadLog(ctx, res.LastSeq+1, changesBatchSize)
+		if err == context.DeadlineExceeded {
+			break
+		}
+		if err == datastore.ErrLogTruncated {
+			httpError(w, http.StatusGone, codeLogTruncated, err.Error())
+			return
+		}
+		if err != nil {
+			writeError(w, r.Context(), err)
+			return
+		}
+		for _, rec := range records {
+			if strings.HasPrefix(rec.Key, prefix) {
+				res.Results = append(res.Results, rec)
+			}
+		}
+		res.LastSeq = records[len(records)-1].Seq
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+// streamChanges sends the writes to the keys with prefix as events.
+func streamChanges(w http.ResponseWriter, r *http.Request, db *datastore.Db, since uint64, prefix string) {
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	sub := db.Subscribe(since + 1)
+	defer sub.Close()
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+
+	started := false
+	start := func() {
+		if !started {
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.Header().Set("Cache-Control", "no-cache")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+	}
+	for {
+		var err error
+		select {
+		case rec, ok := <-sub.C:
+			if !ok {
+				if !started && sub.Err() == datastore.ErrLogTruncated {
+					httpError(w, http.StatusGone, codeLogTruncated, sub.Err().Error())
+				}
+				return
+			}
+			if !strings.HasPrefix(rec.Key, prefix) {
+				continue
+			}
+			start()
+			err = writeEvent(w, rec)
+		case <-ticker.C:
+			start()
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+func writeEvent(w http.ResponseWriter, rec datastore.Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	event := "put"
+	if rec.Deleted {
+		event = "delete"
+	}
+	_, err = fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", rec.Seq, event, data)
+	return err
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChanges(t *testing.T) {
+	store = newTestDb(t, datastore.WithHistorySize(3))
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	assert.Nil(t, store.Put("a", "a1"))
+	assert.Nil(t, store.Put("b", "b1"))
+	assert.Nil(t, store.Delete("a"))
+
+	t.Run("long poll", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/db/_changes?since=1")
+		assert.Nil(t, err, err)
+		defer resp.Body.Close()
+		var res changesRes
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+		assert.Equal(t, uint64(3), res.LastSeq)
+		assert.Equal(t, []datastore.Record{
+			{Seq: 2, Key: "b", Value: "b1"},
+			{Seq: 3, Key: "a", Deleted: true},
+		}, res.Results)
+	})
+
+	t.Run("long poll timeout", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/db/_changes?since=now&timeout=0")
+		assert.Nil(t, err, err)
+		defer resp.Body.Close()
+		var res changesRes
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+		assert.Equal(t, uint64(3), res.LastSeq)
+		assert.Empty(t, res.Results)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		assert.Nil(t, store.Put("c", "c1"))
+		resp, err := http.Get(srv.URL + "/db/_changes?since=0")
+		assert.Nil(t, err, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusGone, resp.StatusCode)
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		resp, err := http.Get(srv.URL + "/db/_changes?since=1&prefix=a")
+		assert.Nil(t, err, err)
+		defer resp.Body.Close()
+		var res changesRes
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+		assert.Equal(t, uint64(4), res.LastSeq, "other keys are skipped")
+		assert.Equal(t, []datastore.Record{{Seq: 3, Key: "a", Deleted: true}}, res.Results)
+	})
+
+	t.Run("event stream", func(t *testing.T) {
+		assert.Nil(t, store.Put("b", "b2"))
+		req, _ := http.NewRequest("GET", srv.URL+"/db/_changes?prefix=c", nil)
+		req.Header.Set("Accept", "text/event-stream")
+		req.Header.Set("Last-Event-ID", "3")
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err, err)
+		defer resp.Body.Close()
+		assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+		in := bufio.NewReader(resp.Body)
+		var lines []string
+		for len(lines) < 3 {
+			line, err := in.ReadString('\n')
+			assert.Nil(t, err, err)
+			if line = strings.TrimSpace(line); line != "" {
+				lines = append(lines, line)
+			}
+		}
+		assert.Equal(t, []string{
+			"id: 4",
+			"event: put",
+			`data: {"seq":4,"key":"c","value":"c1"}`,
+		}, lines)
+	})
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"context"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/dbclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClientKeys(t *testing.T) {
+	store = newTestDb(t)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+	c := dbclient.New(srv.URL)
+	ctx := context.Background()
+
+	for _, key := range []string{"a/b", "with space", "100%"} {
+		assert.Nil(t, c.Put(ctx, key, "v:"+key))
+		value, err := c.Get(ctx, key)
+		assert.Nil(t, err, err)
+		assert.Equal(t, "v:"+key, value)
+	}
+	assert.Nil(t, c.Delete(ctx, "a/b"))
+	_, err := c.Get(ctx, "a/b")
+	assert.Equal(t, dbclient.ErrNotFound, err)
+
+	page, err := c.Scan(ctx, "w", "", 0)
+	assert.Nil(t, err, err)
+	assert.Equal(t, []dbclient.KeyValue{{Key: "with space", Value: "v:with space"}}, page.Items)
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// Durability modes, telling when writes reach the disk.
+const (
+	// durabilityNone leaves flushing to the operating system.
+	durabilityNone = "none"
+	// durabilityInterval flushes the writes every -sync-interval.
+	durabilityInterval = "interval"
+	// durabilityAlways flushes every write before acknowledging it.
+	durabilityAlways = "always"
+)
+
+// envPrefix starts the names of the environment variables that configure the
+// database: -segment-size is read from DB_SEGMENT_SIZE and so on.
+const envPrefix = "DB_"
+
+func envName(flagName string) string {
+	return envPrefix + strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// applyEnv sets the flags that weren't given on the command line from the
+// environment, so the command line wins over the environment.
+func applyEnv(fs *flag.FlagSet) error {
+	set := make(map[string]bool)
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || set[f.Name] {
+			return
+		}
+		value, ok := os.LookupEnv(envName(f.Name))
+		if !ok {
+			return
+		}
+		if setErr := fs.Set(f.Name, value); setErr != nil {
+			err = fmt.Errorf("invalid value %q of %s: %w", value, envName(f.Name), setErr)
+		}
+	})
+	return err
+}
+
+// validateConfig rejects the flag values the database can't run with.
+func validateConfig() error {
+	if *dataDir == "" {
+		return errors.New("-dir must not be empty")
+	}
+	if *namespacesDir == "" {
+		return errors.New("-namespaces-dir must not be empty")
+	}
+	if *addr == "" {
+		return errors.New("-addr must not be empty")
+	}
+	if *segmentSize < minSegmentLimit || *segmentSize > maxSegmentLimit {
+		return fmt.Errorf("-segment-size must be between %d and %d bytes", minSegmentLimit, maxSegmentLimit)
+	}
+	if *maxValue <= 0 || *maxValue > datastore.MaxValueSizeLimit {
+		return fmt.Errorf("-max-value-size must be between 1 and %d bytes", datastore.MaxValueSizeLimit)
+	}
+	switch *durability {
+	case durabilityNone, durabilityAlways:
+	case durabilityInterval:
+		if *syncInterval <= 0 {
+			return errors.New("-sync-interval must be positive")
+		}
+	default:
+		return fmt.Errorf("unknown -durability %q, expected %s, %s or %s", *durability, durabilityNone, durabilityInterval, durabilityAlways)
+	}
+	if *maxSegments < 2 {
+		return errors.New("-max-segments must be at least 2")
+	}
+	if *mergeAt < 2 || *mergeAt > *maxSegments {
+		return fmt.Errorf("-merge-threshold must be between 2 and -max-segments (%d)", *maxSegments)
+	}
+	if *maxKeySize <= 0 {
+		return errors.New("-max-key-size must be positive")
+	}
+	if *maxKeys < 0 || *maxBytes < 0 {
+		return errors.New("-max-keys and -max-bytes must not be negative")
+	}
+	if *rateLimit < 0 || *rateBurst < 0 {
+		return errors.New("-rate-limit and -rate-burst must not be negative")
+	}
+	for name, port := range map[string]int{"-wire-port": *wirePort, "-redis-port": *redisPort} {
+		if port < 0 || port > 65535 {
+			return fmt.Errorf("%s must be between 0 and 65535", name)
+		}
+	}
+	if *primary != "" && *raftID != "" {
+		return errors.New("-primary and -raft-id can't be used together")
+	}
+	if *readOnly && (*primary != "" || *raftID != "") {
+		// Replicas and cluster nodes have to apply the writes they get.
+		return errors.New("-read-only can't be used with -primary or -raft-id")
+	}
+	if *raftID != "" && *raftPeers == "" {
+		return errors.New("-raft-id requires -raft-peers")
+	}
+	if *authFile != "" && (*wirePort != 0 || *redisPort != 0) {
+		// Their clients have no way to send a token.
+		return errors.New("-auth-file requires -wire-port=0 and -redis-port=0, the binary and Redis protocols have no authentication")
+	}
+	return nil
+}
+
+// logConfig logs the effective value of every flag.
+func logConfig(fs *flag.FlagSet) {
+	var settings []string
+	fs.VisitAll(func(f *flag.Flag) {
+		value := f.Value.String()
+		if f.Name == "peer-token" && value != "" {
+			value = "<hidden>"
+		}
+		settings = append(settings, f.Name+"="+value)
+	})
+	log.Printf("Configuration: %s", strings.Join(settings, " "))
+}
+
+// keyring encrypts the values of the stores. It is nil when encryption is
+// off.
+var keyring *datastore.Keyring
+
+// storeOptions are the options of the default store and the namespaces,
+// except for their quotas.
+func storeOptions() []datastore.Option {
+	opts := []datastore.Option{
+		datastore.WithCacheSize(mb1),
+		datastore.WithMaxValueSize(*maxValue),
+		datastore.WithMaxSegments(*maxSegments),
+		datastore.WithMergeThreshold(*mergeAt),
+		datastore.WithMaxKeySize(*maxKeySize),
+	}
+	switch *durability {
+	case durabilityInterval:
+		opts = append(opts, datastore.WithSyncInterval(*syncInterval))
+	case durabilityAlways:
+		opts = append(opts, datastore.WithSyncWrites())
+	}
+	if keyring != nil {
+		opts = append(opts, datastore.WithEncryption(keyring))
+	}
+	if *readOnly {
+		opts = append(opts, datastore.WithReadOnly())
+	}
+	return opts
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"flag"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestApplyEnv(t *testing.T) {
+	fs := flag.NewFlagSet("db", flag.ContinueOnError)
+	dir := fs.String("dir", "./store", "")
+	size := fs.Int64("segment-size", 100, "")
+	interval := fs.Duration("sync-interval", time.Second, "")
+	assert.Nil(t, fs.Parse([]string{"-dir", "/from/flag"}))
+
+	t.Setenv("DB_DIR", "/from/env")
+	t.Setenv("DB_SEGMENT_SIZE", "2048")
+	t.Setenv("DB_SYNC_INTERVAL", "250ms")
+	assert.Nil(t, applyEnv(fs))
+	assert.Equal(t, "/from/flag", *dir, "the command line wins over the environment")
+	assert.Equal(t, int64(2048), *size)
+	assert.Equal(t, 250*time.Millisecond, *interval)
+
+	fs = flag.NewFlagSet("db", flag.ContinueOnError)
+	fs.Int64("segment-size", 100, "")
+	t.Setenv("DB_SEGMENT_SIZE", "large")
+	assert.NotNil(t, applyEnv(fs))
+}
+
+func TestValidateConfig(t *testing.T) {
+	assert.Nil(t, validateConfig(), "the defaults are valid")
+
+	for name, change := range map[string]func(){
+		"empty dir":          func() { *dataDir = "" },
+		"empty addr":         func() { *addr = "" },
+		"small segments":     func() { *segmentSize = 10 },
+		"huge values":        func() { *maxValue = 1 << 40 },
+		"unknown durability": func() { *durability = "sometimes" },
+		"no sync interval": func() {
+			*durability = durabilityInterval
+			*syncInterval = 0
+		},
+		"one segment":         func() { *maxSegments = 1 },
+		"unreachable merges":  func() { *mergeAt = *maxSegments + 1 },
+		"invalid port":        func() { *redisPort = 70000 },
+		"replica and cluster": func() { *primary, *raftID = "db:9000", "db2:9000" },
+		"cluster of nobody":   func() { *raftID = "db2:9000" },
+		"auth with wire":      func() { *authFile = "auth.json" },
+		"read-only replica":   func() { *readOnly, *primary = true, "db:9000" },
+	} {
+		t.Run(name, func(t *testing.T) {
+			defer restoreFlags()
+			change()
+			assert.NotNil(t, validateConfig())
+		})
+	}
+}
+
+// restoreFlags resets the flags of the database to their defaults, leaving
+// the ones of the test binary alone.
+func restoreFlags() {
+	flag.VisitAll(func(f *flag.Flag) {
+		if !strings.HasPrefix(f.Name, "test.") {
+			f.Value.Set(f.DefValue)
+		}
+	})
+}
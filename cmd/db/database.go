@@ -1,17 +1,58 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"io/ioutil"
 	"log"
 	"net/http"
+	"net/url"
+	"strconv"
+	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/roman-mazur/design-practice-2-template/httptools"
+	"github.com/roman-mazur/design-practice-2-template/resp"
+	"github.com/roman-mazur/design-practice-2-template/signal"
+	"github.com/roman-mazur/design-practice-2-template/wire"
 )
 
 var store *datastore.Db
 
+// follower replicates the store from the primary if the process runs as a
+// replica.
+var follower *replica
+
+var (
+	dataDir       = flag.String("dir", "./cmd/db/store", "directory of the default store")
+	namespacesDir = flag.String("namespaces-dir", "./cmd/db/namespaces", "directory of the namespaces")
+	addr          = flag.String("addr", ":9000", "address of the HTTP API")
+	segmentSize   = flag.Int64("segment-size", mb10, "size limit of a data file in bytes")
+	durability    = flag.String("durability", durabilityNone, "when writes reach the disk: none, interval or always")
+	syncInterval  = flag.Duration("sync-interval", time.Second, "how often writes are flushed with -durability=interval")
+	maxSegments   = flag.Int("max-segments", 8, "number of sealed segments that blocks writes until they are merged")
+	mergeAt       = flag.Int("merge-threshold", 2, "number of sealed segments that starts a merge")
+	primary       = flag.String("primary", "", "primary database address; runs as its replica when set")
+	raftID        = flag.String("raft-id", "", "address of this node in the cluster; runs as a cluster member when set")
+	raftPeers     = flag.String("raft-peers", "", "comma-separated addresses of all the cluster nodes")
+	raftDir       = flag.String("raft-dir", "./cmd/db/raft", "directory of the cluster log")
+	maxValue      = flag.Int64("max-value-size", 64*1024*1024, "size limit of a value in bytes")
+	wirePort      = flag.Int("wire-port", 9090, "port of the binary protocol; 0 disables it")
+	redisPort     = flag.Int("redis-port", 0, "port of the Redis protocol, like 6379; 0 disables it")
+	authFile      = flag.String("auth-file", "", "JSON file with the API tokens; authentication is off without it")
+	peerToken     = flag.String("peer-token", "", "admin token sent to the primary and the cluster peers")
+	keyFile       = flag.String("encryption-key-file", "", "file with the keys encrypting the values at rest; the last one is current")
+	maxKeySize    = flag.Int("max-key-size", 1024, "size limit of a key in bytes")
+	maxKeys       = flag.Int64("max-keys", 0, "default limit of keys in the default store and new namespaces; 0 is unlimited")
+	maxBytes      = flag.Int64("max-bytes", 0, "default limit of the size of the keys and values in the default store and new namespaces; 0 is unlimited")
+	rateLimit     = flag.Float64("rate-limit", 0, "requests to the keys a second allowed to every client; 0 is unlimited")
+	rateBurst     = flag.Int("rate-burst", 0, "requests a client may send at once over -rate-limit; defaults to -rate-limit")
+	readOnly      = flag.Bool("read-only", false, "open the stores read-only, leaving their files as they are, and stay in maintenance mode")
+)
+
 type putReq struct {
 	Value string	`json:"value"`
 }
@@ -22,51 +63,253 @@ type getRes struct {
 }
 
 const mb10 = 1024*1024*10
+const mb1 = 1024*1024
+
+// storeTimeout bounds how long a request may wait for the datastore.
+const storeTimeout = 5 * time.Second
 
 func main() {
-	db, err := datastore.NewDb("./cmd/db/store", mb10)
+	flag.Parse()
+	if err := applyEnv(flag.CommandLine); err != nil {
+		log.Fatal(err.Error())
+	}
+	if err := validateConfig(); err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+	logConfig(flag.CommandLine)
+	if err := loadTLS(); err != nil {
+		log.Fatal(err.Error())
+	}
+	if *authFile != "" {
+		var err error
+		if tokens, err = loadAuth(*authFile); err != nil {
+			log.Fatal(err.Error())
+		}
+		log.Printf("Loaded %d tokens from %s", len(tokens), *authFile)
+	}
+	if *keyFile != "" {
+		var err error
+		if keyring, err = datastore.ReadKeyFile(*keyFile); err != nil {
+			log.Fatal(err.Error())
+		}
+		log.Printf("Encrypting values with the current key of %s", *keyFile)
+	}
+
+	if *rateLimit > 0 {
+		limiter = newRateLimiter(*rateLimit, *rateBurst)
+	}
+
+	opts := append(storeOptions(), datastore.WithQuota(*maxKeys, *maxBytes))
+	db, err := datastore.NewDb(*dataDir, *segmentSize, opts...)
 	store = db
 	if err != nil {
 		log.Fatal(err.Error())
 	}
-	router := mux.NewRouter()
-	router.HandleFunc("/db/{key}", getValue).Methods("GET")
-	router.HandleFunc("/db/{key}", putValue).Methods("POST")
+	if *primary != "" {
+		follower = startReplica(*primary, store)
+		log.Printf("Replicating from %s", *primary)
+	}
+	if *primary == "" && *raftID == "" {
+		namespaces, err = openNamespaces(*namespacesDir)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	if *readOnly {
+		maintenance.Store(true)
+		log.Println("Opened the stores read-only, writes are refused")
+	}
+	if *raftID != "" {
+		cluster, err = startCluster(*raftID, parsePeers(*raftPeers), *raftDir, store)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+		log.Printf("Joined the cluster of %s as %s", *raftPeers, *raftID)
+	}
 
+	server := httptools.CreateServerAt(*addr, newRouter(), httptools.WithTLS(tlsConfig))
+	server.Start()
+	var wireServer *wire.Server
+	if *wirePort != 0 {
+		wireServer, err = startWire(*wirePort)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
+	var (
+		redisServer *resp.Server
+		redis       *redisHandler
+	)
+	if *redisPort != 0 {
+		redisServer, redis, err = startRedis(*redisPort)
+		if err != nil {
+			log.Fatal(err.Error())
+		}
+	}
 	log.Println("Database started")
-	err = http.ListenAndServe(":9000", router)
-	log.Fatal(err)
+	signal.WaitForTerminationSignal()
+	if wireServer != nil {
+		wireServer.Close()
+	}
+	if redisServer != nil {
+		redisServer.Close()
+		redis.close()
+	}
+	if follower != nil {
+		follower.stop()
+	}
+	if cluster != nil {
+		cluster.Stop()
+	}
+	namespaces.close()
+	if err := store.Close(); err != nil {
+		log.Printf("Failed to close the store: %s", err)
+	}
+}
+
+func newRouter() *mux.Router {
+	// Keys are matched escaped, so that they may contain slashes.
+	router := mux.NewRouter().UseEncodedPath()
+	router.Use(unescapeVars, authenticate, limitRate)
+	// The keys of batches are checked by the handlers.
+	router.HandleFunc("/db/_changes", requireAccess(accessRead, changesHandler)).Methods("GET")
+	router.HandleFunc("/db/_scan", requireAccess(accessRead, leaderOnly(scanValues))).Methods("GET")
+	router.HandleFunc("/db/_mget", leaderOnly(mgetValues)).Methods("POST")
+	router.HandleFunc("/db/_mput", leaderOnly(mputValues)).Methods("POST")
+	router.HandleFunc("/db/{key}", requireAccess(accessRead, leaderOnly(getValue))).Methods("GET")
+	router.HandleFunc("/db/{key}", requireAccess(accessWrite, leaderOnly(putValue))).Methods("POST")
+	router.HandleFunc("/db/{key}", requireAccess(accessWrite, leaderOnly(rawPutValue))).Methods("PUT")
+	router.HandleFunc("/db/{key}", requireAccess(accessWrite, leaderOnly(deleteValue))).Methods("DELETE")
+	router.HandleFunc("/db/{namespace}/_changes", requireAccess(accessRead, changesHandler)).Methods("GET")
+	router.HandleFunc("/db/{namespace}/_scan", requireAccess(accessRead, scanValues)).Methods("GET")
+	router.HandleFunc("/db/{namespace}/_mget", mgetValues).Methods("POST")
+	router.HandleFunc("/db/{namespace}/_mput", mputValues).Methods("POST")
+	router.HandleFunc("/db/{namespace}/{key}", requireAccess(accessRead, getValue)).Methods("GET")
+	router.HandleFunc("/db/{namespace}/{key}", requireAccess(accessWrite, putValue)).Methods("POST")
+	router.HandleFunc("/db/{namespace}/{key}", requireAccess(accessWrite, rawPutValue)).Methods("PUT")
+	router.HandleFunc("/db/{namespace}/{key}", requireAccess(accessWrite, deleteValue)).Methods("DELETE")
+	router.HandleFunc("/namespaces", adminOnly(listNamespaces)).Methods("GET")
+	router.HandleFunc("/namespaces", adminOnly(createNamespace)).Methods("POST")
+	router.HandleFunc("/namespaces/{namespace}", adminOnly(dropNamespace)).Methods("DELETE")
+	router.HandleFunc("/admin/usage", adminOnly(usageHandler)).Methods("GET")
+	router.HandleFunc("/metrics", adminOnly(metricsHandler)).Methods("GET")
+	router.HandleFunc("/admin/status", adminOnly(statusHandler)).Methods("GET")
+	router.HandleFunc("/admin/compact", adminOnly(compactHandler)).Methods("POST")
+	router.HandleFunc("/admin/rotate", adminOnly(rotateHandler)).Methods("POST")
+	router.HandleFunc("/admin/maintenance", adminOnly(maintenanceHandler)).Methods("POST")
+	router.HandleFunc("/_replication/log", adminOnly(streamLog)).Methods("GET")
+	router.HandleFunc("/_replication/snapshot", adminOnly(serveSnapshot)).Methods("GET")
+	router.HandleFunc("/_replication/value", adminOnly(serveValue)).Methods("GET")
+	router.HandleFunc("/_replication/status", adminOnly(replicationStatusHandler)).Methods("GET")
+	router.HandleFunc("/_replication/promote", adminOnly(promoteHandler)).Methods("POST")
+	if cluster != nil {
+		raftHandler{cluster}.register(router)
+	}
+	return router
+}
+
+// unescapeVars decodes the path variables of routes matched escaped.
+func unescapeVars(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		for name, value := range vars {
+			if unescaped, err := url.PathUnescape(value); err == nil {
+				vars[name] = unescaped
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
 }
 
 func getValue(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
-	value, err := store.Get(key)
+	db := requestStore(w, r)
+	if db == nil {
+		return
+	}
+	if r.URL.Query().Get("watch") == "true" {
+		watchValue(w, r, db, key)
+		return
+	}
+	if r.Header.Get("Accept") == octetStream {
+		rawGetValue(w, r, db, key)
+		return
+	}
+	// The sequence number is taken before the read, so a watch started from
+	// it can't miss a change made after the read.
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	if err := syncRead(ctx); err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	seq := db.Seq()
+	value, err := db.GetContext(ctx, key)
 	log.Printf("GET key %s from db", key)
 	if err != nil {
-		http.NotFound(w, r)
+		writeError(w, ctx, err)
 		return
 	}
 	resS := getRes{Key: key, Value: value}
 	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(seqHeader, strconv.FormatUint(seq, 10))
 	_ = json.NewEncoder(w).Encode(resS)
 }
 
 func putValue(w http.ResponseWriter, r *http.Request) {
 	vars := mux.Vars(r)
 	key := vars["key"]
-	body, err := ioutil.ReadAll(r.Body)
+	if rejectWrites(w) {
+		return
+	}
+	db := requestStore(w, r)
+	if db == nil {
+		return
+	}
+	// Escaping in JSON takes some room on top of the value itself.
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 2*db.MaxValueSize()+1024))
 	if err != nil {
-		http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeError(w, r.Context(), err)
+		} else {
+			httpError(w, http.StatusBadRequest, codeBadRequest, "Failed to read request body")
+		}
 		return
 	}
 	var putR putReq
 	err = json.Unmarshal(body, &putR)
 	if err != nil {
-		http.Error(w, "Failed to parse JSON", http.StatusBadRequest)
+		httpError(w, http.StatusBadRequest, codeBadRequest, "Failed to parse JSON")
+		return
+	}
+	log.Printf("PUT %s: %d bytes into db", key, len(putR.Value))
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	if err := writeRecord(ctx, db, datastore.Record{Key: key, Value: putR.Value}); err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func deleteValue(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	key := vars["key"]
+	if rejectWrites(w) {
+		return
+	}
+	db := requestStore(w, r)
+	if db == nil {
+		return
+	}
+	log.Printf("DELETE %s from db", key)
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	if err := writeRecord(ctx, db, datastore.Record{Key: key, Deleted: true}); err != nil {
+		writeError(w, ctx, err)
 		return
 	}
-	log.Printf("PUT %s: %s into db", key, putR.Value)
-	store.Put(key, putR.Value)
 	w.WriteHeader(http.StatusAccepted)
 }
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"net/http"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/roman-mazur/design-practice-2-template/raft"
+)
+
+// Error codes tell the causes of failed requests apart without parsing the
+// messages.
+const (
+	codeBadRequest         = "bad_request"
+	codeUnauthorized       = "unauthorized"
+	codeForbidden          = "forbidden"
+	codeNotFound           = "not_found"
+	codeCorrupted          = "corrupted_record"
+	codeUnknownKey         = "unknown_encryption_key"
+	codeValueTooLarge      = "value_too_large"
+	codeKeyTooLarge        = "key_too_large"
+	codeQuotaExceeded      = "quota_exceeded"
+	codeRateLimited        = "rate_limited"
+	codeBodyTooLarge       = "body_too_large"
+	codeUnsupportedType    = "unsupported_media_type"
+	codeReadOnly           = "read_only"
+	codeMaintenance        = "maintenance"
+	codeTimeout            = "timeout"
+	codeNotLeader          = "not_leader"
+	codeUnavailable        = "unavailable"
+	codeStorageUnavailable = "storage_unavailable"
+	codeLogTruncated       = "log_truncated"
+	codeConflict           = "conflict"
+	codeNotImplemented     = "not_implemented"
+	codeInternal           = "internal"
+)
+
+var (
+	errTimedOut    = errors.New("Datastore timed out")
+	errReadOnly    = errors.New("Replica is read-only, write to the primary")
+	errMaintenance = errors.New("Database is in maintenance mode, retry later")
+)
+
+// errorRes is the body of every error response.
+type errorRes struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// httpError replies to the request with a JSON error.
+func httpError(w http.ResponseWriter, status int, code, message string) {
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorRes{Code: code, Message: message})
+}
+
+// writeError reports a failed write or read of the store.
+func writeError(w http.ResponseWriter, ctx context.Context, err error) {
+	status, code, err := errorStatus(w, ctx, err)
+	httpError(w, status, code, err.Error())
+}
+
+// errorStatus picks the response status and the error code for a failed
+// write or read of the store, along with the error to report. Clients are
+// asked to retry when the cluster is changing its leader or the store is in
+// maintenance.
+func errorStatus(w http.ResponseWriter, ctx context.Context, err error) (int, string, error) {
+	status, code, err := errorCode(ctx, err)
+	switch code {
+	case codeNotLeader:
+		w.Header().Set("Retry-After", "1")
+	case codeMaintenance:
+		w.Header().Set("Retry-After", maintenanceRetryAfter)
+	}
+	return status, code, err
+}
+
+// errorCode classifies a failed write or read of the store.
+func errorCode(ctx context.Context, err error) (int, string, error) {
+	var (
+		notLeader *raft.NotLeaderError
+		tooLarge  *http.MaxBytesError
+		pathErr   *fs.PathError
+	)
+	switch {
+	case errors.Is(err, datastore.ErrNotFound):
+		return http.StatusNotFound, codeNotFound, err
+	case ctx.Err() != nil:
+		return http.StatusServiceUnavailable, codeTimeout, errTimedOut
+	case errors.As(err, &notLeader), errors.Is(err, raft.ErrLeadershipLost):
+		return http.StatusServiceUnavailable, codeNotLeader, err
+	case errors.Is(err, datastore.ErrReadOnly):
+		return http.StatusServiceUnavailable, codeMaintenance, errMaintenance
+	case errors.Is(err, datastore.ErrValueTooLarge):
+		return http.StatusRequestEntityTooLarge, codeValueTooLarge, err
+	case errors.Is(err, datastore.ErrKeyTooLarge):
+		return http.StatusRequestEntityTooLarge, codeKeyTooLarge, err
+	case errors.Is(err, datastore.ErrQuotaExceeded):
+		return http.StatusInsufficientStorage, codeQuotaExceeded, err
+	case errors.As(err, &tooLarge):
+		return http.StatusRequestEntityTooLarge, codeBodyTooLarge, err
+	case errors.Is(err, datastore.ErrCorrupted):
+		return http.StatusInternalServerError, codeCorrupted, err
+	case errors.Is(err, datastore.ErrUnknownKey):
+		return http.StatusInternalServerError, codeUnknownKey, err
+	case errors.Is(err, datastore.ErrClosed), errors.As(err, &pathErr):
+		return http.StatusServiceUnavailable, codeStorageUnavailable, err
+	case errors.Is(err, datastore.ErrLogTruncated):
+		return http.StatusGone, codeLogTruncated, err
+	}
+	return http.StatusInternalServerError, codeInternal, err
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func requestError(t *testing.T, method, url, body string) (int, errorRes) {
+	resp := request(t, method, url, body)
+	defer resp.Body.Close()
+	assert.Equal(t, "application/json", resp.Header.Get("Content-Type"))
+	var res errorRes
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+	return resp.StatusCode, res
+}
+
+func TestErrors(t *testing.T) {
+	dir := t.TempDir()
+	db, err := datastore.NewDb(dir, 1000, datastore.WithMaxValueSize(16))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer db.Close()
+	store = db
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	status, res := requestError(t, "GET", srv.URL+"/db/missing", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Equal(t, codeNotFound, res.Code)
+
+	status, res = requestError(t, "POST", srv.URL+"/db/key", `{"value": `)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Equal(t, codeBadRequest, res.Code)
+
+	status, res = requestError(t, "POST", srv.URL+"/db/key", `{"value": "`+strings.Repeat("x", 17)+`"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, codeValueTooLarge, res.Code)
+
+	status, res = requestError(t, "POST", srv.URL+"/db/key", `{"value": "`+strings.Repeat("x", 2048)+`"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, codeBodyTooLarge, res.Code)
+
+	t.Run("corrupted record", func(t *testing.T) {
+		assert.Equal(t, http.StatusAccepted, requestStatus(t, "POST", srv.URL+"/db/key", `{"value": "value"}`))
+		path := filepath.Join(dir, "current-data")
+		data, err := os.ReadFile(path)
+		assert.Nil(t, err, err)
+		// Flip a byte of the value.
+		data[len(data)-sha256.Size-5] ^= 0xff
+		assert.Nil(t, os.WriteFile(path, data, 0o600))
+
+		status, res := requestError(t, "GET", srv.URL+"/db/key", "")
+		assert.Equal(t, http.StatusInternalServerError, status)
+		assert.Equal(t, codeCorrupted, res.Code)
+	})
+}
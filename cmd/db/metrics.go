@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// metricsContentType is the Prometheus text exposition format.
+const metricsContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// storeMetrics are the stats of the default store or a namespace, which is
+// empty for the default store.
+type storeMetrics struct {
+	namespace string
+	stats     datastore.Stats
+	usage     datastore.Usage
+}
+
+func collectMetrics() []storeMetrics {
+	res := []storeMetrics{{stats: store.Stats(), usage: store.Usage()}}
+	if namespaces != nil {
+		for _, info := range namespaces.list() {
+			db, err := namespaces.get(info.Name)
+			if err != nil {
+				// Dropped since it was listed.
+				continue
+			}
+			res = append(res, storeMetrics{namespace: info.Name, stats: db.Stats(), usage: db.Usage()})
+		}
+	}
+	return res
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// label is a label of a sample.
+type label struct {
+	name, value string
+}
+
+// withLabel returns a copy of labels with l added.
+func withLabel(labels []label, l label) []label {
+	return append(append([]label(nil), labels...), l)
+}
+
+// metricsWriter writes metrics in the Prometheus text format. All the
+// samples of a metric must follow its header.
+type metricsWriter struct {
+	w *bufio.Writer
+}
+
+func (m metricsWriter) header(name, kind, help string) {
+	m.w.WriteString("# HELP " + name + " " + help + "\n")
+	m.w.WriteString("# TYPE " + name + " " + kind + "\n")
+}
+
+func (m metricsWriter) sample(name string, labels []label, value float64) {
+	m.w.WriteString(name)
+	if len(labels) > 0 {
+		m.w.WriteByte('{')
+		for i, l := range labels {
+			if i > 0 {
+				m.w.WriteByte(',')
+			}
+			m.w.WriteString(l.name + `="` + labelEscaper.Replace(l.value) + `"`)
+		}
+		m.w.WriteByte('}')
+	}
+	m.w.WriteString(" " + strconv.FormatFloat(value, 'g', -1, 64) + "\n")
+}
+
+// histogram writes the samples of a histogram: a cumulative count for every
+// bucket, the sum and the count.
+func (m metricsWriter) histogram(name string, labels []label, h datastore.Histogram) {
+	for i, bound := range h.Bounds {
+		le := label{"le", strconv.FormatFloat(bound, 'g', -1, 64)}
+		m.sample(name+"_bucket", withLabel(labels, le), float64(h.Counts[i]))
+	}
+	m.sample(name+"_bucket", withLabel(labels, label{"le", "+Inf"}), float64(h.Count))
+	m.sample(name+"_sum", labels, h.Sum)
+	m.sample(name+"_count", labels, float64(h.Count))
+}
+
+// metricsHandler serves the metrics of every store, labelled with their
+// namespaces.
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	stores := collectMetrics()
+	w.Header().Set("Content-Type", metricsContentType)
+	bw := bufio.NewWriter(w)
+	m := metricsWriter{bw}
+	ns := func(s storeMetrics) []label {
+		return []label{{"namespace", s.namespace}}
+	}
+
+	histograms := []struct {
+		name, help string
+		get        func(datastore.Stats) datastore.Histogram
+	}{
+		{"db_get_duration_seconds", "Duration of value reads.", func(s datastore.Stats) datastore.Histogram { return s.GetLatency }},
+		{"db_put_duration_seconds", "Duration of writes, including deletions, batches and replicated records.", func(s datastore.Stats) datastore.Histogram { return s.PutLatency }},
+		{"db_merge_duration_seconds", "Duration of segment merges.", func(s datastore.Stats) datastore.Histogram { return s.MergeDuration }},
+	}
+	for _, h := range histograms {
+		m.header(h.name, "histogram", h.help)
+		for _, s := range stores {
+			m.histogram(h.name, ns(s), h.get(s.stats))
+		}
+	}
+
+	values := []struct {
+		name, kind, help string
+		get              func(storeMetrics) float64
+	}{
+		{"db_checksum_failures_total", "counter", "Records that failed their hash sum or authentication tag when read.", func(s storeMetrics) float64 { return float64(s.stats.ChecksumFailures) }},
+		{"db_merges_total", "counter", "Completed segment merges.", func(s storeMetrics) float64 { return float64(s.stats.Merges) }},
+		{"db_merge_failures_total", "counter", "Failed segment merges.", func(s storeMetrics) float64 { return float64(s.stats.MergeFailures) }},
+		{"db_cache_hits_total", "counter", "Reads served by the value cache.", func(s storeMetrics) float64 { return float64(s.stats.CacheHits) }},
+		{"db_cache_misses_total", "counter", "Reads that missed the value cache.", func(s storeMetrics) float64 { return float64(s.stats.CacheMisses) }},
+		{"db_segments", "gauge", "Sealed segments.", func(s storeMetrics) float64 { return float64(len(s.stats.Segments)) }},
+		{"db_keys", "gauge", "Keys that have values.", func(s storeMetrics) float64 { return float64(s.usage.Keys) }},
+		{"db_bytes", "gauge", "Size of the keys that have values and of their values.", func(s storeMetrics) float64 { return float64(s.usage.Bytes) }},
+	}
+	for _, v := range values {
+		m.header(v.name, v.kind, v.help)
+		for _, s := range stores {
+			m.sample(v.name, ns(s), v.get(s))
+		}
+	}
+
+	// The current data file is labelled segment="current".
+	m.header("db_segment_bytes", "gauge", "Size of the data files.")
+	for _, s := range stores {
+		for _, seg := range s.stats.Segments {
+			m.sample("db_segment_bytes", withLabel(ns(s), label{"segment", strconv.FormatUint(seg.Gen, 10)}), float64(seg.Bytes))
+		}
+		m.sample("db_segment_bytes", withLabel(ns(s), label{"segment", "current"}), float64(s.stats.CurrentBytes))
+	}
+	m.header("db_index_keys", "gauge", "Keys in the hash indexes of the data files, including deleted ones.")
+	for _, s := range stores {
+		for _, seg := range s.stats.Segments {
+			m.sample("db_index_keys", withLabel(ns(s), label{"segment", strconv.FormatUint(seg.Gen, 10)}), float64(seg.Keys))
+		}
+		m.sample("db_index_keys", withLabel(ns(s), label{"segment", "current"}), float64(s.stats.CurrentKeys))
+	}
+	_ = bw.Flush()
+}
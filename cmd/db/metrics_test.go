@@ -0,0 +1,77 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetrics(t *testing.T) {
+	store = newTestDb(t)
+	var err error
+	namespaces, err = openNamespaces(t.TempDir())
+	assert.Nil(t, err, err)
+	defer func() {
+		namespaces.close()
+		namespaces = nil
+	}()
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusCreated, requestStatus(t, "POST", srv.URL+"/namespaces", `{"name": "team"}`))
+	assert.Equal(t, http.StatusAccepted, requestStatus(t, "POST", srv.URL+"/db/a", `{"value": "1"}`))
+	assert.Equal(t, http.StatusOK, requestStatus(t, "GET", srv.URL+"/db/a", ""))
+	assert.Equal(t, http.StatusAccepted, requestStatus(t, "POST", srv.URL+"/db/team/b", `{"value": "2"}`))
+	assert.Equal(t, http.StatusAccepted, requestStatus(t, "DELETE", srv.URL+"/db/team/b", ""))
+
+	resp := request(t, "GET", srv.URL+"/metrics", "")
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err, err)
+	assert.Equal(t, metricsContentType, resp.Header.Get("Content-Type"))
+	lines := make(map[string]bool)
+	scanner := bufio.NewScanner(strings.NewReader(string(body)))
+	for scanner.Scan() {
+		lines[scanner.Text()] = true
+	}
+	for _, line := range []string{
+		"# TYPE db_get_duration_seconds histogram",
+		`db_get_duration_seconds_count{namespace=""} 1`,
+		`db_get_duration_seconds_bucket{namespace="",le="+Inf"} 1`,
+		`db_put_duration_seconds_count{namespace="team"} 2`,
+		"# TYPE db_checksum_failures_total counter",
+		`db_checksum_failures_total{namespace=""} 0`,
+		`db_merges_total{namespace="team"} 0`,
+		`db_keys{namespace=""} 1`,
+		`db_keys{namespace="team"} 0`,
+		`db_index_keys{namespace="team",segment="current"} 1`,
+		`db_segment_bytes{namespace="",segment="current"} 50`,
+	} {
+		assert.True(t, lines[line], "missing %q in\n%s", line, body)
+	}
+}
+
+func TestMetricsWriter(t *testing.T) {
+	var out strings.Builder
+	w := bufio.NewWriter(&out)
+	m := metricsWriter{w}
+	m.histogram("latency", []label{{"namespace", `a"b`}}, datastore.Histogram{
+		Bounds: []float64{0.001, 0.5},
+		Counts: []uint64{1, 3},
+		Count:  4,
+		Sum:    2.25,
+	})
+	w.Flush()
+	assert.Equal(t, `latency_bucket{namespace="a\"b",le="0.001"} 1
+latency_bucket{namespace="a\"b",le="0.5"} 3
+latency_bucket{namespace="a\"b",le="+Inf"} 4
+latency_sum{namespace="a\"b"} 2.25
+latency_count{namespace="a\"b"} 4
+`, out.String())
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+const (
+	namespacesFileName = "namespaces.json"
+	minSegmentLimit    = 1024
+	maxSegmentLimit    = 1024 * 1024 * 1024
+)
+
+var (
+	errNamespaceNotFound = errors.New("namespace does not exist")
+	errNamespaceExists   = errors.New("namespace already exists")
+	errNamespacesOff     = errors.New("namespaces aren't available in replica and cluster modes")
+)
+
+// Names starting with an underscore are left for endpoints like _scan.
+var namespaceName = regexp.MustCompile(`^[a-zA-Z0-9][a-zA-Z0-9_-]{0,63}$`)
+
+// namespaces holds the named databases next to the default store. It is nil
+// in replica and cluster modes, which only replicate the default store.
+var namespaces *namespaceSet
+
+type namespaceInfo struct {
+	Name         string `json:"name"`
+	SegmentLimit int64  `json:"segment_limit"`
+	// MaxKeys and MaxBytes are the quota of the namespace; zero is
+	// unlimited.
+	MaxKeys  int64 `json:"max_keys,omitempty"`
+	MaxBytes int64 `json:"max_bytes,omitempty"`
+}
+
+// options are the store options of the namespace.
+func (info namespaceInfo) options() []datastore.Option {
+	return append(storeOptions(), datastore.WithQuota(info.MaxKeys, info.MaxBytes))
+}
+
+type namespace struct {
+	namespaceInfo
+	db *datastore.Db
+}
+
+// namespaceSet keeps every namespace in its own directory under dir. The
+// list of namespaces is saved to namespaces.json in the same directory.
+type namespaceSet struct {
+	dir string
+	mu  sync.RWMutex
+	all map[string]*namespace
+}
+
+func openNamespaces(dir string) (*namespaceSet, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, err
+	}
+	s := &namespaceSet{dir: dir, all: make(map[string]*namespace)}
+	data, err := os.ReadFile(filepath.Join(dir, namespacesFileName))
+	if os.IsNotExist(err) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var infos []namespaceInfo
+	if err := json.Unmarshal(data, &infos); err != nil {
+		return nil, fmt.Errorf("corrupted namespace list: %w", err)
+	}
+	for _, info := range infos {
+		db, err := datastore.NewDb(filepath.Join(dir, info.Name), info.SegmentLimit, info.options()...)
+		if err != nil {
+			s.close()
+			return nil, fmt.Errorf("opening namespace %s: %w", info.Name, err)
+		}
+		s.all[info.Name] = &namespace{namespaceInfo: info, db: db}
+	}
+	return s, nil
+}
+
+func (s *namespaceSet) get(name string) (*datastore.Db, error) {
+	ns, err := s.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return ns.db, nil
+}
+
+// lookup returns a namespace along with its settings.
+func (s *namespaceSet) lookup(name string) (*namespace, error) {
+	if s == nil {
+		return nil, errNamespacesOff
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ns, ok := s.all[name]
+	if !ok {
+		return nil, errNamespaceNotFound
+	}
+	return ns, nil
+}
+
+func (s *namespaceSet) list() []namespaceInfo {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	infos := make([]namespaceInfo, 0, len(s.all))
+	for _, ns := range s.all {
+		infos = append(infos, ns.namespaceInfo)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name < infos[j].Name })
+	return infos
+}
+
+func (s *namespaceSet) create(info namespaceInfo) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.all[info.Name]; ok {
+		return errNamespaceExists
+	}
+	dir := filepath.Join(s.dir, info.Name)
+	// Leftovers of a namespace that was dropped halfway.
+	if err := os.RemoveAll(dir); err != nil {
+		return err
+	}
+	if err := os.Mkdir(dir, 0o755); err != nil {
+		return err
+	}
+	db, err := datastore.NewDb(dir, info.SegmentLimit, info.options()...)
+	if err != nil {
+		os.RemoveAll(dir)
+		return err
+	}
+	s.all[info.Name] = &namespace{namespaceInfo: info, db: db}
+	if err := s.save(); err != nil {
+		delete(s.all, info.Name)
+		db.Close()
+		os.RemoveAll(dir)
+		return err
+	}
+	return nil
+}
+
+// drop removes a namespace with all its data. Requests still using its Db
+// fail with datastore.ErrClosed.
+func (s *namespaceSet) drop(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ns, ok := s.all[name]
+	if !ok {
+		return errNamespaceNotFound
+	}
+	delete(s.all, name)
+	if err := s.save(); err != nil {
+		s.all[name] = ns
+		return err
+	}
+	ns.db.Close()
+	return os.RemoveAll(filepath.Join(s.dir, name))
+}
+
+// save writes the list of namespaces. s.mu must be held.
+func (s *namespaceSet) save() error {
+	infos := make([]namespaceInfo, 0, len(s.all))
+	for _, ns := range s.all {
+		infos = append(infos, ns.namespaceInfo)
+	}
+	data, err := json.MarshalIndent(infos, "", "  ")
+	if err != nil {
+		return err
+	}
+	path := filepath.Join(s.dir, namespacesFileName)
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *namespaceSet) close() {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, ns := range s.all {
+		ns.db.Close()
+	}
+}
+
+// requestStore returns the Db a request is for: the one of the namespace in
+// its path, or the default store. If there's no such namespace, it responds
+// with an error and returns nil.
+func requestStore(w http.ResponseWriter, r *http.Request) *datastore.Db {
+	name, ok := mux.Vars(r)["namespace"]
+	if !ok {
+		return store
+	}
+	db, err := namespaces.get(name)
+	if err != nil {
+		httpError(w, http.StatusNotFound, codeNotFound, err.Error())
+		return nil
+	}
+	return db
+}
+
+func listNamespaces(w http.ResponseWriter, r *http.Request) {
+	if namespaces == nil {
+		httpError(w, http.StatusNotImplemented, codeNotImplemented, errNamespacesOff.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(namespaces.list())
+}
+
+// createNamespace creates the namespace described by a JSON body like
+// {"name": "team", "segment_limit": 1048576, "max_keys": 1000}. All but the
+// name are optional, the quota defaults to -max-keys and -max-bytes.
+func createNamespace(w http.ResponseWriter, r *http.Request) {
+	if namespaces == nil {
+		httpError(w, http.StatusNotImplemented, codeNotImplemented, errNamespacesOff.Error())
+		return
+	}
+	if rejectMaintenance(w) {
+		return
+	}
+	info := namespaceInfo{SegmentLimit: *segmentSize, MaxKeys: *maxKeys, MaxBytes: *maxBytes}
+	if err := json.NewDecoder(r.Body).Decode(&info); err != nil {
+		httpError(w, http.StatusBadRequest, codeBadRequest, "Failed to parse JSON")
+		return
+	}
+	if !namespaceName.MatchString(info.Name) {
+		httpError(w, http.StatusBadRequest, codeBadRequest, "Invalid namespace name")
+		return
+	}
+	if info.SegmentLimit < minSegmentLimit || info.SegmentLimit > maxSegmentLimit {
+		httpError(w, http.StatusBadRequest, codeBadRequest, fmt.Sprintf("Segment limit must be between %d and %d bytes", minSegmentLimit, maxSegmentLimit))
+		return
+	}
+	if info.MaxKeys < 0 || info.MaxBytes < 0 {
+		httpError(w, http.StatusBadRequest, codeBadRequest, "Quota must not be negative")
+		return
+	}
+	err := namespaces.create(info)
+	switch {
+	case err == errNamespaceExists:
+		httpError(w, http.StatusConflict, codeConflict, err.Error())
+		return
+	case err != nil:
+		httpError(w, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	_ = json.NewEncoder(w).Encode(info)
+}
+
+func dropNamespace(w http.ResponseWriter, r *http.Request) {
+	if namespaces == nil {
+		httpError(w, http.StatusNotImplemented, codeNotImplemented, errNamespacesOff.Error())
+		return
+	}
+	if rejectMaintenance(w) {
+		return
+	}
+	err := namespaces.drop(mux.Vars(r)["namespace"])
+	switch {
+	case err == errNamespaceNotFound:
+		httpError(w, http.StatusNotFound, codeNotFound, err.Error())
+		return
+	case err != nil:
+		httpError(w, http.StatusInternalServerError, codeInternal, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func request(t *testing.T, method, url, body string) *http.Response {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	assert.Nil(t, err, err)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err, err)
+	return resp
+}
+
+func requestStatus(t *testing.T, method, url, body string) int {
+	resp := request(t, method, url, body)
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestNamespaces(t *testing.T) {
+	store = newTestDb(t)
+	dir := t.TempDir()
+	var err error
+	namespaces, err = openNamespaces(dir)
+	assert.Nil(t, err, err)
+	defer func() {
+		namespaces.close()
+		namespaces = nil
+	}()
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusCreated, requestStatus(t, "POST", srv.URL+"/namespaces", `{"name": "team-a", "segment_limit": 2048}`))
+	assert.Equal(t, http.StatusCreated, requestStatus(t, "POST", srv.URL+"/namespaces", `{"name": "team-b"}`))
+	assert.Equal(t, http.StatusConflict, requestStatus(t, "POST", srv.URL+"/namespaces", `{"name": "team-a"}`))
+	assert.Equal(t, http.StatusBadRequest, requestStatus(t, "POST", srv.URL+"/namespaces", `{"name": "_scan"}`))
+	assert.Equal(t, http.StatusBadRequest, requestStatus(t, "POST", srv.URL+"/namespaces", `{"name": "c", "segment_limit": 10}`))
+
+	t.Run("keys are separated", func(t *testing.T) {
+		assert.Equal(t, http.StatusAccepted, requestStatus(t, "POST", srv.URL+"/db/team-a/key", `{"value": "a"}`))
+		assert.Equal(t, http.StatusAccepted, requestStatus(t, "POST", srv.URL+"/db/team-b/key", `{"value": "b"}`))
+		assert.Equal(t, http.StatusNotFound, requestStatus(t, "GET", srv.URL+"/db/key", ""))
+		assert.Equal(t, http.StatusNotFound, requestStatus(t, "POST", srv.URL+"/db/team-c/key", `{"value": "c"}`))
+
+		resp := request(t, "GET", srv.URL+"/db/team-a/key", "")
+		var res getRes
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&res))
+		resp.Body.Close()
+		assert.Equal(t, getRes{Key: "key", Value: "a"}, res)
+
+		resp = request(t, "GET", srv.URL+"/db/team-b/_scan", "")
+		var scan scanRes
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&scan))
+		resp.Body.Close()
+		if assert.Len(t, scan.Items, 1) {
+			assert.Equal(t, "b", scan.Items[0].Value)
+		}
+	})
+
+	t.Run("list", func(t *testing.T) {
+		resp := request(t, "GET", srv.URL+"/namespaces", "")
+		var infos []namespaceInfo
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&infos))
+		resp.Body.Close()
+		assert.Equal(t, []namespaceInfo{{Name: "team-a", SegmentLimit: 2048}, {Name: "team-b", SegmentLimit: mb10}}, infos)
+	})
+
+	t.Run("drop", func(t *testing.T) {
+		assert.Equal(t, http.StatusNoContent, requestStatus(t, "DELETE", srv.URL+"/namespaces/team-b", ""))
+		assert.Equal(t, http.StatusNotFound, requestStatus(t, "DELETE", srv.URL+"/namespaces/team-b", ""))
+		assert.Equal(t, http.StatusNotFound, requestStatus(t, "GET", srv.URL+"/db/team-b/key", ""))
+	})
+
+	t.Run("reopen", func(t *testing.T) {
+		namespaces.close()
+		namespaces, err = openNamespaces(dir)
+		assert.Nil(t, err, err)
+		assert.Equal(t, []namespaceInfo{{Name: "team-a", SegmentLimit: 2048}}, namespaces.list())
+		assert.Equal(t, http.StatusOK, requestStatus(t, "GET", srv.URL+"/db/team-a/key", ""))
+	})
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/roman-mazur/design-practice-2-template/raft"
+)
+
+// forwardedHeader marks a request a follower forwarded to the leader, so it
+// isn't forwarded again while the leadership changes.
+const forwardedHeader = "X-Db-Forwarded-By"
+
+// cluster replicates the writes through Raft when the database runs as a
+// member of a cluster.
+var cluster *raft.Node
+
+// dbMachine applies the writes committed by the cluster to a Db. A command
+// is a JSON record, or an array of records put as a batch. Snapshots are Db
+// snapshots prefixed with their sequence number.
+type dbMachine struct {
+	db *datastore.Db
+}
+
+func (m dbMachine) Apply(data []byte) error {
+	return applyError(m.apply(data))
+}
+
+func (m dbMachine) apply(data []byte) error {
+	if bytes.HasPrefix(data, []byte("[")) {
+		var records []datastore.Record
+		if err := json.Unmarshal(data, &records); err != nil {
+			return raft.Reject(err)
+		}
+		pairs := make([]datastore.KeyValue, len(records))
+		for i, rec := range records {
+			pairs[i] = datastore.KeyValue{Key: rec.Key, Value: rec.Value}
+		}
+		return m.db.PutBatch(context.Background(), pairs)
+	}
+	var rec datastore.Record
+	if err := json.Unmarshal(data, &rec); err != nil {
+		return raft.Reject(err)
+	}
+	if rec.Deleted {
+		return m.db.Delete(rec.Key)
+	}
+	return m.db.Put(rec.Key, rec.Value)
+}
+
+// applyError rejects the writes that every node refuses alike, as they break
+// the limits of the store. Other errors, like those of I/O, are left for
+// Raft to retry the write.
+func applyError(err error) error {
+	switch {
+	case errors.Is(err, datastore.ErrKeyTooLarge),
+		errors.Is(err, datastore.ErrValueTooLarge),
+		errors.Is(err, datastore.ErrQuotaExceeded):
+		return raft.Reject(err)
+	}
+	return err
+}
+
+func (m dbMachine) Snapshot() (io.ReadCloser, error) {
+	snapshot, seq, err := m.db.Snapshot()
+	if err != nil {
+		return nil, err
+	}
+	header := binary.LittleEndian.AppendUint64(nil, seq)
+	return struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(header), snapshot), snapshot}, nil
+}
+
+func (m dbMachine) Restore(r io.Reader) error {
+	var header [8]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return err
+	}
+	return m.db.Restore(r, binary.LittleEndian.Uint64(header[:]))
+}
+
+func (m dbMachine) Sync() error {
+	return m.db.Sync()
+}
+
+// startCluster joins the cluster of peers as the node with id, which is the
+// address the other nodes reach it at.
+func startCluster(id string, peers []string, dir string, db *datastore.Db) (*raft.Node, error) {
+	return raft.NewNode(raft.Config{
+		ID:           id,
+		Peers:        peers,
+		Dir:          dir,
+		Transport:    &httpTransport{client: peerClient()},
+		StateMachine: dbMachine{db},
+	})
+}
+
+// httpTransport sends the Raft requests as JSON to the /_raft endpoints of
+// the peers.
+type httpTransport struct {
+	client *http.Client
+}
+
+func (t *httpTransport) call(ctx context.Context, peer, path string, req, resp interface{}) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	httpReq, err := http.NewRequestWithContext(ctx, "POST", peer+path, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	httpReq.Header.Set("Content-Type", "application/json")
+	httpResp, err := t.client.Do(httpReq)
+	if err != nil {
+		return fmt.Errorf("%w: %s", raft.ErrUnreachable, err)
+	}
+	defer httpResp.Body.Close()
+	if httpResp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(httpResp.Body)
+		return fmt.Errorf("%s%s: %s: %s", peer, path, httpResp.Status, strings.TrimSpace(string(msg)))
+	}
+	return json.NewDecoder(httpResp.Body).Decode(resp)
+}
+
+func (t *httpTransport) RequestVote(ctx context.Context, peer string, req raft.VoteRequest) (raft.VoteResponse, error) {
+	var resp raft.VoteResponse
+	err := t.call(ctx, peer, "/_raft/vote", req, &resp)
+	return resp, err
+}
+
+func (t *httpTransport) AppendEntries(ctx context.Context, peer string, req raft.AppendRequest) (raft.AppendResponse, error) {
+	var resp raft.AppendResponse
+	err := t.call(ctx, peer, "/_raft/append", req, &resp)
+	return resp, err
+}
+
+func (t *httpTransport) InstallSnapshot(ctx context.Context, peer string, req raft.SnapshotRequest) (raft.SnapshotResponse, error) {
+	var resp raft.SnapshotResponse
+	err := t.call(ctx, peer, "/_raft/snapshot", req, &resp)
+	return resp, err
+}
+
+// raftHandler serves the requests of the other nodes of the cluster.
+type raftHandler struct {
+	node *raft.Node
+}
+
+func (h raftHandler) register(router *mux.Router) {
+	router.HandleFunc("/_raft/vote", adminOnly(raftRPC(h.node.HandleVote))).Methods("POST")
+	router.HandleFunc("/_raft/append", adminOnly(raftRPC(h.node.HandleAppend))).Methods("POST")
+	router.HandleFunc("/_raft/snapshot", adminOnly(raftRPC(h.node.HandleSnapshot))).Methods("POST")
+	router.HandleFunc("/_raft/status", adminOnly(h.status)).Methods("GET")
+}
+
+func raftRPC[Req, Resp any](handle func(Req) (Resp, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req Req
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			httpError(w, http.StatusBadRequest, codeBadRequest, "Failed to parse JSON")
+			return
+		}
+		resp, err := handle(req)
+		if err != nil {
+			httpError(w, http.StatusServiceUnavailable, codeUnavailable, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(resp)
+	}
+}
+
+func (h raftHandler) status(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(h.node.Status())
+}
+
+// leaderOnly forwards the requests a follower gets to the leader of the
+// cluster. Without a cluster the requests are served locally.
+func leaderOnly(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cluster == nil || cluster.IsLeader() {
+			h(w, r)
+			return
+		}
+		leader := cluster.Leader()
+		target, err := url.Parse(leader)
+		if leader == "" || err != nil || r.Header.Get(forwardedHeader) != "" {
+			clusterUnavailable(w, &raft.NotLeaderError{Leader: leader})
+			return
+		}
+		r.Header.Set(forwardedHeader, cluster.ID())
+		proxy := httputil.NewSingleHostReverseProxy(target)
+		proxy.Transport = forwardTransport
+		proxy.ServeHTTP(w, r)
+	}
+}
+
+func clusterUnavailable(w http.ResponseWriter, err error) {
+	w.Header().Set("Retry-After", "1")
+	httpError(w, http.StatusServiceUnavailable, codeNotLeader, err.Error())
+}
+
+// writeBatch writes pairs atomically through the cluster, or directly to db
+// when there is none.
+func writeBatch(ctx context.Context, db *datastore.Db, pairs []datastore.KeyValue) error {
+	if cluster == nil {
+		return db.PutBatch(ctx, pairs)
+	}
+	records := make([]datastore.Record, len(pairs))
+	for i, kv := range pairs {
+		records[i] = datastore.Record{Key: kv.Key, Value: kv.Value}
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return cluster.Propose(ctx, data)
+}
+
+// writeRecord makes a write through the cluster, or directly to db when
+// there is none. A cluster only has the default store.
+func writeRecord(ctx context.Context, db *datastore.Db, rec datastore.Record) error {
+	if cluster == nil {
+		if rec.Deleted {
+			return db.DeleteContext(ctx, rec.Key)
+		}
+		return db.PutContext(ctx, rec.Key, rec.Value)
+	}
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	return cluster.Propose(ctx, data)
+}
+
+// syncRead makes the reads that follow it linearizable in a cluster.
+func syncRead(ctx context.Context) error {
+	if cluster == nil {
+		return nil
+	}
+	return cluster.ReadIndex(ctx)
+}
+
+// parsePeers splits a comma-separated list of node addresses.
+func parsePeers(list string) []string {
+	var peers []string
+	for _, peer := range strings.Split(list, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			peers = append(peers, strings.TrimSuffix(peer, "/"))
+		}
+	}
+	return peers
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/roman-mazur/design-practice-2-template/raft"
+	"github.com/stretchr/testify/assert"
+)
+
+func waitForLeader(t *testing.T, nodes []*raft.Node) *raft.Node {
+	var leader *raft.Node
+	waitFor(t, func() bool {
+		for _, n := range nodes {
+			if n.IsLeader() {
+				leader = n
+				return true
+			}
+		}
+		return false
+	})
+	return leader
+}
+
+func propose(n *raft.Node, rec datastore.Record) error {
+	data, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	return n.Propose(ctx, data)
+}
+
+func waitForValue(t *testing.T, db *datastore.Db, key, value string) {
+	waitFor(t, func() bool {
+		v, _ := db.Get(key)
+		return v == value
+	})
+}
+
+func TestRaftCluster(t *testing.T) {
+	var (
+		routers []*mux.Router
+		peers   []string
+		dbs     []*datastore.Db
+		nodes   []*raft.Node
+	)
+	for i := 0; i < 3; i++ {
+		router := mux.NewRouter()
+		srv := httptest.NewServer(router)
+		defer srv.Close()
+		routers = append(routers, router)
+		peers = append(peers, srv.URL)
+	}
+	for i, id := range peers {
+		db := newTestDb(t)
+		node, err := startCluster(id, peers, t.TempDir(), db)
+		if !assert.Nil(t, err, err) {
+			return
+		}
+		defer node.Stop()
+		raftHandler{node}.register(routers[i])
+		dbs = append(dbs, db)
+		nodes = append(nodes, node)
+	}
+
+	leader := waitForLeader(t, nodes)
+	assert.Nil(t, propose(leader, datastore.Record{Key: "a", Value: "1"}))
+	assert.Nil(t, propose(leader, datastore.Record{Key: "b", Value: "2"}))
+	assert.Nil(t, propose(leader, datastore.Record{Key: "a", Deleted: true}))
+	for _, db := range dbs {
+		waitForValue(t, db, "b", "2")
+		waitFor(t, func() bool {
+			_, err := db.Get("a")
+			return err == datastore.ErrNotFound
+		})
+	}
+
+	batch, _ := json.Marshal([]datastore.Record{{Key: "c", Value: "3"}, {Key: "d", Value: "4"}})
+	assert.Nil(t, leader.Propose(context.Background(), batch))
+	for _, db := range dbs {
+		waitForValue(t, db, "d", "4")
+		value, _ := db.Get("c")
+		assert.Equal(t, "3", value)
+	}
+
+	for _, n := range nodes {
+		if n != leader {
+			err := propose(n, datastore.Record{Key: "c", Value: "3"})
+			if assert.IsType(t, &raft.NotLeaderError{}, err) {
+				assert.Equal(t, leader.ID(), err.(*raft.NotLeaderError).Leader)
+			}
+		}
+	}
+	assert.Nil(t, leader.ReadIndex(context.Background()))
+}
+
+func TestRaftSnapshot(t *testing.T) {
+	network := raft.NewNetwork()
+	ids := []string{"db0", "db1", "db2"}
+	var (
+		dbs   []*datastore.Db
+		nodes []*raft.Node
+	)
+	for _, id := range ids {
+		db := newTestDb(t)
+		node, err := raft.NewNode(raft.Config{
+			ID:                id,
+			Peers:             ids,
+			Transport:         network.Transport(id),
+			StateMachine:      dbMachine{db},
+			SnapshotThreshold: 10,
+		})
+		if !assert.Nil(t, err, err) {
+			return
+		}
+		defer node.Stop()
+		network.Add(node)
+		dbs = append(dbs, db)
+		nodes = append(nodes, node)
+	}
+
+	leader := waitForLeader(t, nodes)
+	lagging := 0
+	if nodes[lagging] == leader {
+		lagging = 1
+	}
+	network.Disconnect(ids[lagging])
+	for i := 0; i < 50; i++ {
+		assert.Nil(t, propose(leader, datastore.Record{Key: fmt.Sprintf("key%d", i), Value: fmt.Sprint(i)}))
+	}
+	waitFor(t, func() bool { return leader.Status().SnapshotIndex > 0 })
+
+	network.Connect(ids[lagging])
+	waitForValue(t, dbs[lagging], "key49", "49")
+	waitForValue(t, dbs[lagging], "key0", "0")
+	assert.NotZero(t, nodes[lagging].Status().SnapshotIndex)
+}
+
+func TestDbMachine_ApplyErrors(t *testing.T) {
+	db := newTestDb(t, datastore.WithMaxKeySize(4))
+	m := dbMachine{db}
+	var rejected *raft.RejectedError
+	assert.ErrorAs(t, m.Apply([]byte(`{"key": "too long", "value": "v"}`)), &rejected)
+	assert.ErrorIs(t, m.Apply([]byte(`{"key": "too long", "value": "v"}`)), datastore.ErrKeyTooLarge)
+	assert.ErrorAs(t, m.Apply([]byte(`{bad`)), &rejected)
+
+	assert.Nil(t, db.SetReadOnly(true))
+	err := m.Apply([]byte(`{"key": "a", "value": "v"}`))
+	assert.ErrorIs(t, err, datastore.ErrReadOnly)
+	assert.False(t, errors.As(err, &rejected), "the write is retried")
+}
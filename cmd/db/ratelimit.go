@@ -0,0 +1,106 @@
+package main
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const rateLimitedMessage = "Too many requests, slow down"
+
+// bucket is the token bucket of a client. It holds up to burst tokens, gains
+// rate tokens a second and every request takes one.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter limits the request rate of every client separately.
+type rateLimiter struct {
+	rate  float64
+	burst float64
+
+	mu      sync.Mutex
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = int(math.Ceil(rate))
+	}
+	return &rateLimiter{rate: rate, burst: float64(burst), buckets: make(map[string]*bucket)}
+}
+
+// allow takes a token from the bucket of client. If it's empty, allow
+// returns false and how long until the next token.
+func (l *rateLimiter) allow(client string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+	b, ok := l.buckets[client]
+	if !ok {
+		b = &bucket{tokens: l.burst, last: now}
+		l.buckets[client] = b
+	}
+	b.tokens = math.Min(l.burst, b.tokens+now.Sub(b.last).Seconds()*l.rate)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / l.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep forgets the clients whose buckets have refilled, as they are no
+// different from new ones. l.mu must be held.
+func (l *rateLimiter) sweep(now time.Time) {
+	refill := time.Duration(l.burst / l.rate * float64(time.Second))
+	if now.Sub(l.swept) < refill {
+		return
+	}
+	l.swept = now
+	for client, b := range l.buckets {
+		if now.Sub(b.last) >= refill {
+			delete(l.buckets, client)
+		}
+	}
+}
+
+// limiter limits the requests to the keys. It is nil when -rate-limit is 0.
+var limiter *rateLimiter
+
+// clientOf tells who sent a request: the name of its token when
+// authentication is on, or else the address it came from.
+func clientOf(r *http.Request) string {
+	if p, ok := r.Context().Value(principalKey{}).(*principal); ok {
+		return "token " + p.name
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitRate replies 429 to the requests to the keys over the rate limit of
+// their client. The other endpoints are for operators and aren't limited.
+func limitRate(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if limiter == nil || !strings.HasPrefix(r.URL.Path, "/db/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if ok, wait := limiter.allow(clientOf(r), time.Now()); !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			httpError(w, http.StatusTooManyRequests, codeRateLimited, rateLimitedMessage)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
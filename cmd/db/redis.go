@@ -0,0 +1,530 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"log"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/roman-mazur/design-practice-2-template/resp"
+)
+
+const (
+	defaultRedisScanCount = 10
+	// maxRedisCursors bounds the SCAN cursors kept; the oldest are dropped.
+	maxRedisCursors     = 1024
+	expirySweepInterval = time.Second
+)
+
+// redisExpiry is a deadline set by EXPIRE or SET EX. It only applies while
+// the key still has the value it was set for, so a write through another
+// interface cancels it.
+type redisExpiry struct {
+	deadline time.Time
+	sum      [sha256.Size]byte
+}
+
+// redisHandler maps Redis commands onto the default store. Deadlines are
+// kept in memory: keys expire while the process runs, and lose their
+// deadlines on restart.
+type redisHandler struct {
+	mu       sync.Mutex
+	expiries map[string]redisExpiry
+	// SCAN cursors are numbers, so they stand for the last returned keys.
+	cursors     map[uint64]string
+	cursorOrder []uint64
+	nextCursor  uint64
+
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newRedisHandler() *redisHandler {
+	h := &redisHandler{
+		expiries: make(map[string]redisExpiry),
+		cursors:  make(map[uint64]string),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	go h.sweep()
+	return h
+}
+
+func (h *redisHandler) close() {
+	close(h.stop)
+	<-h.done
+}
+
+// sweep removes the keys that expired without being read.
+func (h *redisHandler) sweep() {
+	defer close(h.done)
+	ticker := time.NewTicker(expirySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-h.stop:
+			return
+		case <-ticker.C:
+		}
+		h.mu.Lock()
+		var expired []string
+		now := time.Now()
+		for key, e := range h.expiries {
+			if !now.Before(e.deadline) {
+				expired = append(expired, key)
+			}
+		}
+		h.mu.Unlock()
+		for _, key := range expired {
+			ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+			h.get(ctx, key)
+			cancel()
+		}
+	}
+}
+
+// get reads key, deleting it if it has expired.
+func (h *redisHandler) get(ctx context.Context, key string) (string, error) {
+	value, err := store.GetContext(ctx, key)
+	if err != nil {
+		return "", err
+	}
+	h.mu.Lock()
+	e, ok := h.expiries[key]
+	if !ok {
+		h.mu.Unlock()
+		return value, nil
+	}
+	if e.sum != sha256.Sum256([]byte(value)) {
+		// The value was replaced since the deadline was set.
+		delete(h.expiries, key)
+		h.mu.Unlock()
+		return value, nil
+	}
+	if time.Now().Before(e.deadline) {
+		h.mu.Unlock()
+		return value, nil
+	}
+	delete(h.expiries, key)
+	h.mu.Unlock()
+	if _, err := writeBlock(); err != nil {
+		// The primary deletes it, or the first read after the maintenance.
+		return "", datastore.ErrNotFound
+	}
+	if err := writeRecord(ctx, store, datastore.Record{Key: key, Deleted: true}); err != nil {
+		return "", err
+	}
+	return "", datastore.ErrNotFound
+}
+
+func (h *redisHandler) setExpiry(key, value string, ttl time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.expiries[key] = redisExpiry{deadline: time.Now().Add(ttl), sum: sha256.Sum256([]byte(value))}
+}
+
+func (h *redisHandler) clearExpiry(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.expiries, key)
+}
+
+func (h *redisHandler) ServeRESP(w *resp.Writer, args []string) {
+	ctx, cancel := context.WithTimeout(context.Background(), storeTimeout)
+	defer cancel()
+	cmd, ok := redisCommands[args[0]]
+	if !ok {
+		w.Error(fmt.Sprintf("ERR unknown command '%s'", args[0]))
+		return
+	}
+	if len(args) < cmd.minArgs || (cmd.maxArgs > 0 && len(args) > cmd.maxArgs) {
+		w.Error(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(args[0])))
+		return
+	}
+	if cmd.write {
+		switch code, err := writeBlock(); code {
+		case codeReadOnly:
+			w.Error("READONLY You can't write against a read only replica.")
+			return
+		case codeMaintenance:
+			w.Error("TRYAGAIN " + err.Error())
+			return
+		}
+	}
+	if cmd.read {
+		if err := syncRead(ctx); err != nil {
+			redisError(w, ctx, err)
+			return
+		}
+	}
+	cmd.run(h, ctx, w, args)
+}
+
+type redisCommand struct {
+	// minArgs and maxArgs count the command name too. Zero maxArgs means
+	// no limit.
+	minArgs, maxArgs int
+	read, write      bool
+	run              func(h *redisHandler, ctx context.Context, w *resp.Writer, args []string)
+}
+
+var redisCommands = map[string]redisCommand{
+	"PING":    {1, 2, false, false, (*redisHandler).ping},
+	"COMMAND": {1, 0, false, false, (*redisHandler).command},
+	"CLIENT":  {2, 0, false, false, (*redisHandler).client},
+	"SELECT":  {2, 2, false, false, (*redisHandler).selectDb},
+	"GET":     {2, 2, true, false, (*redisHandler).getCmd},
+	"MGET":    {2, 0, true, false, (*redisHandler).mget},
+	"EXISTS":  {2, 0, true, false, (*redisHandler).exists},
+	"SCAN":    {2, 6, true, false, (*redisHandler).scan},
+	"TTL":     {2, 2, true, false, (*redisHandler).ttl},
+	"SET":     {3, 5, false, true, (*redisHandler).set},
+	"DEL":     {2, 0, true, true, (*redisHandler).del},
+	"EXPIRE":  {3, 3, true, true, (*redisHandler).expire},
+}
+
+// redisError replies with a failed write or read of the store.
+func redisError(w *resp.Writer, ctx context.Context, err error) {
+	_, code, err := errorCode(ctx, err)
+	w.Error(fmt.Sprintf("ERR %s: %s", code, err))
+}
+
+func (h *redisHandler) ping(ctx context.Context, w *resp.Writer, args []string) {
+	if len(args) == 2 {
+		w.Bulk(args[1])
+		return
+	}
+	w.Simple("PONG")
+}
+
+// command answers the introspection of redis-cli with no commands.
+func (h *redisHandler) command(ctx context.Context, w *resp.Writer, args []string) {
+	w.Array(0)
+}
+
+// client accepts the connection settings client libraries send.
+func (h *redisHandler) client(ctx context.Context, w *resp.Writer, args []string) {
+	w.Simple("OK")
+}
+
+func (h *redisHandler) selectDb(ctx context.Context, w *resp.Writer, args []string) {
+	if args[1] != "0" {
+		w.Error("ERR DB index is out of range")
+		return
+	}
+	w.Simple("OK")
+}
+
+func (h *redisHandler) getCmd(ctx context.Context, w *resp.Writer, args []string) {
+	value, err := h.get(ctx, args[1])
+	switch {
+	case err == datastore.ErrNotFound:
+		w.Null()
+	case err != nil:
+		redisError(w, ctx, err)
+	default:
+		w.Bulk(value)
+	}
+}
+
+func (h *redisHandler) mget(ctx context.Context, w *resp.Writer, args []string) {
+	values := make([]*string, len(args)-1)
+	for i, key := range args[1:] {
+		value, err := h.get(ctx, key)
+		if err == datastore.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			redisError(w, ctx, err)
+			return
+		}
+		values[i] = &value
+	}
+	w.Array(len(values))
+	for _, value := range values {
+		if value == nil {
+			w.Null()
+		} else {
+			w.Bulk(*value)
+		}
+	}
+}
+
+func (h *redisHandler) exists(ctx context.Context, w *resp.Writer, args []string) {
+	var n int64
+	for _, key := range args[1:] {
+		_, err := h.get(ctx, key)
+		if err == datastore.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			redisError(w, ctx, err)
+			return
+		}
+		n++
+	}
+	w.Int(n)
+}
+
+// set supports the EX and PX options.
+func (h *redisHandler) set(ctx context.Context, w *resp.Writer, args []string) {
+	key, value := args[1], args[2]
+	var ttl time.Duration
+	if len(args) > 3 {
+		if len(args) != 5 {
+			w.Error("ERR syntax error")
+			return
+		}
+		n, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil || n <= 0 {
+			w.Error("ERR invalid expire time in 'set' command")
+			return
+		}
+		switch strings.ToUpper(args[3]) {
+		case "EX":
+			ttl = time.Duration(n) * time.Second
+		case "PX":
+			ttl = time.Duration(n) * time.Millisecond
+		default:
+			w.Error("ERR syntax error")
+			return
+		}
+	}
+	if err := writeRecord(ctx, store, datastore.Record{Key: key, Value: value}); err != nil {
+		redisError(w, ctx, err)
+		return
+	}
+	if ttl > 0 {
+		h.setExpiry(key, value, ttl)
+	} else {
+		h.clearExpiry(key)
+	}
+	w.Simple("OK")
+}
+
+func (h *redisHandler) del(ctx context.Context, w *resp.Writer, args []string) {
+	var n int64
+	for _, key := range args[1:] {
+		_, err := h.get(ctx, key)
+		if err == datastore.ErrNotFound {
+			continue
+		}
+		if err == nil {
+			err = writeRecord(ctx, store, datastore.Record{Key: key, Deleted: true})
+		}
+		if err != nil {
+			redisError(w, ctx, err)
+			return
+		}
+		h.clearExpiry(key)
+		n++
+	}
+	w.Int(n)
+}
+
+func (h *redisHandler) expire(ctx context.Context, w *resp.Writer, args []string) {
+	key := args[1]
+	seconds, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		w.Error("ERR value is not an integer or out of range")
+		return
+	}
+	value, err := h.get(ctx, key)
+	if err == datastore.ErrNotFound {
+		w.Int(0)
+		return
+	}
+	if err != nil {
+		redisError(w, ctx, err)
+		return
+	}
+	if seconds <= 0 {
+		if err := writeRecord(ctx, store, datastore.Record{Key: key, Deleted: true}); err != nil {
+			redisError(w, ctx, err)
+			return
+		}
+		h.clearExpiry(key)
+	} else {
+		h.setExpiry(key, value, time.Duration(seconds)*time.Second)
+	}
+	w.Int(1)
+}
+
+func (h *redisHandler) ttl(ctx context.Context, w *resp.Writer, args []string) {
+	key := args[1]
+	value, err := h.get(ctx, key)
+	if err == datastore.ErrNotFound {
+		w.Int(-2)
+		return
+	}
+	if err != nil {
+		redisError(w, ctx, err)
+		return
+	}
+	h.mu.Lock()
+	e, ok := h.expiries[key]
+	h.mu.Unlock()
+	if !ok || e.sum != sha256.Sum256([]byte(value)) {
+		w.Int(-1)
+		return
+	}
+	w.Int(int64((time.Until(e.deadline) + time.Second/2) / time.Second))
+}
+
+// scan supports the MATCH and COUNT options. Like in Redis, a page may hold
+// fewer keys than COUNT, and the scan ends when the cursor is 0.
+func (h *redisHandler) scan(ctx context.Context, w *resp.Writer, args []string) {
+	cursor, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		w.Error("ERR invalid cursor")
+		return
+	}
+	count := defaultRedisScanCount
+	pattern := "*"
+	for i := 2; i < len(args); i += 2 {
+		if i+1 == len(args) {
+			w.Error("ERR syntax error")
+			return
+		}
+		switch strings.ToUpper(args[i]) {
+		case "MATCH":
+			pattern = args[i+1]
+		case "COUNT":
+			count, err = strconv.Atoi(args[i+1])
+			if err != nil || count <= 0 {
+				w.Error("ERR value is not an integer or out of range")
+				return
+			}
+			if count > maxScanLimit {
+				count = maxScanLimit
+			}
+		default:
+			w.Error("ERR syntax error")
+			return
+		}
+	}
+	prefix, match, err := globMatcher(pattern)
+	if err != nil {
+		w.Error("ERR invalid pattern")
+		return
+	}
+
+	var after string
+	if cursor != 0 {
+		var ok bool
+		h.mu.Lock()
+		after, ok = h.cursors[cursor]
+		h.mu.Unlock()
+		if !ok {
+			w.Error("ERR invalid cursor")
+			return
+		}
+	}
+	items, err := store.Scan(prefix, after, count)
+	if err != nil {
+		redisError(w, ctx, err)
+		return
+	}
+	var keys []string
+	for _, kv := range items {
+		if !match.MatchString(kv.Key) {
+			continue
+		}
+		if _, err := h.get(ctx, kv.Key); err == nil {
+			keys = append(keys, kv.Key)
+		}
+	}
+	var next uint64
+	if len(items) == count {
+		next = h.saveCursor(items[len(items)-1].Key)
+	}
+	w.Array(2)
+	w.Bulk(strconv.FormatUint(next, 10))
+	w.Array(len(keys))
+	for _, key := range keys {
+		w.Bulk(key)
+	}
+}
+
+func (h *redisHandler) saveCursor(after string) uint64 {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.nextCursor++
+	h.cursors[h.nextCursor] = after
+	h.cursorOrder = append(h.cursorOrder, h.nextCursor)
+	if len(h.cursorOrder) > maxRedisCursors {
+		delete(h.cursors, h.cursorOrder[0])
+		h.cursorOrder = h.cursorOrder[1:]
+	}
+	return h.nextCursor
+}
+
+// globMatcher compiles a Redis glob pattern. It also returns the literal
+// prefix of the pattern, which narrows down the keys to scan.
+func globMatcher(pattern string) (string, *regexp.Regexp, error) {
+	var prefix, re strings.Builder
+	literal := true
+	re.WriteString("(?s)^")
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch c {
+		case '*':
+			re.WriteString(".*")
+			literal = false
+		case '?':
+			re.WriteString(".")
+			literal = false
+		case '[':
+			end := strings.IndexByte(pattern[i+1:], ']')
+			if end < 0 {
+				return "", nil, fmt.Errorf("unterminated class in %q", pattern)
+			}
+			class := pattern[i+1 : i+1+end]
+			if strings.HasPrefix(class, "^") {
+				class = "^" + regexp.QuoteMeta(class[1:])
+			} else {
+				class = regexp.QuoteMeta(class)
+			}
+			re.WriteString("[" + class + "]")
+			i += end + 1
+			literal = false
+		case '\\':
+			if i+1 < len(pattern) {
+				i++
+				c = pattern[i]
+			}
+			fallthrough
+		default:
+			re.WriteString(regexp.QuoteMeta(string(c)))
+			if literal {
+				prefix.WriteByte(c)
+			}
+		}
+	}
+	re.WriteString("$")
+	compiled, err := regexp.Compile(re.String())
+	return prefix.String(), compiled, err
+}
+
+// startRedis serves the Redis protocol on port in the background.
+func startRedis(port int) (*resp.Server, *redisHandler, error) {
+	l, err := listen(port)
+	if err != nil {
+		return nil, nil, err
+	}
+	h := newRedisHandler()
+	srv := &resp.Server{Handler: h}
+	go func() {
+		if err := srv.Serve(l); err != resp.ErrServerClosed {
+			log.Fatalf("Redis server finished: %s. Finishing the process.", err)
+		}
+	}()
+	log.Printf("Serving the Redis protocol on port %d", port)
+	return srv, h, nil
+}
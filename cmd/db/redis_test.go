@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/resp"
+	"github.com/stretchr/testify/assert"
+)
+
+// readReply decodes a reply: strings for simple and bulk strings, "-..." for
+// errors, int64 for integers, nil for null and slices for arrays.
+func readReply(t *testing.T, r *bufio.Reader) interface{} {
+	line, err := r.ReadString('\n')
+	if !assert.Nil(t, err, err) {
+		t.FailNow()
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	switch line[0] {
+	case '+':
+		return line[1:]
+	case '-':
+		return line
+	case ':':
+		n, _ := strconv.ParseInt(line[1:], 10, 64)
+		return n
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return nil
+		}
+		data := make([]byte, n+2)
+		_, err := io.ReadFull(r, data)
+		assert.Nil(t, err, err)
+		return string(data[:n])
+	case '*':
+		n, _ := strconv.Atoi(line[1:])
+		items := make([]interface{}, n)
+		for i := range items {
+			items[i] = readReply(t, r)
+		}
+		return items
+	}
+	t.Fatalf("unexpected reply %q", line)
+	return nil
+}
+
+func dialRedis(t *testing.T, addr string) (net.Conn, *bufio.Reader) {
+	conn, err := net.Dial("tcp", addr)
+	if !assert.Nil(t, err, err) {
+		t.FailNow()
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn, bufio.NewReader(conn)
+}
+
+func TestRedis(t *testing.T) {
+	store = newTestDb(t)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	h := newRedisHandler()
+	defer h.close()
+	srv := &resp.Server{Handler: h}
+	go srv.Serve(l)
+	defer srv.Close()
+	addr := l.Addr().String()
+	conn, r := dialRedis(t, addr)
+
+	// The commands are pipelined.
+	fmt.Fprint(conn, "*3\r\n$3\r\nSET\r\n$1\r\na\r\n$1\r\n1\r\n")
+	fmt.Fprint(conn, "SET b 2\r\nSET c 3 PX 50\r\nGET a\r\nGET missing\r\nEXISTS a missing b\r\n")
+	fmt.Fprint(conn, "MGET a missing b\r\nDEL b missing\r\nTTL a\r\nNOPE\r\nget\r\n")
+	assert.Equal(t, "OK", readReply(t, r))
+	assert.Equal(t, "OK", readReply(t, r))
+	assert.Equal(t, "OK", readReply(t, r))
+	assert.Equal(t, "1", readReply(t, r))
+	assert.Nil(t, readReply(t, r))
+	assert.Equal(t, int64(2), readReply(t, r))
+	assert.Equal(t, []interface{}{"1", nil, "2"}, readReply(t, r))
+	assert.Equal(t, int64(1), readReply(t, r))
+	assert.Equal(t, int64(-1), readReply(t, r))
+	assert.Equal(t, "-ERR unknown command 'NOPE'", readReply(t, r))
+	assert.Equal(t, "-ERR wrong number of arguments for 'get' command", readReply(t, r))
+
+	t.Run("expire", func(t *testing.T) {
+		time.Sleep(60 * time.Millisecond)
+		fmt.Fprint(conn, "GET c\r\nEXPIRE a 100\r\nTTL a\r\nEXPIRE missing 10\r\nEXPIRE a 0\r\nEXISTS a\r\n")
+		assert.Nil(t, readReply(t, r))
+		assert.Equal(t, int64(1), readReply(t, r))
+		assert.Equal(t, int64(100), readReply(t, r))
+		assert.Equal(t, int64(0), readReply(t, r))
+		assert.Equal(t, int64(1), readReply(t, r))
+		assert.Equal(t, int64(0), readReply(t, r))
+		_, err := store.Get("c")
+		assert.NotNil(t, err)
+	})
+
+	t.Run("scan", func(t *testing.T) {
+		for i := 0; i < 25; i++ {
+			fmt.Fprintf(conn, "SET user:%02d x\r\n", i)
+		}
+		fmt.Fprint(conn, "SET other x\r\n")
+		for i := 0; i < 26; i++ {
+			assert.Equal(t, "OK", readReply(t, r))
+		}
+		var keys []interface{}
+		cursor := "0"
+		for {
+			fmt.Fprintf(conn, "SCAN %s MATCH user:?5 COUNT 10\r\n", cursor)
+			page := readReply(t, r).([]interface{})
+			keys = append(keys, page[1].([]interface{})...)
+			if cursor = page[0].(string); cursor == "0" {
+				break
+			}
+		}
+		assert.Equal(t, []interface{}{"user:05", "user:15"}, keys)
+	})
+
+	t.Run("concurrent connections", func(t *testing.T) {
+		var wg sync.WaitGroup
+		for i := 0; i < 5; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				conn, r := dialRedis(t, addr)
+				fmt.Fprintf(conn, "SET conn%d %d\r\nGET conn%d\r\n", i, i, i)
+				assert.Equal(t, "OK", readReply(t, r))
+				assert.Equal(t, fmt.Sprint(i), readReply(t, r))
+			}(i)
+		}
+		wg.Wait()
+	})
+}
+
+func TestGlobMatcher(t *testing.T) {
+	prefix, re, err := globMatcher(`user:[a-c]?\*x*`)
+	assert.Nil(t, err, err)
+	assert.Equal(t, "user:", prefix)
+	assert.True(t, re.MatchString("user:b1*xyz"))
+	assert.False(t, re.MatchString("user:d1*x"))
+	assert.False(t, re.MatchString("user:b1x"))
+}
@@ -0,0 +1,314 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+const (
+	// heartbeatInterval is how often the primary writes an empty line to an
+	// idle log stream. A replica reconnects after missing a few of them.
+	heartbeatInterval = 2 * time.Second
+	heartbeatMisses   = 3
+	logBatchSize      = 1000
+	retryDelay        = time.Second
+	maxLogLine        = 64 * 1024 * 1024
+	seqHeader         = "X-Db-Seq"
+)
+
+// streamLog serves the records of the append log starting with the from
+// query parameter as newline-delimited JSON. The stream doesn't end: it
+// follows new writes until the client disconnects.
+func streamLog(w http.ResponseWriter, r *http.Request) {
+	from, err := strconv.ParseUint(r.URL.Query().Get("from"), 10, 64)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, codeBadRequest, "Invalid from offset")
+		return
+	}
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+
+	started := false
+	start := func() {
+		if !started {
+			w.Header().Set("Content-Type", "application/x-ndjson")
+			w.WriteHeader(http.StatusOK)
+			started = true
+		}
+	}
+	enc := json.NewEncoder(w)
+	for {
+		ctx, cancel := context.WithTimeout(r.Context(), heartbeatInterval)
+		records, err := store.ReadLog(ctx, from, logBatchSize)
+		cancel()
+		switch {
+		case err == datastore.ErrLogTruncated && !started:
+			httpError(w, http.StatusGone, codeLogTruncated, err.Error())
+			return
+		case err == context.DeadlineExceeded && r.Context().Err() == nil:
+			start()
+			_, err = w.Write([]byte("\n"))
+		case err == nil:
+			start()
+			for _, rec := range records {
+				if err = enc.Encode(rec); err != nil {
+					break
+				}
+			}
+			from = records[len(records)-1].Seq + 1
+		}
+		if err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
+
+// serveSnapshot sends a snapshot of the store with its sequence number in
+// the X-Db-Seq header.
+func serveSnapshot(w http.ResponseWriter, r *http.Request) {
+	snapshot, seq, err := store.Snapshot()
+	if err != nil {
+		writeError(w, r.Context(), err)
+		return
+	}
+	defer snapshot.Close()
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set(seqHeader, strconv.FormatUint(seq, 10))
+	if _, err := io.Copy(w, snapshot); err != nil {
+		log.Printf("Failed to send snapshot: %s", err)
+	}
+}
+
+// serveValue streams the latest value of the key query parameter, for
+// replicas to fetch the Large records of the log.
+func serveValue(w http.ResponseWriter, r *http.Request) {
+	key := r.URL.Query().Get("key")
+	value, size, err := store.GetReader(key)
+	if err != nil {
+		writeError(w, r.Context(), err)
+		return
+	}
+	defer value.Close()
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", octetStream)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	if _, err := io.Copy(w, value); err != nil {
+		log.Printf("Failed to send %s to a replica: %s", key, err)
+	}
+}
+
+// replica follows the append log of a primary and applies it to a local
+// store until it is promoted.
+type replica struct {
+	primary string
+	store   *datastore.Db
+	client  *http.Client
+
+	mu       sync.Mutex
+	promoted bool
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+func startReplica(primary string, db *datastore.Db) *replica {
+	ctx, cancel := context.WithCancel(context.Background())
+	rp := &replica{
+		primary: primary,
+		store:   db,
+		client:  peerClient(),
+		cancel:  cancel,
+		done:    make(chan struct{}),
+	}
+	go rp.run(ctx)
+	return rp
+}
+
+func (rp *replica) run(ctx context.Context) {
+	defer close(rp.done)
+	for {
+		err := rp.follow(ctx)
+		if ctx.Err() != nil {
+			return
+		}
+		if err == nil {
+			// restored a snapshot, continue with the log right away
+			continue
+		}
+		log.Printf("Replication from %s interrupted: %s", rp.primary, err)
+		select {
+		case <-time.After(retryDelay):
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// follow applies the log stream of the primary until it breaks. If the
+// primary no longer has the records the store needs, it resyncs from a
+// snapshot instead.
+func (rp *replica) follow(ctx context.Context) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	url := fmt.Sprintf("%s/_replication/log?from=%d", rp.primary, rp.store.Seq()+1)
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusGone {
+		return rp.resync(ctx)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+
+	watchdog := time.AfterFunc(heartbeatInterval*heartbeatMisses, cancel)
+	defer watchdog.Stop()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(make([]byte, 64*1024), maxLogLine)
+	for scanner.Scan() {
+		watchdog.Reset(heartbeatInterval * heartbeatMisses)
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+		var rec datastore.Record
+		if err := json.Unmarshal(line, &rec); err != nil {
+			return err
+		}
+		if rec.Large {
+			// The value may take longer than the heartbeats to arrive.
+			watchdog.Stop()
+			err = rp.applyLarge(ctx, rec)
+			watchdog.Reset(heartbeatInterval * heartbeatMisses)
+		} else {
+			err = rp.store.Apply(ctx, rec)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return io.EOF
+}
+
+// applyLarge fetches the value of a Large record from the primary and applies
+// it. The primary has the latest value of the key, which later records in the
+// log overwrite again if it has changed since.
+func (rp *replica) applyLarge(ctx context.Context, rec datastore.Record) error {
+	url := fmt.Sprintf("%s/_replication/value?key=%s", rp.primary, url.QueryEscape(rec.Key))
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		return rp.store.ApplyReader(ctx, rec, resp.Body)
+	case http.StatusNotFound:
+		// Deleted since, and so is the key once the log gets there.
+		return rp.store.Apply(ctx, datastore.Record{Seq: rec.Seq, Key: rec.Key, Deleted: true})
+	}
+	return fmt.Errorf("unexpected status %s", resp.Status)
+}
+
+func (rp *replica) resync(ctx context.Context) error {
+	log.Printf("Replica is too far behind, restoring a snapshot from %s", rp.primary)
+	req, err := http.NewRequestWithContext(ctx, "GET", rp.primary+"/_replication/snapshot", nil)
+	if err != nil {
+		return err
+	}
+	resp, err := rp.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	seq, err := strconv.ParseUint(resp.Header.Get(seqHeader), 10, 64)
+	if err != nil {
+		return fmt.Errorf("bad snapshot sequence number: %w", err)
+	}
+	return rp.store.Restore(resp.Body, seq)
+}
+
+// promote stops replication so the store can accept writes.
+func (rp *replica) promote() {
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	if rp.promoted {
+		return
+	}
+	rp.promoted = true
+	rp.stop()
+	log.Printf("Promoted to primary at seq %d", rp.store.Seq())
+}
+
+// stop interrupts replication and waits for it to finish.
+func (rp *replica) stop() {
+	rp.cancel()
+	<-rp.done
+}
+
+func (rp *replica) isFollowing() bool {
+	if rp == nil {
+		return false
+	}
+	rp.mu.Lock()
+	defer rp.mu.Unlock()
+	return !rp.promoted
+}
+
+type replicationStatus struct {
+	Role    string `json:"role"`
+	Seq     uint64 `json:"seq"`
+	Primary string `json:"primary,omitempty"`
+}
+
+func (rp *replica) status() replicationStatus {
+	if rp.isFollowing() {
+		return replicationStatus{Role: "replica", Seq: rp.store.Seq(), Primary: rp.primary}
+	}
+	return replicationStatus{Role: "primary", Seq: store.Seq()}
+}
+
+func replicationStatusHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(follower.status())
+}
+
+func promoteHandler(w http.ResponseWriter, r *http.Request) {
+	if follower != nil {
+		follower.promote()
+	}
+	replicationStatusHandler(w, r)
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func newTestDb(t *testing.T, opts ...datastore.Option) *datastore.Db {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	db, err := datastore.NewDb(dir, 1000, opts...)
+	assert.Nil(t, err, err)
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+func waitFor(t *testing.T, cond func() bool) {
+	deadline := time.Now().Add(2 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatal("condition wasn't met in time")
+		}
+		time.Sleep(time.Millisecond * 10)
+	}
+}
+
+func TestReplication(t *testing.T) {
+	store = newTestDb(t, datastore.WithHistorySize(2))
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		assert.Nil(t, store.Put(key, key+"1"))
+	}
+
+	replicaDb := newTestDb(t)
+	rp := startReplica(srv.URL, replicaDb)
+	defer rp.stop()
+
+	t.Run("catch up from a snapshot", func(t *testing.T) {
+		waitFor(t, func() bool { return replicaDb.Seq() == store.Seq() })
+		value, err := replicaDb.Get("a")
+		assert.Nil(t, err, err)
+		assert.Equal(t, "a1", value)
+	})
+
+	t.Run("follow new writes", func(t *testing.T) {
+		assert.Nil(t, store.Put("a", "a2"))
+		assert.Nil(t, store.Put("e", "e1"))
+		waitFor(t, func() bool { return replicaDb.Seq() == store.Seq() })
+		value, err := replicaDb.Get("a")
+		assert.Nil(t, err, err)
+		assert.Equal(t, "a2", value)
+	})
+
+	t.Run("large value", func(t *testing.T) {
+		value := strings.Repeat("0123456789abcdef", 1<<13)
+		assert.Nil(t, store.PutReader(context.Background(), "large", strings.NewReader(value)))
+		assert.Nil(t, store.Put("f", "f1"))
+		waitFor(t, func() bool { return replicaDb.Seq() == store.Seq() })
+		got, err := replicaDb.Get("large")
+		assert.Nil(t, err, err)
+		assert.Equal(t, value, got)
+	})
+
+	t.Run("promote", func(t *testing.T) {
+		assert.True(t, rp.isFollowing())
+		rp.promote()
+		assert.False(t, rp.isFollowing())
+		assert.Equal(t, "primary", rp.status().Role)
+	})
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+const (
+	defaultScanLimit = 100
+	maxScanLimit     = 1000
+)
+
+type scanRes struct {
+	Items []datastore.KeyValue `json:"items"`
+	// Next is the after parameter for the next page, empty on the last one.
+	Next string `json:"next,omitempty"`
+}
+
+// scanValues lists the keys with the prefix query parameter in order,
+// starting after the key in the after parameter.
+func scanValues(w http.ResponseWriter, r *http.Request) {
+	db := requestStore(w, r)
+	if db == nil {
+		return
+	}
+	query := r.URL.Query()
+	limit := defaultScanLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit <= 0 {
+			httpError(w, http.StatusBadRequest, codeBadRequest, "Invalid limit")
+			return
+		}
+		if limit > maxScanLimit {
+			limit = maxScanLimit
+		}
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	if err := syncRead(ctx); err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	items, err := db.Scan(query.Get("prefix"), query.Get("after"), limit)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	res := scanRes{Items: items}
+	if res.Items == nil {
+		res.Items = []datastore.KeyValue{}
+	}
+	if len(items) == limit {
+		res.Next = items[len(items)-1].Key
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
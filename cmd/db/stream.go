@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+const octetStream = "application/octet-stream"
+
+// rawPutValue stores the request body as the value as is. Outside of a
+// cluster the body is streamed into the store rather than read into memory.
+func rawPutValue(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	if r.Header.Get("Content-Type") != octetStream {
+		httpError(w, http.StatusUnsupportedMediaType, codeUnsupportedType, "Content-Type must be "+octetStream)
+		return
+	}
+	if rejectWrites(w) {
+		return
+	}
+	db := requestStore(w, r)
+	if db == nil {
+		return
+	}
+	if r.ContentLength > db.MaxValueSize() {
+		httpError(w, http.StatusRequestEntityTooLarge, codeValueTooLarge, datastore.ErrValueTooLarge.Error())
+		return
+	}
+	log.Printf("PUT %s: %d raw bytes into db", key, r.ContentLength)
+
+	if cluster == nil {
+		// The body may take long to arrive, so the server's timeouts don't
+		// cut it off or the reply to it, and only the client bounds it.
+		rc := http.NewResponseController(w)
+		_ = rc.SetReadDeadline(time.Time{})
+		_ = rc.SetWriteDeadline(time.Time{})
+		err := db.PutReader(r.Context(), key, r.Body)
+		if err != nil {
+			writeError(w, r.Context(), err)
+			return
+		}
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	// Cluster log entries are held in memory anyway.
+	body, err := io.ReadAll(io.LimitReader(r.Body, db.MaxValueSize()+1))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, codeBadRequest, "Failed to read request body")
+		return
+	}
+	if int64(len(body)) > db.MaxValueSize() {
+		httpError(w, http.StatusRequestEntityTooLarge, codeValueTooLarge, datastore.ErrValueTooLarge.Error())
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	if err := writeRecord(ctx, db, datastore.Record{Key: key, Value: string(body)}); err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// rawGetValue streams the value out as is, for clients that accept
+// application/octet-stream.
+func rawGetValue(w http.ResponseWriter, r *http.Request, db *datastore.Db, key string) {
+	ctx, cancel := context.WithTimeout(r.Context(), storeTimeout)
+	defer cancel()
+	if err := syncRead(ctx); err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	seq := db.Seq()
+	value, size, err := db.GetReader(key)
+	log.Printf("GET key %s raw from db", key)
+	if err != nil {
+		writeError(w, ctx, err)
+		return
+	}
+	defer value.Close()
+	// Large values may take longer than the server's write timeout to send.
+	_ = http.NewResponseController(w).SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", octetStream)
+	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	w.Header().Set(seqHeader, strconv.FormatUint(seq, 10))
+	if _, err := io.Copy(w, value); err != nil {
+		// The status is already sent, so the client sees a short body.
+		log.Printf("Failed to stream %s: %s", key, err)
+	}
+}
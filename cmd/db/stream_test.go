@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRawValues(t *testing.T) {
+	store = newTestDb(t, datastore.WithMaxValueSize(1<<20))
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	value := bytes.Repeat([]byte{0, 1, 2, 0xff}, 1<<17)
+	req, err := http.NewRequest("PUT", srv.URL+"/db/blob", bytes.NewReader(value))
+	assert.Nil(t, err, err)
+	req.Header.Set("Content-Type", octetStream)
+	resp, err := http.DefaultClient.Do(req)
+	assert.Nil(t, err, err)
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+
+	req, err = http.NewRequest("GET", srv.URL+"/db/blob", nil)
+	assert.Nil(t, err, err)
+	req.Header.Set("Accept", octetStream)
+	resp, err = http.DefaultClient.Do(req)
+	assert.Nil(t, err, err)
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	assert.Nil(t, err, err)
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, int64(len(value)), resp.ContentLength)
+	assert.Equal(t, value, body)
+
+	t.Run("too large", func(t *testing.T) {
+		req, err := http.NewRequest("PUT", srv.URL+"/db/huge", bytes.NewReader(make([]byte, 1<<20+1)))
+		assert.Nil(t, err, err)
+		req.Header.Set("Content-Type", octetStream)
+		resp, err := http.DefaultClient.Do(req)
+		assert.Nil(t, err, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	})
+
+	t.Run("wrong content type", func(t *testing.T) {
+		assert.Equal(t, http.StatusUnsupportedMediaType, requestStatus(t, "PUT", srv.URL+"/db/blob", "x"))
+	})
+}
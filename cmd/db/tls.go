@@ -0,0 +1,62 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+
+	"github.com/roman-mazur/design-practice-2-template/httptools"
+)
+
+var (
+	serverTLS = httptools.ServerTLSFlags("tls-")
+	peerTLS   = httptools.ClientTLSFlags("peer-", "the primary and the cluster peers")
+)
+
+var (
+	// tlsConfig secures the HTTP API and the binary and Redis protocols. It
+	// is nil when TLS is off.
+	tlsConfig *tls.Config
+	// peerTLSConfig secures the requests to the primary and the cluster
+	// peers, which then have https addresses.
+	peerTLSConfig *tls.Config
+	// forwardTransport sends the requests forwarded to the leader. It is nil,
+	// for the default transport, when the peers don't use TLS.
+	forwardTransport http.RoundTripper
+)
+
+// loadTLS loads the certificates of the -tls and -peer flags.
+func loadTLS() error {
+	var err error
+	if tlsConfig, err = serverTLS.ServerConfig(); err != nil {
+		return fmt.Errorf("server TLS: %w", err)
+	}
+	if peerTLSConfig, err = peerTLS.ClientConfig(); err != nil {
+		return fmt.Errorf("peer TLS: %w", err)
+	}
+	if peerTLSConfig != nil {
+		forwardTransport = peerTransport()
+	}
+	return nil
+}
+
+// peerTransport connects to the other nodes, with the -peer TLS
+// configuration.
+func peerTransport() *http.Transport {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if peerTLSConfig != nil {
+		transport.TLSClientConfig = peerTLSConfig
+	}
+	return transport
+}
+
+// listen opens a TCP listener on port, accepting TLS connections if TLS is
+// on.
+func listen(port int) (net.Listener, error) {
+	l, err := net.Listen("tcp", fmt.Sprintf(":%d", port))
+	if err != nil || tlsConfig == nil {
+		return l, err
+	}
+	return tls.NewListener(l, tlsConfig), nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// storeUsage is the usage of the default store or a namespace, which is
+// empty for the default store, next to its quota.
+type storeUsage struct {
+	Namespace string `json:"namespace"`
+	datastore.Usage
+	Quota datastore.Usage `json:"quota"`
+}
+
+func usageOf(namespace string, db *datastore.Db) storeUsage {
+	return storeUsage{Namespace: namespace, Usage: db.Usage(), Quota: db.Quota()}
+}
+
+type usageRes struct {
+	Stores []storeUsage `json:"stores"`
+	// RateLimit and RateBurst are the request rate every client is allowed,
+	// zero if it's unlimited.
+	RateLimit float64 `json:"rate_limit"`
+	RateBurst int     `json:"rate_burst"`
+}
+
+// usageHandler reports the usage and the quotas of all the stores.
+func usageHandler(w http.ResponseWriter, r *http.Request) {
+	res := usageRes{
+		Stores: []storeUsage{usageOf("", store)},
+	}
+	if limiter != nil {
+		res.RateLimit = limiter.rate
+		res.RateBurst = int(limiter.burst)
+	}
+	if namespaces != nil {
+		for _, info := range namespaces.list() {
+			db, err := namespaces.get(info.Name)
+			if err != nil {
+				// Dropped since it was listed.
+				continue
+			}
+			res.Stores = append(res.Stores, usageOf(info.Name, db))
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
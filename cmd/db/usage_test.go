@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestQuota(t *testing.T) {
+	store = newTestDb(t, datastore.WithQuota(1, 0), datastore.WithMaxKeySize(*maxKeySize))
+	var err error
+	namespaces, err = openNamespaces(t.TempDir())
+	assert.Nil(t, err, err)
+	defer func() {
+		namespaces.close()
+		namespaces = nil
+	}()
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusAccepted, requestStatus(t, "POST", srv.URL+"/db/a", `{"value": "1"}`))
+	status, res := requestError(t, "POST", srv.URL+"/db/b", `{"value": "1"}`)
+	assert.Equal(t, http.StatusInsufficientStorage, status)
+	assert.Equal(t, codeQuotaExceeded, res.Code)
+	assert.Equal(t, http.StatusAccepted, requestStatus(t, "DELETE", srv.URL+"/db/a", ""))
+	assert.Equal(t, http.StatusAccepted, requestStatus(t, "POST", srv.URL+"/db/b", `{"value": "1"}`))
+
+	status, res = requestError(t, "POST", srv.URL+"/db/"+strings.Repeat("k", *maxKeySize+1), `{"value": "1"}`)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, status)
+	assert.Equal(t, codeKeyTooLarge, res.Code)
+
+	assert.Equal(t, http.StatusCreated, requestStatus(t, "POST", srv.URL+"/namespaces", `{"name": "team", "max_bytes": 10}`))
+	assert.Equal(t, http.StatusBadRequest, requestStatus(t, "POST", srv.URL+"/namespaces", `{"name": "other", "max_keys": -1}`))
+	assert.Equal(t, http.StatusAccepted, requestStatus(t, "POST", srv.URL+"/db/team/key", `{"value": "12345"}`))
+	status, res = requestError(t, "POST", srv.URL+"/db/team/key", `{"value": "12345678"}`)
+	assert.Equal(t, http.StatusInsufficientStorage, status)
+	assert.Equal(t, codeQuotaExceeded, res.Code)
+
+	resp := request(t, "GET", srv.URL+"/admin/usage", "")
+	var usage usageRes
+	assert.Nil(t, json.NewDecoder(resp.Body).Decode(&usage))
+	resp.Body.Close()
+	assert.Equal(t, []storeUsage{
+		{Usage: datastore.Usage{Keys: 1, Bytes: 2}, Quota: datastore.Usage{Keys: 1}},
+		{Namespace: "team", Usage: datastore.Usage{Keys: 1, Bytes: 8}, Quota: datastore.Usage{Bytes: 10}},
+	}, usage.Stores)
+}
+
+func TestRateLimit(t *testing.T) {
+	store = newTestDb(t)
+	limiter = newRateLimiter(1, 2)
+	defer func() { limiter = nil }()
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	assert.Equal(t, http.StatusAccepted, requestStatus(t, "POST", srv.URL+"/db/a", `{"value": "1"}`))
+	assert.Equal(t, http.StatusOK, requestStatus(t, "GET", srv.URL+"/db/a", ""))
+	resp := request(t, "GET", srv.URL+"/db/a", "")
+	resp.Body.Close()
+	assert.Equal(t, http.StatusTooManyRequests, resp.StatusCode)
+	assert.Equal(t, "1", resp.Header.Get("Retry-After"))
+	assert.Equal(t, http.StatusOK, requestStatus(t, "GET", srv.URL+"/admin/usage", ""), "only keys are limited")
+
+	now := time.Now()
+	l := newRateLimiter(2, 1)
+	ok, _ := l.allow("a", now)
+	assert.True(t, ok)
+	ok, wait := l.allow("a", now)
+	assert.False(t, ok)
+	assert.Equal(t, 500*time.Millisecond, wait)
+	ok, _ = l.allow("b", now)
+	assert.True(t, ok, "clients are limited separately")
+	ok, _ = l.allow("a", now.Add(wait))
+	assert.True(t, ok)
+
+	l.allow("c", now.Add(time.Hour))
+	assert.Len(t, l.buckets, 1, "idle clients are forgotten")
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+)
+
+// watchValue waits for the value of a key to change. With prefix=true the
+// key is a prefix and any key starting with it is watched. Clients pass the
+// X-Db-Seq header of their last read as since, so changes made in between
+// are not missed. The change is returned as a JSON record, or streamed as
+// Server-Sent Events when the client accepts text/event-stream. A long poll
+// that times out gets 204 No Content.
+func watchValue(w http.ResponseWriter, r *http.Request, db *datastore.Db, key string) {
+	query := r.URL.Query()
+	prefix := query.Get("prefix") == "true"
+	var since uint64
+	if s := query.Get("since"); s != "" {
+		var err error
+		if since, err = strconv.ParseUint(s, 10, 64); err != nil {
+			httpError(w, http.StatusBadRequest, codeBadRequest, "Invalid since sequence number")
+			return
+		}
+	}
+
+	var watcher *datastore.Watcher
+	match := func(k string) bool { return k == key }
+	if prefix {
+		watcher = db.WatchPrefix(key)
+		match = func(k string) bool { return strings.HasPrefix(k, key) }
+	} else {
+		watcher = db.Watch(key)
+	}
+	defer watcher.Close()
+
+	var missed []datastore.Record
+	if since > 0 {
+		var err error
+		missed, err = missedChanges(db, since, match)
+		if err == datastore.ErrLogTruncated {
+			if prefix {
+				httpError(w, http.StatusGone, codeLogTruncated, err.Error())
+				return
+			}
+			missed = []datastore.Record{currentRecord(db, key)}
+		}
+	}
+
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		streamWatch(w, r, watcher, missed)
+	} else {
+		pollWatch(w, r, watcher, missed)
+	}
+}
+
+// missedChanges returns the changes of matching keys made after since that
+// are already in the log.
+func missedChanges(db *datastore.Db, since uint64, match func(string) bool) ([]datastore.Record, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel() // don't wait for new writes
+	var res []datastore.Record
+	for from := since + 1; ; {
+		records, err := db.ReadLog(ctx, from, changesBatchSize)
+		if err == context.Canceled {
+			return res, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, rec := range records {
+			if match(rec.Key) {
+				res = append(res, rec)
+			}
+		}
+		from = records[len(records)-1].Seq + 1
+	}
+}
+
+func currentRecord(db *datastore.Db, key string) datastore.Record {
+	rec := datastore.Record{Seq: db.Seq(), Key: key}
+	value, err := db.Get(key)
+	if err != nil {
+		rec.Deleted = true
+	} else {
+		rec.Value = value
+	}
+	return rec
+}
+
+func pollWatch(w http.ResponseWriter, r *http.Request, watcher *datastore.Watcher, missed []datastore.Record) {
+	timeout, err := pollTimeout(r)
+	if err != nil {
+		httpError(w, http.StatusBadRequest, codeBadRequest, "Invalid timeout")
+		return
+	}
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Now().Add(timeout + storeTimeout))
+
+	var rec datastore.Record
+	if len(missed) > 0 {
+		rec = missed[len(missed)-1]
+	} else {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		var ok bool
+		select {
+		case rec, ok = <-watcher.C:
+			if !ok {
+				httpError(w, http.StatusServiceUnavailable, codeUnavailable, watcher.Err().Error())
+				return
+			}
+		case <-timer.C:
+			w.WriteHeader(http.StatusNoContent)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set(seqHeader, strconv.FormatUint(rec.Seq, 10))
+	_ = json.NewEncoder(w).Encode(rec)
+}
+
+func streamWatch(w http.ResponseWriter, r *http.Request, watcher *datastore.Watcher, missed []datastore.Record) {
+	rc := http.NewResponseController(w)
+	_ = rc.SetWriteDeadline(time.Time{})
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	var lastSeq uint64
+	for _, rec := range missed {
+		if err := writeEvent(w, rec); err != nil {
+			return
+		}
+		lastSeq = rec.Seq
+	}
+	if err := rc.Flush(); err != nil {
+		return
+	}
+
+	ticker := time.NewTicker(heartbeatInterval)
+	defer ticker.Stop()
+	for {
+		var err error
+		select {
+		case rec, ok := <-watcher.C:
+			if !ok {
+				fmt.Fprintf(w, "event: error\ndata: %s\n\n", watcher.Err())
+				rc.Flush()
+				return
+			}
+			if rec.Seq <= lastSeq {
+				// already sent from the log
+				continue
+			}
+			err = writeEvent(w, rec)
+		case <-ticker.C:
+			_, err = fmt.Fprint(w, ": ping\n\n")
+		case <-r.Context().Done():
+			return
+		}
+		if err != nil {
+			return
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+	}
+}
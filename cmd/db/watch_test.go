@@ -0,0 +1,69 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/stretchr/testify/assert"
+)
+
+func getWatch(t *testing.T, url string) (int, datastore.Record) {
+	resp, err := http.Get(url)
+	assert.Nil(t, err, err)
+	defer resp.Body.Close()
+	var rec datastore.Record
+	if resp.StatusCode == http.StatusOK {
+		assert.Nil(t, json.NewDecoder(resp.Body).Decode(&rec))
+	}
+	return resp.StatusCode, rec
+}
+
+func TestWatch(t *testing.T) {
+	store = newTestDb(t)
+	srv := httptest.NewServer(newRouter())
+	defer srv.Close()
+
+	assert.Nil(t, store.Put("team-name", "v1"))
+	resp, err := http.Get(srv.URL + "/db/team-name")
+	assert.Nil(t, err, err)
+	resp.Body.Close()
+	since := resp.Header.Get(seqHeader)
+	assert.Equal(t, "1", since)
+
+	t.Run("change after the read", func(t *testing.T) {
+		assert.Nil(t, store.Put("team-name", "v2"))
+		status, rec := getWatch(t, srv.URL+"/db/team-name?watch=true&since="+since)
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, datastore.Record{Seq: 2, Key: "team-name", Value: "v2"}, rec)
+	})
+
+	t.Run("wait for a change", func(t *testing.T) {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			store.Put("other", "value")
+			store.Put("team-name", "v3")
+		}()
+		status, rec := getWatch(t, srv.URL+"/db/team-name?watch=true")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, datastore.Record{Seq: 4, Key: "team-name", Value: "v3"}, rec)
+	})
+
+	t.Run("prefix", func(t *testing.T) {
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			store.Delete("team-name")
+		}()
+		status, rec := getWatch(t, srv.URL+"/db/team-?watch=true&prefix=true")
+		assert.Equal(t, http.StatusOK, status)
+		assert.Equal(t, datastore.Record{Seq: 5, Key: "team-name", Deleted: true}, rec)
+	})
+
+	t.Run("timeout", func(t *testing.T) {
+		status, _ := getWatch(t, srv.URL+"/db/team-name?watch=true&timeout=0")
+		assert.Equal(t, http.StatusNoContent, status)
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/roman-mazur/design-practice-2-template/wire"
+)
+
+// wireHandler serves the binary protocol from the default store, with the
+// same rules as the HTTP interface. Unlike HTTP, requests to a follower of
+// a cluster aren't forwarded to the leader.
+type wireHandler struct{}
+
+// wireError converts a failed write or read of the store for the binary
+// protocol.
+func wireError(ctx context.Context, err error) error {
+	if errors.Is(err, datastore.ErrNotFound) {
+		return wire.ErrNotFound
+	}
+	_, code, err := errorCode(ctx, err)
+	return &wire.Error{Code: code, Message: err.Error()}
+}
+
+func checkWritable() error {
+	if code, err := writeBlock(); err != nil {
+		return &wire.Error{Code: code, Message: err.Error()}
+	}
+	return nil
+}
+
+func (wireHandler) Get(ctx context.Context, key string) (string, error) {
+	if err := syncRead(ctx); err != nil {
+		return "", wireError(ctx, err)
+	}
+	value, err := store.GetContext(ctx, key)
+	if err != nil {
+		return "", wireError(ctx, err)
+	}
+	return value, nil
+}
+
+func (wireHandler) Put(ctx context.Context, key, value string) error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if err := writeRecord(ctx, store, datastore.Record{Key: key, Value: value}); err != nil {
+		return wireError(ctx, err)
+	}
+	return nil
+}
+
+func (wireHandler) Delete(ctx context.Context, key string) error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if err := writeRecord(ctx, store, datastore.Record{Key: key, Deleted: true}); err != nil {
+		return wireError(ctx, err)
+	}
+	return nil
+}
+
+func (wireHandler) Scan(ctx context.Context, prefix, after string, limit int) ([]wire.KeyValue, error) {
+	if limit <= 0 {
+		limit = defaultScanLimit
+	}
+	if limit > maxScanLimit {
+		limit = maxScanLimit
+	}
+	if err := syncRead(ctx); err != nil {
+		return nil, wireError(ctx, err)
+	}
+	items, err := store.Scan(prefix, after, limit)
+	if err != nil {
+		return nil, wireError(ctx, err)
+	}
+	res := make([]wire.KeyValue, len(items))
+	for i, kv := range items {
+		res[i] = wire.KeyValue{Key: kv.Key, Value: kv.Value}
+	}
+	return res, nil
+}
+
+func (wireHandler) PutBatch(ctx context.Context, pairs []wire.KeyValue) error {
+	if err := checkWritable(); err != nil {
+		return err
+	}
+	if len(pairs) > maxBatchKeys {
+		return &wire.Error{Code: codeBadRequest, Message: fmt.Sprintf("At most %d keys are allowed", maxBatchKeys)}
+	}
+	batch := make([]datastore.KeyValue, len(pairs))
+	for i, kv := range pairs {
+		if kv.Key == "" {
+			return &wire.Error{Code: codeBadRequest, Message: "empty key"}
+		}
+		batch[i] = datastore.KeyValue{Key: kv.Key, Value: kv.Value}
+	}
+	if err := writeBatch(ctx, store, batch); err != nil {
+		return wireError(ctx, err)
+	}
+	return nil
+}
+
+// startWire serves the binary protocol on port in the background.
+func startWire(port int) (*wire.Server, error) {
+	l, err := listen(port)
+	if err != nil {
+		return nil, err
+	}
+	srv := &wire.Server{Handler: wireHandler{}, Timeout: storeTimeout, MaxBatchKeys: maxBatchKeys}
+	go func() {
+		if err := srv.Serve(l); err != wire.ErrServerClosed {
+			log.Fatalf("Wire server finished: %s. Finishing the process.", err)
+		}
+	}()
+	log.Printf("Serving the binary protocol on port %d", port)
+	return srv, nil
+}
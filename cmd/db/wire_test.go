@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"net"
+	"testing"
+
+	"github.com/roman-mazur/design-practice-2-template/datastore"
+	"github.com/roman-mazur/design-practice-2-template/wire"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWire(t *testing.T) {
+	store = newTestDb(t, datastore.WithMaxValueSize(16))
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	srv := &wire.Server{Handler: wireHandler{}, Timeout: storeTimeout, MaxBatchKeys: maxBatchKeys}
+	go srv.Serve(l)
+	defer srv.Close()
+
+	ctx := context.Background()
+	c, err := wire.Dial(ctx, l.Addr().String())
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer c.Close()
+
+	assert.Nil(t, c.PutBatch(ctx, []wire.KeyValue{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}))
+	assert.Nil(t, c.Put(ctx, "c", "3"))
+	assert.Nil(t, c.Delete(ctx, "b"))
+	value, err := c.Get(ctx, "a")
+	assert.Nil(t, err, err)
+	assert.Equal(t, "1", value)
+	_, err = c.Get(ctx, "b")
+	assert.Equal(t, wire.ErrNotFound, err)
+
+	items, err := c.Scan(ctx, "", "", 0)
+	assert.Nil(t, err, err)
+	assert.Equal(t, []wire.KeyValue{{Key: "a", Value: "1"}, {Key: "c", Value: "3"}}, items)
+
+	err = c.Put(ctx, "d", "a value over the limit")
+	if assert.IsType(t, &wire.Error{}, err) {
+		assert.Equal(t, codeValueTooLarge, err.(*wire.Error).Code)
+	}
+	err = c.PutBatch(ctx, []wire.KeyValue{{Key: "", Value: "x"}})
+	if assert.IsType(t, &wire.Error{}, err) {
+		assert.Equal(t, codeBadRequest, err.(*wire.Error).Code)
+	}
+	_, err = c.GetBatch(ctx, make([]string, maxBatchKeys+1))
+	if assert.IsType(t, &wire.Error{}, err) {
+		assert.Equal(t, codeBadRequest, err.(*wire.Error).Code)
+	}
+}
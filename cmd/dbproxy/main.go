@@ -0,0 +1,46 @@
+package main
+
+import (
+	"flag"
+	"log"
+	"strings"
+
+	"github.com/roman-mazur/design-practice-2-template/httptools"
+	"github.com/roman-mazur/design-practice-2-template/signal"
+)
+
+var (
+	port     = flag.Int("port", 9100, "proxy port")
+	shards   = flag.String("shards", "http://database:9000", "comma-separated addresses of the db shards")
+	vnodes   = flag.Int("vnodes", 100, "number of points every shard gets on the hash ring")
+	shardTLS = httptools.ClientTLSFlags("shard-", "the shards over HTTPS")
+	token    = flag.String("shard-token", "", "API token of the shards that may read and write every key; moves keys while resharding and is required to add shards")
+	maxValue = flag.Int64("max-value-size", defaultMaxValueSize, "size limit of a value in bytes")
+	state    = flag.String("state-file", "./cmd/dbproxy/shards.json", "file the shards are kept in, so that added shards and resharding survive restarts; shards can't be added without it")
+)
+
+func main() {
+	flag.Parse()
+	var addrs []string
+	for _, addr := range strings.Split(*shards, ",") {
+		if addr = strings.TrimSpace(addr); addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	if len(addrs) == 0 {
+		log.Fatal("No shards configured")
+	}
+
+	transport, err := shardTLS.Transport()
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := newProxy(addrs, *vnodes, withToken(*token), withTransport(transport), withMaxValueSize(*maxValue), withStateFile(*state))
+	if err := p.loadState(); err != nil {
+		log.Fatal(err)
+	}
+	server := httptools.CreateServer(*port, p.router())
+	server.Start()
+	log.Printf("DB proxy started with shards %v", p.status().Shards)
+	signal.WaitForTerminationSignal()
+}
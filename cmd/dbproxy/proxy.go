@@ -0,0 +1,531 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+)
+
+const (
+	keyLockStripes = 256
+	moveBatchSize  = 500
+	maxScanLimit   = 1000
+	// shardTimeout bounds every request to a shard, including reading the
+	// response.
+	shardTimeout = 30 * time.Second
+	// defaultMaxValueSize is the default size limit of a value, the same
+	// as the one of the shards.
+	defaultMaxValueSize = 64 * 1024 * 1024
+)
+
+type keyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+type scanRes struct {
+	Items []keyValue `json:"items"`
+	Next  string     `json:"next,omitempty"`
+}
+
+type shardsReq struct {
+	Add string `json:"add"`
+}
+
+type shardsRes struct {
+	Shards     []string `json:"shards"`
+	Resharding bool     `json:"resharding"`
+	Moved      int      `json:"moved"`
+	LastError  string   `json:"last_error,omitempty"`
+}
+
+// proxy routes the db API to shards picked by a consistent hash ring.
+//
+// The shards, including the ones added since the start, are kept in the state
+// file, along with the ring before them while resharding. While resharding, prev is the ring before the new shard was added. Keys are
+// read from their new owner first and from the previous one if they haven't
+// been moved yet, and writes always go to the new owner. Writes and moves of
+// the same key are serialized by the key locks, so a move never overwrites a
+// newer value.
+type proxy struct {
+	client *http.Client
+	// token authenticates the requests of the proxy itself, which move keys
+	// while resharding.
+	token string
+	// maxValue is the size limit of the values put through the proxy.
+	maxValue int64
+	// statePath is the file the shards are kept in.
+	statePath string
+
+	mu      sync.RWMutex
+	ring    *ring
+	prev    *ring
+	moved   int
+	lastErr string
+
+	keyLocks [keyLockStripes]sync.Mutex
+}
+
+type proxyOption func(*proxy)
+
+// withToken sets the API token the proxy moves keys between the shards with.
+// Adding a shard requires the same token.
+func withToken(token string) proxyOption {
+	return func(p *proxy) {
+		p.token = token
+	}
+}
+
+// withTransport sends the requests to the shards with transport, which sets
+// up TLS for shards served over HTTPS.
+func withTransport(transport http.RoundTripper) proxyOption {
+	return func(p *proxy) {
+		p.client.Transport = transport
+	}
+}
+
+// withMaxValueSize sets the size limit of the values put through the proxy.
+func withMaxValueSize(n int64) proxyOption {
+	return func(p *proxy) {
+		if n > 0 {
+			p.maxValue = n
+		}
+	}
+}
+
+func newProxy(shards []string, vnodes int, opts ...proxyOption) *proxy {
+	p := &proxy{
+		client:   &http.Client{Timeout: shardTimeout},
+		maxValue: defaultMaxValueSize,
+		ring:     newRing(shards, vnodes),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// ownAuth is the Authorization header of the requests of the proxy itself.
+func (p *proxy) ownAuth() string {
+	if p.token == "" {
+		return ""
+	}
+	return "Bearer " + p.token
+}
+
+func (p *proxy) router() *mux.Router {
+	// Keys are matched escaped, so that they may contain slashes.
+	router := mux.NewRouter().UseEncodedPath()
+	router.Use(unescapeVars)
+	router.HandleFunc("/db/_scan", p.scan).Methods("GET")
+	router.HandleFunc("/db/{key}", p.get).Methods("GET")
+	router.HandleFunc("/db/{key}", p.put).Methods("POST")
+	router.HandleFunc("/db/{key}", p.delete).Methods("DELETE")
+	router.HandleFunc("/_shards", p.shards).Methods("GET")
+	router.HandleFunc("/_shards", p.addShard).Methods("POST")
+	return router
+}
+
+// unescapeVars decodes the path variables of routes matched escaped.
+func unescapeVars(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		vars := mux.Vars(r)
+		for name, value := range vars {
+			if unescaped, err := url.PathUnescape(value); err == nil {
+				vars[name] = unescaped
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (p *proxy) lockKey(key string) func() {
+	l := &p.keyLocks[crc32.ChecksumIEEE([]byte(key))%keyLockStripes]
+	l.Lock()
+	return l.Unlock
+}
+
+// owners returns the shard of key and, while resharding, the shard it had
+// before if that is a different one.
+func (p *proxy) owners(key string) (string, string) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	owner := p.ring.owner(key)
+	if p.prev != nil {
+		if prevOwner := p.prev.owner(key); prevOwner != owner {
+			return owner, prevOwner
+		}
+	}
+	return owner, ""
+}
+
+func keyURL(shard, key string) string {
+	return fmt.Sprintf("%s/db/%s", shard, url.PathEscape(key))
+}
+
+// do sends a request to a shard with auth as its Authorization header: the
+// one of the client the proxy serves, or ownAuth. It is cancelled with ctx,
+// which is the one of the client request if there is one.
+func (p *proxy) do(ctx context.Context, auth, method, url string, body []byte) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if auth != "" {
+		req.Header.Set("Authorization", auth)
+	}
+	return p.client.Do(req)
+}
+
+func copyResponse(w http.ResponseWriter, resp *http.Response) {
+	defer resp.Body.Close()
+	for k, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(k, value)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func (p *proxy) get(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	auth := r.Header.Get("Authorization")
+	owner, prevOwner := p.owners(key)
+	resp, err := p.do(r.Context(), auth, "GET", keyURL(owner, key), nil)
+	if err == nil && resp.StatusCode == http.StatusNotFound && prevOwner != "" {
+		resp.Body.Close()
+		resp, err = p.do(r.Context(), auth, "GET", keyURL(prevOwner, key), nil)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	copyResponse(w, resp)
+}
+
+func (p *proxy) put(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	// Escaping in JSON takes some room on top of the value itself.
+	body, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 2*p.maxValue+1024))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "Request body is too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "Failed to read request body", http.StatusBadRequest)
+		}
+		return
+	}
+	defer p.lockKey(key)()
+	owner, _ := p.owners(key)
+	resp, err := p.do(r.Context(), r.Header.Get("Authorization"), "POST", keyURL(owner, key), body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	copyResponse(w, resp)
+}
+
+func (p *proxy) delete(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	auth := r.Header.Get("Authorization")
+	defer p.lockKey(key)()
+	owner, prevOwner := p.owners(key)
+	if prevOwner != "" {
+		resp, err := p.do(r.Context(), auth, "DELETE", keyURL(prevOwner, key), nil)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		resp.Body.Close()
+	}
+	resp, err := p.do(r.Context(), auth, "DELETE", keyURL(owner, key), nil)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	copyResponse(w, resp)
+}
+
+func (p *proxy) scanShard(ctx context.Context, auth, shard, prefix, after string, limit int) (scanRes, error) {
+	var res scanRes
+	u := fmt.Sprintf("%s/db/_scan?prefix=%s&after=%s&limit=%d",
+		shard, url.QueryEscape(prefix), url.QueryEscape(after), limit)
+	resp, err := p.do(ctx, auth, "GET", u, nil)
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return res, fmt.Errorf("scan of %s failed: %s", shard, resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
+
+// scan merges the scans of all shards. While resharding a key can be found
+// on two shards; the value of its new owner wins.
+func (p *proxy) scan(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit := 100
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 {
+			http.Error(w, "Invalid limit", http.StatusBadRequest)
+			return
+		}
+		if limit > maxScanLimit {
+			limit = maxScanLimit
+		}
+	}
+	p.mu.RLock()
+	current := p.ring
+	p.mu.RUnlock()
+
+	type shardScan struct {
+		shard string
+		res   scanRes
+		err   error
+	}
+	results := make([]shardScan, len(current.nodes))
+	var wg sync.WaitGroup
+	for i, shard := range current.nodes {
+		wg.Add(1)
+		go func(i int, shard string) {
+			defer wg.Done()
+			res, err := p.scanShard(r.Context(), r.Header.Get("Authorization"), shard, query.Get("prefix"), query.Get("after"), limit)
+			results[i] = shardScan{shard, res, err}
+		}(i, shard)
+	}
+	wg.Wait()
+
+	merged := make(map[string]keyValue)
+	for _, sc := range results {
+		if sc.err != nil {
+			http.Error(w, sc.err.Error(), http.StatusBadGateway)
+			return
+		}
+		for _, item := range sc.res.Items {
+			if _, seen := merged[item.Key]; !seen || current.owner(item.Key) == sc.shard {
+				merged[item.Key] = item
+			}
+		}
+	}
+	res := scanRes{Items: make([]keyValue, 0, len(merged))}
+	for _, item := range merged {
+		res.Items = append(res.Items, item)
+	}
+	sort.Slice(res.Items, func(i, j int) bool { return res.Items[i].Key < res.Items[j].Key })
+	if len(res.Items) >= limit {
+		res.Items = res.Items[:limit]
+		res.Next = res.Items[limit-1].Key
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func (p *proxy) status() shardsRes {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return shardsRes{
+		Shards:     p.ring.nodes,
+		Resharding: p.prev != nil,
+		Moved:      p.moved,
+		LastError:  p.lastErr,
+	}
+}
+
+func (p *proxy) shards(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(p.status())
+}
+
+// addShard adds a shard to the ring and moves the keys it now owns to it in
+// the background.
+func (p *proxy) addShard(w http.ResponseWriter, r *http.Request) {
+	// The keys of every shard are moved with the token of the proxy, so
+	// only its holders may pick where they go.
+	if p.token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), []byte(p.ownAuth())) != 1 {
+		http.Error(w, "Adding shards requires the token of the proxy", http.StatusUnauthorized)
+		return
+	}
+	var req shardsReq
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Add == "" {
+		http.Error(w, "Expected {\"add\": \"<shard address>\"}", http.StatusBadRequest)
+		return
+	}
+	p.mu.Lock()
+	if p.prev != nil {
+		retry := p.lastErr != "" && !p.prev.has(req.Add) && p.ring.has(req.Add)
+		if !retry {
+			p.mu.Unlock()
+			http.Error(w, "Resharding is already in progress", http.StatusConflict)
+			return
+		}
+		// Adding the same shard again resumes a failed resharding.
+		p.lastErr = ""
+		p.mu.Unlock()
+		go p.reshard()
+		w.WriteHeader(http.StatusAccepted)
+		_ = json.NewEncoder(w).Encode(p.status())
+		return
+	}
+	if p.ring.has(req.Add) {
+		p.mu.Unlock()
+		http.Error(w, "Shard is already in the ring", http.StatusConflict)
+		return
+	}
+	if p.statePath == "" {
+		p.mu.Unlock()
+		// The new shard would be forgotten on restart, along with the
+		// keys moved to it.
+		http.Error(w, "Adding shards requires a state file", http.StatusConflict)
+		return
+	}
+	p.prev = p.ring
+	p.ring = p.ring.withNode(req.Add)
+	if err := p.saveState(); err != nil {
+		p.ring = p.prev
+		p.prev = nil
+		p.mu.Unlock()
+		http.Error(w, fmt.Sprintf("Failed to save the shards: %s", err), http.StatusInternalServerError)
+		return
+	}
+	p.moved = 0
+	p.lastErr = ""
+	p.mu.Unlock()
+
+	log.Printf("Adding shard %s", req.Add)
+	go p.reshard()
+	w.WriteHeader(http.StatusAccepted)
+	_ = json.NewEncoder(w).Encode(p.status())
+}
+
+// reshard moves every key whose owner changed to its new shard. If it fails,
+// the proxy keeps reading from both rings so no key is lost, and the error is
+// reported in the shard status.
+func (p *proxy) reshard() {
+	p.mu.RLock()
+	prev := p.prev
+	p.mu.RUnlock()
+
+	for _, shard := range prev.nodes {
+		if err := p.moveFrom(shard); err != nil {
+			log.Printf("Resharding failed: %s", err)
+			p.mu.Lock()
+			p.lastErr = err.Error()
+			p.mu.Unlock()
+			return
+		}
+	}
+	p.mu.Lock()
+	p.prev = nil
+	moved := p.moved
+	if err := p.saveState(); err != nil {
+		// The resharding is resumed on restart, and finds no keys to move.
+		log.Printf("Failed to save the shards: %s", err)
+	}
+	p.mu.Unlock()
+	log.Printf("Resharding finished, moved %d keys", moved)
+}
+
+func (p *proxy) moveFrom(shard string) error {
+	after := ""
+	for {
+		res, err := p.scanShard(context.Background(), p.ownAuth(), shard, "", after, moveBatchSize)
+		if err != nil {
+			return err
+		}
+		for _, item := range res.Items {
+			if owner, _ := p.owners(item.Key); owner != shard {
+				if err := p.moveKey(item.Key, shard, owner); err != nil {
+					return err
+				}
+			}
+		}
+		if res.Next == "" {
+			return nil
+		}
+		after = res.Next
+	}
+}
+
+// moveKey copies key from one shard to another unless it was written there
+// already, and deletes it from the old shard.
+func (p *proxy) moveKey(key, from, to string) error {
+	defer p.lockKey(key)()
+	auth := p.ownAuth()
+	ctx := context.Background()
+
+	resp, err := p.do(ctx, auth, "GET", keyURL(to, key), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusNotFound {
+		return fmt.Errorf("reading %s from %s failed: %s", key, to, resp.Status)
+	}
+	if resp.StatusCode == http.StatusNotFound {
+		resp, err := p.do(ctx, auth, "GET", keyURL(from, key), nil)
+		if err != nil {
+			return err
+		}
+		var kv keyValue
+		status := resp.StatusCode
+		if status == http.StatusOK {
+			err = json.NewDecoder(resp.Body).Decode(&kv)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if status == http.StatusNotFound {
+			// deleted after the scan
+			return nil
+		}
+		if status != http.StatusOK {
+			return fmt.Errorf("reading %s from %s failed: %d", key, from, status)
+		}
+		body, _ := json.Marshal(map[string]string{"value": kv.Value})
+		resp, err = p.do(ctx, auth, "POST", keyURL(to, key), body)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			return fmt.Errorf("writing %s to %s failed: %s", key, to, resp.Status)
+		}
+	}
+
+	resp, err = p.do(ctx, auth, "DELETE", keyURL(from, key), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("deleting %s from %s failed: %s", key, from, resp.Status)
+	}
+	p.mu.Lock()
+	p.moved++
+	p.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,395 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeShard is an in-memory stand-in for a db instance. It requires one of
+// tokens, if there are any.
+type fakeShard struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func newFakeShard(t *testing.T, tokens ...string) (*fakeShard, string) {
+	s := &fakeShard{values: make(map[string]string)}
+	router := mux.NewRouter().UseEncodedPath()
+	router.Use(unescapeVars, func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			for _, token := range tokens {
+				if r.Header.Get("Authorization") == "Bearer "+token {
+					next.ServeHTTP(w, r)
+					return
+				}
+			}
+			if len(tokens) > 0 {
+				w.WriteHeader(http.StatusUnauthorized)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	})
+	router.HandleFunc("/db/_scan", s.scan).Methods("GET")
+	router.HandleFunc("/db/{key}", s.get).Methods("GET")
+	router.HandleFunc("/db/{key}", s.put).Methods("POST")
+	router.HandleFunc("/db/{key}", s.delete).Methods("DELETE")
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+	return s, server.URL
+}
+
+func (s *fakeShard) get(w http.ResponseWriter, r *http.Request) {
+	key := mux.Vars(r)["key"]
+	s.mu.Lock()
+	value, ok := s.values[key]
+	s.mu.Unlock()
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	_ = json.NewEncoder(w).Encode(keyValue{Key: key, Value: value})
+}
+
+func (s *fakeShard) put(w http.ResponseWriter, r *http.Request) {
+	var body struct{ Value string }
+	_ = json.NewDecoder(r.Body).Decode(&body)
+	s.mu.Lock()
+	s.values[mux.Vars(r)["key"]] = body.Value
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *fakeShard) delete(w http.ResponseWriter, r *http.Request) {
+	s.mu.Lock()
+	delete(s.values, mux.Vars(r)["key"])
+	s.mu.Unlock()
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func (s *fakeShard) scan(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	limit, _ := strconv.Atoi(query.Get("limit"))
+	s.mu.Lock()
+	var keys []string
+	for key := range s.values {
+		if strings.HasPrefix(key, query.Get("prefix")) && key > query.Get("after") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	var res scanRes
+	for _, key := range keys {
+		if len(res.Items) == limit {
+			res.Next = res.Items[limit-1].Key
+			break
+		}
+		res.Items = append(res.Items, keyValue{Key: key, Value: s.values[key]})
+	}
+	s.mu.Unlock()
+	_ = json.NewEncoder(w).Encode(res)
+}
+
+func (s *fakeShard) has(key string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, ok := s.values[key]
+	return ok
+}
+
+func TestProxy(t *testing.T) {
+	shards := make(map[string]*fakeShard)
+	var addrs []string
+	for i := 0; i < 3; i++ {
+		s, addr := newFakeShard(t)
+		shards[addr] = s
+		addrs = append(addrs, addr)
+	}
+	statePath := filepath.Join(t.TempDir(), "shards.json")
+	p := newProxy(addrs[:2], 50, withStateFile(statePath))
+	server := httptest.NewServer(p.router())
+	defer server.Close()
+
+	const n = 300
+	for i := 0; i < n; i++ {
+		body := fmt.Sprintf(`{"value": "v%d"}`, i)
+		resp, err := http.Post(fmt.Sprintf("%s/db/key%03d", server.URL, i), "application/json", strings.NewReader(body))
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+		}
+	}
+	assert.Empty(t, shards[addrs[2]].values)
+
+	body, _ := json.Marshal(shardsReq{Add: addrs[2]})
+	resp, err := http.Post(server.URL+"/_shards", "application/json", bytes.NewReader(body))
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+
+	deadline := time.Now().Add(10 * time.Second)
+	for p.status().Resharding {
+		if time.Now().After(deadline) {
+			t.Fatal("resharding didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := p.status()
+	assert.Empty(t, status.LastError)
+	assert.True(t, status.Moved > 0)
+	assert.Equal(t, status.Moved, len(shards[addrs[2]].values))
+
+	for i := 0; i < n; i++ {
+		key := fmt.Sprintf("key%03d", i)
+		resp, err := http.Get(fmt.Sprintf("%s/db/%s", server.URL, key))
+		if !assert.NoError(t, err) {
+			continue
+		}
+		var kv keyValue
+		_ = json.NewDecoder(resp.Body).Decode(&kv)
+		resp.Body.Close()
+		assert.Equal(t, fmt.Sprintf("v%d", i), kv.Value)
+
+		owner := p.ring.owner(key)
+		for addr, s := range shards {
+			assert.Equal(t, addr == owner, s.has(key), "key %s on shard %s", key, addr)
+		}
+	}
+
+	var keys []string
+	for after := ""; ; {
+		resp, err := http.Get(fmt.Sprintf("%s/db/_scan?after=%s&limit=70", server.URL, after))
+		if !assert.NoError(t, err) {
+			return
+		}
+		var res scanRes
+		_ = json.NewDecoder(resp.Body).Decode(&res)
+		resp.Body.Close()
+		for _, item := range res.Items {
+			keys = append(keys, item.Key)
+		}
+		if res.Next == "" {
+			break
+		}
+		after = res.Next
+	}
+	assert.Equal(t, n, len(keys))
+	assert.True(t, sort.StringsAreSorted(keys))
+
+	restarted := newProxy(addrs[:2], 50, withStateFile(statePath))
+	assert.NoError(t, restarted.loadState())
+	assert.Equal(t, shardsRes{Shards: addrs}, restarted.status(), "the added shard is kept")
+}
+
+func TestProxy_State(t *testing.T) {
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		_, addr := newFakeShard(t)
+		addrs = append(addrs, addr)
+	}
+	// Keys can't be moved to the new shard without a token.
+	_, locked := newFakeShard(t, "token")
+	add, _ := json.Marshal(shardsReq{Add: locked})
+
+	p := newProxy(addrs, 50)
+	server := httptest.NewServer(p.router())
+	defer server.Close()
+	for i := 0; i < 50; i++ {
+		resp, err := http.Post(fmt.Sprintf("%s/db/key%d", server.URL, i), "application/json", strings.NewReader(`{"value": "v"}`))
+		if assert.NoError(t, err) {
+			resp.Body.Close()
+		}
+	}
+	resp, err := http.Post(server.URL+"/_shards", "application/json", bytes.NewReader(add))
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusConflict, resp.StatusCode, "shards aren't added without a state file")
+	}
+
+	statePath := filepath.Join(t.TempDir(), "shards.json")
+	p = newProxy(addrs, 50, withStateFile(statePath))
+	server = httptest.NewServer(p.router())
+	defer server.Close()
+	resp, err = http.Post(server.URL+"/_shards", "application/json", bytes.NewReader(add))
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+	deadline := time.Now().Add(10 * time.Second)
+	for p.status().LastError == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("resharding didn't fail")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	restarted := newProxy(addrs, 50, withStateFile(statePath))
+	assert.NoError(t, restarted.loadState())
+	status := restarted.status()
+	assert.Equal(t, append(addrs, locked), status.Shards)
+	assert.True(t, status.Resharding, "the resharding is resumed")
+	assert.Equal(t, addrs, restarted.prev.nodes)
+
+	assert.NoError(t, os.WriteFile(statePath, []byte("{"), 0o644))
+	assert.Error(t, newProxy(addrs, 50, withStateFile(statePath)).loadState())
+}
+
+func TestProxy_SlashKey(t *testing.T) {
+	s, addr := newFakeShard(t)
+	p := newProxy([]string{addr}, 10)
+	server := httptest.NewServer(p.router())
+	defer server.Close()
+
+	path := server.URL + "/db/" + url.PathEscape("users/1")
+	resp, err := http.Post(path, "application/json", strings.NewReader(`{"value": "alice"}`))
+	if !assert.NoError(t, err) {
+		return
+	}
+	resp.Body.Close()
+	assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	assert.True(t, s.has("users/1"))
+
+	resp, err = http.Get(path)
+	if !assert.NoError(t, err) {
+		return
+	}
+	var kv keyValue
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&kv))
+	resp.Body.Close()
+	assert.Equal(t, keyValue{Key: "users/1", Value: "alice"}, kv)
+
+	req, _ := http.NewRequest("DELETE", path, nil)
+	resp, err = http.DefaultClient.Do(req)
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusAccepted, resp.StatusCode)
+	}
+	assert.False(t, s.has("users/1"))
+}
+
+func TestProxy_Auth(t *testing.T) {
+	shards := make(map[string]*fakeShard)
+	var addrs []string
+	for i := 0; i < 2; i++ {
+		s, addr := newFakeShard(t, "client", "proxy")
+		shards[addr] = s
+		addrs = append(addrs, addr)
+	}
+	p := newProxy(addrs[:1], 50, withToken("proxy"), withStateFile(filepath.Join(t.TempDir(), "shards.json")))
+	server := httptest.NewServer(p.router())
+	defer server.Close()
+
+	send := func(method, path, token, body string) int {
+		req, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if !assert.NoError(t, err) {
+			return 0
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	for i := 0; i < 20; i++ {
+		assert.Equal(t, http.StatusAccepted, send("POST", fmt.Sprintf("/db/key%d", i), "client", `{"value": "v"}`))
+	}
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/db/key", "", `{"value": "v"}`), "the client's credentials are forwarded")
+	assert.Equal(t, http.StatusOK, send("GET", "/db/key0", "client", ""))
+	assert.Equal(t, http.StatusOK, send("GET", "/db/_scan", "client", ""))
+
+	add := fmt.Sprintf(`{"add": %q}`, addrs[1])
+	assert.Equal(t, http.StatusUnauthorized, send("POST", "/_shards", "client", add))
+	assert.Equal(t, http.StatusAccepted, send("POST", "/_shards", "proxy", add))
+	deadline := time.Now().Add(10 * time.Second)
+	for p.status().Resharding {
+		if time.Now().After(deadline) {
+			t.Fatal("resharding didn't finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	status := p.status()
+	assert.Empty(t, status.LastError)
+	assert.True(t, status.Moved > 0)
+	assert.Equal(t, status.Moved, len(shards[addrs[1]].values))
+}
+
+func TestProxy_Limits(t *testing.T) {
+	s, addr := newFakeShard(t)
+	p := newProxy([]string{addr}, 10, withMaxValueSize(10))
+	server := httptest.NewServer(p.router())
+	defer server.Close()
+
+	body := fmt.Sprintf(`{"value": %q}`, strings.Repeat("x", 2000))
+	resp, err := http.Post(server.URL+"/db/key", "application/json", strings.NewReader(body))
+	if assert.NoError(t, err) {
+		resp.Body.Close()
+		assert.Equal(t, http.StatusRequestEntityTooLarge, resp.StatusCode)
+	}
+	assert.False(t, s.has("key"))
+
+	// A shard that answers only once the request is cancelled.
+	cancelled := make(chan struct{})
+	router := mux.NewRouter()
+	router.HandleFunc("/db/{key}", func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+		close(cancelled)
+	})
+	slow := httptest.NewServer(router)
+	defer slow.Close()
+	p = newProxy([]string{slow.URL}, 10)
+	server = httptest.NewServer(p.router())
+	defer server.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, "GET", server.URL+"/db/key", nil)
+	if resp, err := http.DefaultClient.Do(req); err == nil {
+		resp.Body.Close()
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("the request to the shard outlived the client request")
+	}
+}
+
+func TestProxy_TLS(t *testing.T) {
+	s := &fakeShard{values: map[string]string{"key": "value"}}
+	router := mux.NewRouter()
+	router.HandleFunc("/db/{key}", s.get).Methods("GET")
+	shard := httptest.NewTLSServer(router)
+	defer shard.Close()
+
+	p := newProxy([]string{shard.URL}, 10, withTransport(shard.Client().Transport))
+	assert.Equal(t, shardTimeout, p.client.Timeout)
+	server := httptest.NewServer(p.router())
+	defer server.Close()
+	resp, err := http.Get(server.URL + "/db/key")
+	if !assert.NoError(t, err) {
+		return
+	}
+	var kv keyValue
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&kv))
+	resp.Body.Close()
+	assert.Equal(t, "value", kv.Value)
+}
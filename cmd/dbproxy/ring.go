@@ -0,0 +1,64 @@
+package main
+
+import (
+	"hash/crc32"
+	"sort"
+	"strconv"
+)
+
+// ring is a consistent hash ring. Every node is placed on the ring at vnodes
+// points and a key belongs to the node at the first point after its hash, so
+// adding a node only moves the keys that land on its points.
+type ring struct {
+	vnodes int
+	nodes  []string
+	points []uint32
+	owners map[uint32]string
+}
+
+func hashKey(key string) uint32 {
+	return crc32.ChecksumIEEE([]byte(key))
+}
+
+func newRing(nodes []string, vnodes int) *ring {
+	r := &ring{
+		vnodes: vnodes,
+		nodes:  append([]string(nil), nodes...),
+		owners: make(map[uint32]string),
+	}
+	for _, node := range nodes {
+		for i := 0; i < vnodes; i++ {
+			point := hashKey(node + "#" + strconv.Itoa(i))
+			if _, taken := r.owners[point]; taken {
+				continue
+			}
+			r.owners[point] = node
+			r.points = append(r.points, point)
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool { return r.points[i] < r.points[j] })
+	return r
+}
+
+// withNode returns a new ring that also contains node.
+func (r *ring) withNode(node string) *ring {
+	return newRing(append(r.nodes, node), r.vnodes)
+}
+
+func (r *ring) has(node string) bool {
+	for _, n := range r.nodes {
+		if n == node {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *ring) owner(key string) string {
+	h := hashKey(key)
+	i := sort.Search(len(r.points), func(i int) bool { return r.points[i] >= h })
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.owners[r.points[i]]
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRing(t *testing.T) {
+	r := newRing([]string{"db1", "db2", "db3"}, 100)
+
+	counts := make(map[string]int)
+	owners := make(map[string]string)
+	for i := 0; i < 3000; i++ {
+		key := fmt.Sprintf("key%d", i)
+		owners[key] = r.owner(key)
+		counts[owners[key]]++
+	}
+	for node, count := range counts {
+		assert.True(t, count > 600 && count < 1400, "unbalanced node %s: %d keys", node, count)
+	}
+
+	bigger := r.withNode("db4")
+	assert.True(t, bigger.has("db4"))
+	assert.False(t, r.has("db4"))
+	moved := 0
+	for key, owner := range owners {
+		if newOwner := bigger.owner(key); newOwner != owner {
+			assert.Equal(t, "db4", newOwner, "key moved between old nodes")
+			moved++
+		}
+	}
+	assert.True(t, moved > 400 && moved < 1200, "unexpected number of moved keys: %d", moved)
+}
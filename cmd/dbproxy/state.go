@@ -0,0 +1,76 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+)
+
+// shardState is what the state file of the proxy holds: the shards of the
+// ring and, while resharding, the shards of the ring before.
+type shardState struct {
+	Shards []string `json:"shards"`
+	Prev   []string `json:"prev,omitempty"`
+}
+
+// withStateFile keeps the shards in the file at path, so that the shards
+// added to the ring and an unfinished resharding survive a restart. Shards
+// can't be added without it.
+func withStateFile(path string) proxyOption {
+	return func(p *proxy) {
+		p.statePath = path
+	}
+}
+
+// loadState replaces the configured shards with the ones of the state file,
+// if it exists, and resumes the resharding it was left in.
+func (p *proxy) loadState() error {
+	if p.statePath == "" {
+		return nil
+	}
+	data, err := os.ReadFile(p.statePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var state shardState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return fmt.Errorf("corrupted state file %s: %w", p.statePath, err)
+	}
+	if len(state.Shards) == 0 {
+		return fmt.Errorf("state file %s has no shards", p.statePath)
+	}
+
+	p.mu.Lock()
+	p.ring = newRing(state.Shards, p.ring.vnodes)
+	resharding := state.Prev != nil
+	if resharding {
+		p.prev = newRing(state.Prev, p.ring.vnodes)
+	}
+	p.mu.Unlock()
+	log.Printf("Restored shards %v from %s", state.Shards, p.statePath)
+	if resharding {
+		log.Printf("Resuming resharding from shards %v", state.Prev)
+		go p.reshard()
+	}
+	return nil
+}
+
+// saveState writes the shards to the state file. p.mu must be held.
+func (p *proxy) saveState() error {
+	state := shardState{Shards: p.ring.nodes}
+	if p.prev != nil {
+		state.Prev = p.prev.nodes
+	}
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(p.statePath+".tmp", data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(p.statePath+".tmp", p.statePath)
+}
@@ -22,8 +22,14 @@ var (
 	https      = flag.Bool("http", false, "whether backends support HTTPs")
 
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
+
+	frontendTLS = httptools.ServerTLSFlags("tls-")
+	backendTLS  = httptools.ClientTLSFlags("backend-", "the backends over HTTPS")
 )
 
+// client sends the health checks and the forwarded requests to the backends.
+var client = http.DefaultClient
+
 type serverType struct {
 	dst             string
 	dataTransferred int
@@ -89,6 +95,10 @@ func (b *Balancer) runChecker() {
 }
 
 func (b *Balancer) Start() {
+	tlsConfig, err := frontendTLS.ServerConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
 	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		index, err := b.getIndex()
 		if err != nil {
@@ -96,7 +106,7 @@ func (b *Balancer) Start() {
 		} else {
 			b.forward(&b.pool[index], rw, r)
 		}
-	}))
+	}), httptools.WithTLS(tlsConfig))
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
@@ -107,13 +117,15 @@ func (b *Balancer) Start() {
 type healthChecker struct{}
 
 func (hc *healthChecker) health(dst string) bool {
-	ctx, _ := context.WithTimeout(context.Background(), timeout)
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 	req, _ := http.NewRequestWithContext(ctx, "GET",
 		fmt.Sprintf("%s://%s/health", scheme(), dst), nil)
-	resp, err := http.DefaultClient.Do(req)
+	resp, err := client.Do(req)
 	if err != nil {
 		return false
 	}
+	resp.Body.Close()
 	if resp.StatusCode != http.StatusOK {
 		return false
 	}
@@ -123,13 +135,14 @@ func (hc *healthChecker) health(dst string) bool {
 var cnt int = 0
 
 func (b *Balancer) forward(server *serverType, rw http.ResponseWriter, r *http.Request) error {
-	ctx, _ := context.WithTimeout(r.Context(), timeout)
+	ctx, cancel := context.WithTimeout(r.Context(), timeout)
+	defer cancel()
 	fwdRequest := r.Clone(ctx)
 	fwdRequest.RequestURI = ""
 	fwdRequest.URL.Host = server.dst
 	fwdRequest.URL.Scheme = scheme()
 	fwdRequest.Host = server.dst
-	resp, err := http.DefaultClient.Do(fwdRequest)
+	resp, err := client.Do(fwdRequest)
 	if err == nil {
 
 		// count length of server response and save it
@@ -162,6 +175,13 @@ func (b *Balancer) forward(server *serverType, rw http.ResponseWriter, r *http.R
 
 func main() {
 	flag.Parse()
+	if backendTLS.Enabled() {
+		transport, err := backendTLS.Transport()
+		if err != nil {
+			log.Fatal(err)
+		}
+		client = &http.Client{Transport: transport}
+	}
 	SetupBalancer()
 }
 
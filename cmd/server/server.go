@@ -1,43 +1,78 @@
 package main
 
 import (
-	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
-	"fmt"
-	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/roman-mazur/design-practice-2-template/dbclient"
 	"github.com/roman-mazur/design-practice-2-template/httptools"
 	"github.com/roman-mazur/design-practice-2-template/signal"
+	"github.com/roman-mazur/design-practice-2-template/wire"
 )
 
-var target = "http://database:9000"
+var target = flag.String("db", "http://database:9000", "URL of the database HTTP API")
 
 var port = flag.Int("port", 8080, "server port")
+var dbWire = flag.String("db-wire", "", "address of the database binary protocol; used instead of HTTP when set")
+var dbToken = flag.String("db-token", "", "API token of the database")
+
+var serverTLS = httptools.ServerTLSFlags("tls-")
+var dbTLS = httptools.ClientTLSFlags("db-", "the database")
 
 const confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 const confHealthFailure = "CONF_HEALTH_FAILURE"
 
+// dbStore is what the server needs from the database, which it reaches
+// over HTTP or the binary protocol.
+type dbStore interface {
+	Get(ctx context.Context, key string) (string, error)
+	Put(ctx context.Context, key, value string) error
+}
+
+func isNotFound(err error) bool {
+	return errors.Is(err, dbclient.ErrNotFound) || errors.Is(err, wire.ErrNotFound)
+}
+
 func main() {
+	flag.Parse()
 	h := new(http.ServeMux)
 	currentTime := time.Now()
 	dateString := currentTime.Format("2006-01-02")
-	payload := []byte(`{"value":"` + dateString + `"}`)
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/db/team-name", target), bytes.NewBuffer(payload))
+	tlsConfig, err := serverTLS.ServerConfig()
 	if err != nil {
 		log.Fatal(err)
 	}
-	req.Header.Set("Content-Type", "application/json")
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	dbTLSConfig, err := dbTLS.ClientConfig()
+	if err != nil {
+		log.Fatal(err)
+	}
+	var db dbStore = dbclient.New(*target, dbclient.WithToken(*dbToken), dbclient.WithTLS(dbTLSConfig))
+	if *dbWire != "" {
+		var wireClient *wire.Client
+		if dbTLSConfig != nil {
+			wireClient, err = wire.DialTLS(context.Background(), *dbWire, dbTLSConfig)
+		} else {
+			wireClient, err = wire.Dial(context.Background(), *dbWire)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer wireClient.Close()
+		db = wireClient
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	err = db.Put(ctx, "team-name", dateString)
+	cancel()
 	if err != nil {
 		log.Fatal(err)
 	}
-	defer resp.Body.Close()
 
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
 		rw.Header().Set("content-type", "text/plain")
@@ -66,26 +101,24 @@ func main() {
 
 		queryParams := r.URL.Query()
 		key := queryParams.Get("key")
-		resp, err := http.DefaultClient.Get(fmt.Sprintf("%s/db/%s", target, key))
-		if err != nil {
+		value, err := db.Get(r.Context(), key)
+		if isNotFound(err) {
 			http.NotFound(rw, r)
 			return
 		}
-
-		body, err := ioutil.ReadAll(resp.Body)
 		if err != nil {
-			http.NotFound(rw, r)
+			log.Printf("Failed to get %s from db: %s", key, err)
+			http.Error(rw, "Database is unavailable", http.StatusBadGateway)
 			return
 		}
-
 		rw.Header().Set("content-type", "application/json")
 		rw.WriteHeader(http.StatusOK)
-		rw.Write(body)
+		_ = json.NewEncoder(rw).Encode(dbclient.KeyValue{Key: key, Value: value})
 	})
 
 	h.Handle("/report", report)
 
-	server := httptools.CreateServer(*port, h)
+	server := httptools.CreateServer(*port, h, httptools.WithTLS(tlsConfig))
 	server.Start()
 	signal.WaitForTerminationSignal()
 }
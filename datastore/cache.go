@@ -0,0 +1,83 @@
+package datastore
+
+import "container/list"
+
+type cacheItem struct {
+	key   string
+	value string
+}
+
+// valueCache is a size-bounded LRU cache of values keyed by record key.
+// It is not safe for concurrent use; Db guards it with its mutex.
+type valueCache struct {
+	capacity int64
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+
+	hits, misses uint64
+}
+
+func newValueCache(capacity int64) *valueCache {
+	return &valueCache{
+		capacity: capacity,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func itemSize(key, value string) int64 {
+	return int64(len(key) + len(value))
+}
+
+func (c *valueCache) get(key string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return "", false
+	}
+	c.hits++
+	c.ll.MoveToFront(el)
+	return el.Value.(*cacheItem).value, true
+}
+
+func (c *valueCache) add(key, value string) {
+	if c == nil {
+		return
+	}
+	size := itemSize(key, value)
+	if size > c.capacity {
+		c.remove(key)
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		item := el.Value.(*cacheItem)
+		c.size += size - itemSize(item.key, item.value)
+		item.value = value
+		c.ll.MoveToFront(el)
+	} else {
+		c.items[key] = c.ll.PushFront(&cacheItem{key: key, value: value})
+		c.size += size
+	}
+	for c.size > c.capacity {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *valueCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *valueCache) removeElement(el *list.Element) {
+	item := c.ll.Remove(el).(*cacheItem)
+	delete(c.items, item.key)
+	c.size -= itemSize(item.key, item.value)
+}
@@ -0,0 +1,61 @@
+package datastore
+
+import "context"
+
+const subscriptionBatchSize = 100
+
+// Subscription delivers the writes of a Db in the order of their sequence
+// numbers. C is closed when the subscription ends and Err tells why, e.g.
+// ErrLogTruncated if the subscriber fell too far behind.
+type Subscription struct {
+	C <-chan Record
+
+	cancel context.CancelFunc
+	done   chan struct{}
+	err    error
+}
+
+// Subscribe streams the writes of the Db starting with sequence number from,
+// including the ones that are still kept in history.
+func (db *Db) Subscribe(from uint64) *Subscription {
+	ctx, cancel := context.WithCancel(context.Background())
+	ch := make(chan Record, subscriptionBatchSize)
+	s := &Subscription{C: ch, cancel: cancel, done: make(chan struct{})}
+	go func() {
+		defer close(s.done)
+		defer close(ch)
+		for {
+			records, err := db.ReadLog(ctx, from, subscriptionBatchSize)
+			if err != nil {
+				s.err = err
+				return
+			}
+			for _, r := range records {
+				select {
+				case ch <- r:
+				case <-ctx.Done():
+					s.err = ctx.Err()
+					return
+				}
+			}
+			from = records[len(records)-1].Seq + 1
+		}
+	}()
+	return s
+}
+
+// Close ends the subscription.
+func (s *Subscription) Close() {
+	s.cancel()
+	<-s.done
+}
+
+// Err returns the reason the subscription ended, or nil while it is active.
+func (s *Subscription) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
@@ -0,0 +1,99 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func nextRecord(t *testing.T, s *Subscription) Record {
+	select {
+	case r, ok := <-s.C:
+		assert.True(t, ok, "subscription ended: %s", s.Err())
+		return r
+	case <-time.After(time.Second):
+		t.Fatal("no record received")
+	}
+	return Record{}
+}
+
+func TestDb_Subscribe(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1000, WithHistorySize(2))
+	assert.Nil(t, err, err)
+	defer db.Close()
+
+	assert.Nil(t, db.Put("a", "a1"))
+	assert.Nil(t, db.Put("b", "b1"))
+
+	s := db.Subscribe(2)
+	assert.Equal(t, Record{Seq: 2, Key: "b", Value: "b1"}, nextRecord(t, s))
+	assert.Nil(t, db.Delete("a"))
+	assert.Equal(t, Record{Seq: 3, Key: "a", Deleted: true}, nextRecord(t, s))
+	s.Close()
+	_, ok := <-s.C
+	assert.False(t, ok)
+
+	_, err = db.Get("a")
+	assert.Equal(t, ErrNotFound, err)
+
+	t.Run("resume from a truncated position", func(t *testing.T) {
+		s := db.Subscribe(1)
+		defer s.Close()
+		_, ok := <-s.C
+		assert.False(t, ok)
+		assert.Equal(t, ErrLogTruncated, s.Err())
+	})
+}
+
+func TestDb_Watch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1000)
+	assert.Nil(t, err, err)
+	defer db.Close()
+
+	key := db.Watch("team-name")
+	prefix := db.WatchPrefix("team-")
+	defer prefix.Close()
+
+	assert.Nil(t, db.Put("other", "value"))
+	assert.Nil(t, db.Put("team-size", "3"))
+	assert.Nil(t, db.Put("team-name", "v1"))
+
+	r, ok := <-key.C
+	assert.True(t, ok)
+	assert.Equal(t, Record{Seq: 3, Key: "team-name", Value: "v1"}, r)
+	assert.Equal(t, "team-size", (<-prefix.C).Key)
+	assert.Equal(t, "team-name", (<-prefix.C).Key)
+
+	key.Close()
+	_, ok = <-key.C
+	assert.False(t, ok)
+	assert.Nil(t, key.Err())
+
+	t.Run("lagging watcher", func(t *testing.T) {
+		w := db.Watch("a")
+		for i := 0; i <= watcherBufferSize; i++ {
+			assert.Nil(t, db.Put("a", "value"))
+		}
+		for range w.C {
+		}
+		assert.Equal(t, ErrWatcherLagged, w.Err())
+	})
+
+	t.Run("closed by Close", func(t *testing.T) {
+		assert.Nil(t, db.Close())
+		for range prefix.C {
+		}
+		assert.Equal(t, ErrClosed, prefix.Err())
+	})
+}
@@ -2,90 +2,281 @@ package datastore
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
 	"os"
-	"path"
+	"time"
 )
 
-func (db *Db) merger(ch chan hashIndex) {
+// maxMergeFailures is how many times in a row merging the oldest segments may
+// fail before the merger gives up on them.
+const maxMergeFailures = 5
+
+// mergeRetryDelay is the pause between failed merges, shortened by tests.
+var mergeRetryDelay = time.Second
+
+// ErrMergeFailed is returned by writes that wait for a merge the merger gave
+// up on, like one of a segment with a corrupted record. Compact retries it.
+var ErrMergeFailed = errors.New("merging segments failed")
+
+func (db *Db) merger() {
+	defer db.wg.Done()
+	failures := 0
 	for {
-		seg1, seg2 := <-ch, <-ch
-		path1 := db.getSPath(0)
-		path2 := db.getSPath(1)
-		mi := mergeHashIndex(seg1, seg2, path1, path2)
-		mergedPath := path.Join(db.dir, "merged")
-		index, err := mergeFiles(mi, mergedPath)
-		if err != nil {
-			println("error occured during merging:", err.Error())
-			os.RemoveAll(mergedPath)
-			continue
+		select {
+		case <-db.mergeCh:
+		case <-db.done:
+			return
 		}
-		db.mu.Lock()
-		os.RemoveAll(path1)
-		os.RemoveAll(path2)
-		os.Rename(mergedPath, path1)
-		if len(db.segments) > 2 {
-			for i := 2; i <= len(db.segments)-1; i++ {
-				db.segments[i-1] = db.segments[i]
-				os.Rename(db.getSPath(i), db.getSPath(i-1))
+		for {
+			merged, err := db.mergeOldest()
+			if err != nil {
+				failures++
+				if failures >= maxMergeFailures {
+					log.Printf("Giving up merging after %d failures: %s", failures, err)
+					db.giveUpMerging(err)
+					failures = 0
+					break
+				}
+				log.Printf("Merging failed, retrying: %s", err)
+				select {
+				case <-time.After(mergeRetryDelay):
+					db.scheduleMerge()
+				case <-db.done:
+					return
+				}
+				break
+			}
+			failures = 0
+			if !merged {
+				break
+			}
+			select {
+			case <-db.done:
+				return
+			default:
 			}
 		}
-		db.segments[0] = index
-		db.segments = db.segments[:len(db.segments)-1]
-		db.mu.Unlock()
 	}
 }
 
-func mergeHashIndex(i1 hashIndex, i2 hashIndex, p1 string, p2 string) mergeIndex {
+// mergeOldest merges the two oldest segments into a new one, or rewrites
+// the only one left during a compaction. It reports false if there was
+// nothing to merge. Writes proceed while the files are merged, and the
+// manifest switches to the merged segment atomically.
+func (db *Db) mergeOldest() (bool, error) {
+	db.mu.Lock()
+	if !db.needsMerge() {
+		db.mu.Unlock()
+		return false, nil
+	}
+	// A compaction rewrites the last segment on its own.
+	n := 2
+	if len(db.segments) < n {
+		n = len(db.segments)
+	}
+	sources := append([]*segment(nil), db.segments[:n]...)
+	merged := &segment{gen: db.nextGen}
+	db.nextGen++
+	db.merging = true
+	db.mu.Unlock()
+	start := time.Now()
+
 	mi := make(mergeIndex)
-	for key, val := range i1 {
-		mi[key] = mergeItem{path: p1, offset: val}
+	for _, seg := range sources {
+		path := db.segmentPath(seg.gen)
+		for key, offset := range seg.index {
+			mi[key] = mergeItem{path: path, offset: offset}
+		}
 	}
-	for key, val := range i2 {
-		mi[key] = mergeItem{path: p2, offset: val}
+	mergedPath := db.segmentPath(merged.gen)
+	index, size, err := mergeFiles(mi, mergedPath, db.keys)
+	if err != nil {
+		os.RemoveAll(mergedPath)
+		err = db.countChecksum(err)
+		db.finishMerge(start, err)
+		return false, err
 	}
-	return mi
+	merged.index, merged.size = index, size
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !db.startsWith(sources) {
+		// The segments were replaced by Restore while merging.
+		os.RemoveAll(mergedPath)
+		db.merging = false
+		db.segCond.Broadcast()
+		return true, nil
+	}
+	segments := append([]*segment{merged}, db.segments[len(sources):]...)
+	old := db.segments
+	db.segments = segments
+	if err := db.writeManifest(); err != nil {
+		db.segments = old
+		os.RemoveAll(mergedPath)
+		db.finishMergeLocked(start, err)
+		return false, err
+	}
+	for _, seg := range sources {
+		db.removeSegmentFile(seg.gen)
+	}
+	db.finishMergeLocked(start, nil)
+	// Merging only rewrites the latest value of every key, so values in
+	// db.cache stay valid and there is nothing to invalidate here.
+	return true, nil
 }
 
-func mergeFiles(mi mergeIndex, outPath string) (hashIndex, error) {
-	f, err := os.Create(outPath)
+// giveUpMerging stops merges until Compact or Restore, failing the writers
+// that wait for one with err.
+func (db *Db) giveUpMerging(err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.mergeErr = fmt.Errorf("%w: %w", ErrMergeFailed, err)
+	db.segCond.Broadcast()
+}
+
+// startsWith tells whether db.segments start with segments. db.mu must be
+// held.
+func (db *Db) startsWith(segments []*segment) bool {
+	if len(db.segments) < len(segments) {
+		return false
+	}
+	for i, seg := range segments {
+		if db.segments[i] != seg {
+			return false
+		}
+	}
+	return true
+}
+
+// Compact rewrites all the data of the Db into a single segment, dropping
+// stale records and tombstones and re-encrypting the values with the
+// current key. The current data file is sealed first. Compact returns once
+// the merger is asked to compact; Stats tells when it is done. It also
+// retries merging segments the merger gave up on.
+func (db *Db) Compact() error {
+	return db.CompactContext(context.Background())
+}
+
+// CompactContext is like Compact but stops waiting for merges to seal the
+// current data file and returns ctx.Err() once ctx is done.
+func (db *Db) CompactContext(ctx context.Context) error {
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if db.mergeErr != nil {
+		db.mergeErr = nil
+		// Sealing the current data file may wait for the merger.
+		db.scheduleMerge()
+	}
+	if db.outOffset > 0 {
+		if err := db.addSegment(ctx); err != nil {
+			return err
+		}
+	}
+	// The segments written from now on are compacted.
+	db.compactUntil = db.nextGen
+	db.scheduleMerge()
+	return nil
+}
+
+// needsMerge tells whether the merger has work to do: enough segments piled
+// up, or a compaction hasn't rewritten all of them yet. db.mu must be held.
+func (db *Db) needsMerge() bool {
+	if db.readOnly || db.mergeErr != nil {
+		return false
+	}
+	if db.compactUntil != 0 {
+		if len(db.segments) > 1 || len(db.segments) == 1 && db.segments[0].gen < db.compactUntil {
+			return true
+		}
+		db.compactUntil = 0
+	}
+	return len(db.segments) >= db.mergeThreshold
+}
+
+// finishMerge records the outcome of a merge started at start.
+func (db *Db) finishMerge(start time.Time, err error) {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.finishMergeLocked(start, err)
+}
+
+// finishMergeLocked is finishMerge with db.mu held.
+func (db *Db) finishMergeLocked(start time.Time, err error) {
+	d := time.Since(start)
+	db.merging = false
+	db.lastMerge = MergeStats{Duration: d, Err: err, At: start}
+	// Writers wait for merges to shrink db.segments, and SetReadOnly for
+	// them to finish.
+	db.segCond.Broadcast()
+	if err != nil {
+		db.mergeFailures.Add(1)
+		return
+	}
+	db.merges.Add(1)
+	db.mergeDuration.observe(d)
+}
+
+// readRecordAt reads the record at offset in the file at path.
+func readRecordAt(path string, offset int64) ([]byte, error) {
+	file, err := os.Open(path)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
+	return readRecord(bufio.NewReader(io.NewSectionReader(file, offset, 1<<62)))
+}
+
+// mergeFiles copies the records found by mi to a new file at outPath,
+// re-encrypting their values with the current key of keys, if any. It
+// returns the index and the size of the new file.
+func mergeFiles(mi mergeIndex, outPath string, keys *Keyring) (hashIndex, int64, error) {
+	f, err := os.Create(outPath)
+	if err != nil {
+		return nil, 0, err
+	}
 	defer f.Close()
 	f.Chmod(0o600)
 
 	var offset int64
 	index := make(hashIndex)
 	for key, value := range mi {
-		file, err := os.Open(value.path)
+		record, err := readRecordAt(value.path, value.offset)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 		}
-
-		_, err = file.Seek(value.offset, 0)
+		e, err := decodeRecord(record, keys)
 		if err != nil {
-			return nil, err
+			return nil, 0, fmt.Errorf("merging %s: %w", key, err)
 		}
-
-		reader := bufio.NewReader(file)
-		record, err := readRecord(reader)
-		value := readValue(record)
-		if err != nil {
-			return nil, err
+		// The oldest segment is always merged, so there is nothing older
+		// left for a tombstone to hide.
+		if e.deleted {
+			continue
 		}
-		file.Close()
-
-		e := entry{
-			key:   key,
-			value: value,
+		data, err := encodeRecord(e, keys)
+		if err != nil {
+			return nil, 0, err
 		}
-		n, err := f.Write(e.Encode())
+		n, err := f.Write(data)
 		if err != nil {
-			return nil, err
+			return nil, 0, err
 
 		}
 		index[key] = offset
 		offset += int64(n)
 	}
-	return index, nil
+	// The merged file must be durable before the manifest refers to it.
+	return index, offset, f.Sync()
 }
@@ -2,20 +2,28 @@ package datastore
 
 import (
 	"bufio"
-	"encoding/binary"
+	"context"
 	"errors"
 	"fmt"
 	"io"
 	"os"
-	"path"
 	"path/filepath"
-	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const outFileName = "current-data"
 
-var ErrNotFound = fmt.Errorf("record does not exist")
+// ErrNotFound is returned for keys that have no value.
+var ErrNotFound = errors.New("record does not exist")
+
+// ErrCorrupted is returned, possibly wrapped with details, when stored data
+// fails its checks.
+var ErrCorrupted = errors.New("record is corrupted")
+
+// ErrClosed is returned by operations on a Db that has been closed.
+var ErrClosed = errors.New("db is closed")
 
 type mergeItem struct {
 	path   string
@@ -28,7 +36,13 @@ type hashIndex map[string]int64
 
 type putMessage struct {
 	res chan error
-	entry entry 
+	// entries are written together as a batch if there are more than one.
+	entries []entry
+	// spooled is the value of the only entry if it was put by PutReader.
+	spooled *spooledValue
+	// seq is the sequence number a replicated record must get, or zero for
+	// local writes.
+	seq uint64
 }
 
 type Db struct {
@@ -39,127 +53,326 @@ type Db struct {
 	mu        sync.Mutex
 	limit     int64
 	index     hashIndex
-	segments  []hashIndex
-	segCh     chan hashIndex
+	segments  []*segment
+	nextGen   uint64
 	putCh     chan putMessage
+	cache     *valueCache
+
+	// mergeCh holds at most one pending merge request for the merger.
+	mergeCh     chan struct{}
+	maxSegments int
+	// maxValueSize is the size limit of a value.
+	maxValueSize int64
+	// mergeThreshold is the number of sealed segments that starts a merge.
+	mergeThreshold int
+	syncWrites     bool
+	syncInterval   time.Duration
+	// keys encrypt the values of new records if set.
+	keys *Keyring
+	// sizes holds the size of every live key and its value, which add up
+	// to usage.
+	sizes      map[string]int64
+	usage      Usage
+	maxKeys    int64
+	maxBytes   int64
+	maxKeySize int
+	// getLatency and putLatency time reads and writes, and mergeDuration
+	// times merges.
+	getLatency       *histogram
+	putLatency       *histogram
+	mergeDuration    *histogram
+	checksumFailures atomic.Uint64
+	merges           atomic.Uint64
+	mergeFailures    atomic.Uint64
+	// merging is set while the merger writes a segment, and lastMerge
+	// describes the last one it wrote.
+	merging   bool
+	lastMerge MergeStats
+	// mergeErr is set once the merger gives up on the oldest segments. No
+	// merges are started then, and writers waiting for one fail with it.
+	mergeErr error
+	// compactUntil is set during a compaction, which goes on until a single
+	// segment of this generation or later is left.
+	compactUntil uint64
+	// readOnly rejects writes and pauses merges. openedReadOnly is set for
+	// a Db opened with WithReadOnly, which has no out file.
+	readOnly       bool
+	openedReadOnly bool
+	// snapshots is the number of snapshots being copied. The segment files
+	// they read are only removed once they are done, from staleFiles.
+	snapshots  int
+	staleFiles []string
+	// segCond is signalled whenever the merger shrinks db.segments or gives
+	// up, and when the Db turns read-only.
+	segCond *sync.Cond
+	closing bool
+
+	// seq is the sequence number of the last write. The most recent writes
+	// are kept in history for replication, up to historySize records and
+	// historyBytes of keys and values, and notify is closed and replaced
+	// after every write.
+	seq          uint64
+	sealedSeq    uint64
+	history      []Record
+	historySize  int
+	historyBytes int64
+	historyLimit int64
+	notify       chan struct{}
+	watchers     watchers
+
+	// closeMu is held for reading by every operation and for writing by
+	// Close, so Close waits for in-flight operations to finish.
+	closeMu sync.RWMutex
+	closed  bool
+	done    chan struct{}
+	wg      sync.WaitGroup
 }
 
+// Option configures optional Db behaviour.
+type Option func(*Db)
 
-func NewDb(dir string, segmLimit int64) (*Db, error) {
-	outputPath := filepath.Join(dir, outFileName)
-	os.MkdirAll(dir, 0o600)
-	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
-	if err != nil {
-		return nil, err
+// WithCacheSize enables an LRU cache of values read by Get, bounded by the
+// total size in bytes of the cached keys and values.
+func WithCacheSize(size int64) Option {
+	return func(db *Db) {
+		if size > 0 {
+			db.cache = newValueCache(size)
+		}
+	}
+}
+
+// WithMaxSegments limits the number of sealed segments waiting to be merged.
+// Once the limit is reached, rotating the current data file blocks writes
+// until the merger catches up. Values below 2 are ignored.
+func WithMaxSegments(n int) Option {
+	return func(db *Db) {
+		if n >= 2 {
+			db.maxSegments = n
+		}
 	}
+}
+
+// WithMergeThreshold sets how many sealed segments have to pile up before
+// they are merged. Higher values merge less often, keeping more stale
+// records on disk. Values below 2 are ignored; values above the segment
+// limit set by WithMaxSegments make NewDb fail.
+func WithMergeThreshold(n int) Option {
+	return func(db *Db) {
+		if n >= 2 {
+			db.mergeThreshold = n
+		}
+	}
+}
+
+// Stats holds runtime counters of a Db.
+type Stats struct {
+	CacheHits   uint64
+	CacheMisses uint64
+	// GetLatency times the reads of values. PutLatency times every write,
+	// including deletions, batches and replicated records, from the moment
+	// it is sent to the writer.
+	GetLatency Histogram
+	PutLatency Histogram
+	// ChecksumFailures counts the records that failed their hash sum or
+	// authentication tag when read.
+	ChecksumFailures uint64
+	Merges           uint64
+	MergeFailures    uint64
+	MergeDuration    Histogram
+	// Merging is set while a merge is running and Compacting until a
+	// compaction started by Compact is done.
+	Merging    bool
+	Compacting bool
+	LastMerge  MergeStats
+	// Segments are the sealed segments, oldest first.
+	Segments []SegmentStats
+	// CurrentPath is the path of the current data file, CurrentBytes its
+	// size and CurrentKeys the number of keys in its index.
+	CurrentPath  string
+	CurrentBytes int64
+	CurrentKeys  int
+}
+
+func NewDb(dir string, segmLimit int64, opts ...Option) (*Db, error) {
+	outputPath := filepath.Join(dir, outFileName)
 
 	db := &Db{
 		outPath: outputPath,
-		out:     f,
 		dir:     dir,
 		index:   make(hashIndex),
 		limit:   segmLimit,
-		segCh:   make(chan hashIndex),
 		putCh:   make(chan putMessage),
+		done:    make(chan struct{}),
+
+		mergeCh:        make(chan struct{}, 1),
+		maxSegments:    defaultMaxSegments,
+		mergeThreshold: defaultMergeThreshold,
+		maxValueSize:   defaultMaxValueSize,
+		historySize:    defaultHistorySize,
+		historyLimit:   defaultHistoryBytes,
+		notify:         make(chan struct{}),
+		getLatency:     newHistogram(latencyBounds),
+		putLatency:     newHistogram(latencyBounds),
+		mergeDuration:  newHistogram(mergeBounds),
 	}
-	err = db.recover()
-	go db.merger(db.segCh)
-	go db.putRoutine(db.putCh)
+	db.segCond = sync.NewCond(&db.mu)
+	for _, opt := range opts {
+		opt(db)
+	}
+	if !db.openedReadOnly {
+		os.MkdirAll(dir, 0o600)
+	}
+	if db.mergeThreshold > db.maxSegments {
+		// Writes would wait for a merge that never starts.
+		return nil, fmt.Errorf("merge threshold %d exceeds the limit of %d segments", db.mergeThreshold, db.maxSegments)
+	}
+	err := db.recover()
 	if err != nil && err != io.EOF {
 		return nil, err
 	}
+	if err := db.recoverUsage(); err != nil {
+		return nil, err
+	}
+	if db.openedReadOnly {
+		db.wg.Add(1)
+		go db.putRoutine(db.putCh)
+		return db, nil
+	}
+	f, err := os.OpenFile(outputPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return nil, err
+	}
+	db.out = f
+	db.wg.Add(2)
+	go db.merger()
+	go db.putRoutine(db.putCh)
+	if db.syncInterval > 0 && !db.syncWrites {
+		db.wg.Add(1)
+		go db.syncer()
+	}
+	db.scheduleMerge()
 	return db, nil
 }
 
 const bufSize = 8192
 
+const (
+	defaultMaxSegments    = 8
+	defaultMergeThreshold = 2
+)
+
 func (db *Db) recover() error {
-	_, err := os.Stat(db.outPath)
+	if err := db.recoverSegments(); err != nil {
+		return err
+	}
+
+	info, err := os.Stat(db.outPath)
 	if err == nil {
-		index, offset, err := recoverFile(db.outPath)
+		index, offset, records, err := recoverFile(db.outPath)
 		if err != nil && err != io.EOF {
 			return err
 		}
+		// Drop the tail of a write interrupted by a crash.
+		if offset < info.Size() && !db.openedReadOnly {
+			if err := os.Truncate(db.outPath, offset); err != nil {
+				return err
+			}
+		}
 		db.index = index
 		db.outOffset = offset
-	}
-
-	for i := 0; ; i++ {
-		_, err := os.Stat(db.getSPath(i))
-		if err != nil {
-			break
-		}
-		index, _, err := recoverFile(db.getSPath(i))
-		if err != nil && err != io.EOF {
-			return err
-		}
-		db.segments = append(db.segments, index)
+		db.seq += uint64(records)
 	}
 	return nil
 }
 
-func recoverFile(path string) (hashIndex, int64, error) {
+// recoverFile builds the index of a data file and returns it together with
+// the size of its complete part and the number of records in it. A record or
+// a batch of records cut short by a crash is left out.
+func recoverFile(path string) (hashIndex, int64, int, error) {
 	input, err := os.Open(path)
 	if err != nil {
-		return nil, 0, err
+		return nil, 0, 0, err
 	}
 	defer input.Close()
 
+	type pendingRecord struct {
+		key    string
+		offset int64
+	}
+	var pending []pendingRecord
 	index := make(hashIndex)
-	var offset int64
-	var buf [bufSize]byte
+	var offset, complete int64
+	var records int
 	in := bufio.NewReaderSize(input, bufSize)
-	for err == nil {
-		var (
-			header, data []byte
-			n            int
-		)
-		header, err = in.Peek(bufSize)
-		if err == io.EOF {
-			if len(header) == 0 {
-				return index, offset, err
-			}
-		} else if err != nil {
-			return nil, 0, err
+	for {
+		record, err := readRecord(in)
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return index, complete, records, io.EOF
 		}
-		size := binary.LittleEndian.Uint32(header)
-
-		if size < bufSize {
-			data = buf[:size]
-		} else {
-			data = make([]byte, size)
+		if err != nil {
+			return nil, 0, 0, err
 		}
-		n, err = in.Read(data)
-
-		if err == nil {
-			if n != int(size) {
-				return nil, 0, fmt.Errorf("corrupted file")
-			}
-
-			var e entry
-			e.Decode(data)
-			index[e.key] = offset
-			offset += int64(n)
+		var e entry
+		e.Decode(record)
+		pending = append(pending, pendingRecord{e.key, offset})
+		offset += int64(len(record))
+		if inBatch(record) {
+			continue
+		}
+		for _, p := range pending {
+			index[p.key] = p.offset
 		}
+		records += len(pending)
+		pending = pending[:0]
+		complete = offset
 	}
-	return index, offset, err
 }
 
+// Close stops accepting new operations, waits for pending writes and a
+// running merge to complete, syncs the current data file and releases it.
+// Any call on a closed Db returns ErrClosed.
 func (db *Db) Close() error {
+	// Wake up writers waiting for the merger so in-flight Puts can finish.
+	db.mu.Lock()
+	db.closing = true
+	db.segCond.Broadcast()
+	db.closeWatchers(ErrClosed)
+	db.mu.Unlock()
 
-	return db.out.Close()
+	db.closeMu.Lock()
+	defer db.closeMu.Unlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.closed = true
+	close(db.done)
+	db.wg.Wait()
+
+	if db.out == nil {
+		return nil
+	}
+	err := db.out.Sync()
+	if cerr := db.out.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func (db *Db) Get(key string) (string, error) {
+	defer db.getLatency.since(time.Now())
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.closed {
+		return "", ErrClosed
+	}
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	outPath := db.outPath
-	position, ok := db.index[key]
+	if value, ok := db.cache.get(key); ok {
+		return value, nil
+	}
+	outPath, position, ok := db.locate(key)
 	if !ok {
-		outPath, position, ok = db.getFromSegments(key)
-		if !ok {
-			return "", ErrNotFound
-		}
+		return "", ErrNotFound
 	}
 
 	file, err := os.Open(outPath)
@@ -174,15 +387,97 @@ func (db *Db) Get(key string) (string, error) {
 	}
 	reader := bufio.NewReader(file)
 	record, err := readRecord(reader)
-	ok = checkHash(record)
-	if !ok {
-		return "", errors.New("wrong hash sum")
+	if err != nil {
+		return "", err
 	}
-	value := readValue(record)
+	e, err := decodeRecord(record, db.keys)
 	if err != nil {
+		return "", db.countChecksum(err)
+	}
+	if e.deleted {
+		return "", ErrNotFound
+	}
+	db.cache.add(key, e.value)
+	return e.value, nil
+}
+
+// GetContext is like Get but returns ctx.Err() once ctx is done.
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	if err := ctx.Err(); err != nil {
 		return "", err
 	}
-	return value, nil
+	type result struct {
+		value string
+		err   error
+	}
+	res := make(chan result, 1)
+	go func() {
+		value, err := db.Get(key)
+		res <- result{value, err}
+	}()
+	select {
+	case r := <-res:
+		return r.value, r.err
+	case <-ctx.Done():
+		return "", ctx.Err()
+	}
+}
+
+// Sync flushes the writes made so far to disk.
+func (db *Db) Sync() error {
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.out == nil {
+		return nil
+	}
+	return db.out.Sync()
+}
+
+// Stats returns a snapshot of the Db counters.
+func (db *Db) Stats() Stats {
+	s := Stats{
+		GetLatency:       db.getLatency.snapshot(),
+		PutLatency:       db.putLatency.snapshot(),
+		ChecksumFailures: db.checksumFailures.Load(),
+		Merges:           db.merges.Load(),
+		MergeFailures:    db.mergeFailures.Load(),
+		MergeDuration:    db.mergeDuration.snapshot(),
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.cache != nil {
+		s.CacheHits = db.cache.hits
+		s.CacheMisses = db.cache.misses
+	}
+	for _, seg := range db.segments {
+		s.Segments = append(s.Segments, SegmentStats{
+			Gen:   seg.gen,
+			Path:  db.segmentPath(seg.gen),
+			Bytes: seg.size,
+			Keys:  len(seg.index),
+		})
+	}
+	s.Merging = db.merging
+	s.Compacting = db.compactUntil != 0
+	s.LastMerge = db.lastMerge
+	s.CurrentPath = db.outPath
+	s.CurrentBytes = db.outOffset
+	s.CurrentKeys = len(db.index)
+	return s
+}
+
+// locate finds the file and the offset of the latest record of key. db.mu
+// must be held.
+func (db *Db) locate(key string) (string, int64, bool) {
+	if position, ok := db.index[key]; ok {
+		return db.outPath, position, true
+	}
+	return db.getFromSegments(key)
 }
 
 func (db *Db) getFromSegments(key string) (string, int64, bool) {
@@ -195,74 +490,269 @@ func (db *Db) getFromSegments(key string) (string, int64, bool) {
 		return "", 0, false
 	}
 	for i := len(db.segments) - 1; i >= 0; i-- {
-		position, ok = db.segments[i][key]
+		position, ok = db.segments[i].index[key]
 		if ok {
-			outPath = db.getSPath(i)
+			outPath = db.segmentPath(db.segments[i].gen)
 			break
 		}
 	}
 	return outPath, position, ok
 }
 
-func (db *Db) Put(key, value string) (error) {
+func (db *Db) Put(key, value string) error {
+	return db.PutContext(context.Background(), key, value)
+}
+
+// PutContext is like Put but gives up waiting for the writer when ctx is
+// done. A record handed to the writer before that may still be written.
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
 	e := entry{
 		key:   key,
 		value: value,
 	}
-	res := make(chan error)
-	message := putMessage{ res: res, entry: e}
-	db.putCh <- message
-	return <- message.res
+	return db.write(ctx, []entry{e}, 0)
+}
+
+// PutBatch writes all the pairs atomically: after a crash the Db has either
+// all of them or none.
+func (db *Db) PutBatch(ctx context.Context, pairs []KeyValue) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	entries := make([]entry, len(pairs))
+	for i, kv := range pairs {
+		entries[i] = entry{key: kv.Key, value: kv.Value}
+	}
+	return db.write(ctx, entries, 0)
+}
+
+// Delete removes key from the Db by writing a tombstone for it.
+func (db *Db) Delete(key string) error {
+	return db.DeleteContext(context.Background(), key)
+}
+
+// DeleteContext is like Delete but gives up waiting for the writer when ctx
+// is done.
+func (db *Db) DeleteContext(ctx context.Context, key string) error {
+	return db.write(ctx, []entry{{key: key, deleted: true}}, 0)
+}
+
+func (db *Db) write(ctx context.Context, entries []entry, seq uint64) error {
+	for _, e := range entries {
+		if err := db.checkKey(e.key); err != nil {
+			return err
+		}
+		if int64(len(e.value)) > db.maxValueSize {
+			return ErrValueTooLarge
+		}
+	}
+	return db.send(ctx, putMessage{entries: entries, seq: seq})
+}
+
+// send hands a message to the writer and waits for the result.
+func (db *Db) send(ctx context.Context, message putMessage) error {
+	defer db.putLatency.since(time.Now())
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	// res is buffered so the writer never blocks on an abandoned request.
+	res := make(chan error, 1)
+	message.res = res
+	select {
+	case db.putCh <- message:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-res:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
 }
 
 func (db *Db) putRoutine(ch chan putMessage) {
+	defer db.wg.Done()
 	for {
-		e := <-ch
+		var e putMessage
+		select {
+		case e = <-ch:
+		case <-db.done:
+			return
+		}
 		db.mu.Lock()
-		n, err := db.out.Write(e.entry.Encode())
-		if err != nil {
+		if e.seq != 0 && e.seq != db.seq+1 {
 			db.mu.Unlock()
-			e.res <- err
+			e.res <- db.replicaSeqError(e.seq)
 			continue
 		}
-		db.index[e.entry.key] = db.outOffset
-		db.outOffset += int64(n)
-		db.mu.Unlock()
-		if db.outOffset > db.limit {
-			err = db.addSegment()
+		var err error
+		switch {
+		case db.readOnly:
+			err = ErrReadOnly
+		case e.seq == 0:
+			err = db.checkQuota(e)
+		}
+		if err == nil {
+			if e.spooled != nil {
+				err = db.writeSpooled(e.entries[0].key, e.spooled)
+			} else {
+				err = db.writeEntries(e.entries)
+			}
+		}
+		if err == nil && db.syncWrites {
+			err = db.out.Sync()
+		}
+		if err == nil && db.outOffset > db.limit {
+			err = db.addSegment(context.Background())
 		}
+		db.mu.Unlock()
 		e.res <- err
 	}
 }
 
-func (db *Db) addSegment() error {
+// writeEntries appends entries to the current data file. A batch goes to the
+// file in a single write, with all but its last record marked as followed by
+// more. db.mu must be held.
+func (db *Db) writeEntries(entries []entry) error {
+	var data []byte
+	offsets := make([]int64, len(entries))
+	for i, en := range entries {
+		en.more = i < len(entries)-1
+		record, err := encodeRecord(en, db.keys)
+		if err != nil {
+			return err
+		}
+		offsets[i] = db.outOffset + int64(len(data))
+		data = append(data, record...)
+	}
+	if _, err := db.out.Write(data); err != nil {
+		// Don't leave a partial write for the next one to follow.
+		db.out.Truncate(db.outOffset)
+		return err
+	}
+	for i, en := range entries {
+		db.index[en.key] = offsets[i]
+		db.account(en.key, entrySize(en), en.deleted)
+		db.cache.remove(en.key)
+		db.appendHistory(en)
+	}
+	db.outOffset += int64(len(data))
+	return nil
+}
+
+// addSegment seals the current data file as the newest segment and asks the
+// merger to compact segments. It blocks while maxSegments sealed segments are
+// waiting to be merged, and fails with ErrReadOnly if the Db turns read-only
+// meanwhile, as merges are paused then, or with ctx.Err() once ctx is done.
+// db.mu must be held.
+func (db *Db) addSegment(ctx context.Context) error {
+	if len(db.segments) >= db.maxSegments && ctx.Done() != nil {
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				db.mu.Lock()
+				db.segCond.Broadcast()
+				db.mu.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+	for len(db.segments) >= db.maxSegments {
+		if db.closing {
+			return ErrClosed
+		}
+		if db.readOnly {
+			return ErrReadOnly
+		}
+		if db.mergeErr != nil {
+			return db.mergeErr
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		db.segCond.Wait()
+	}
+	if err := db.rotate(); err != nil {
+		return err
+	}
+	db.scheduleMerge()
+	return nil
+}
+
+// Rotate seals the current data file as the newest segment, unless it is
+// empty, and starts a new one. Like rotations on reaching the size limit,
+// it blocks while too many segments wait to be merged.
+func (db *Db) Rotate() error {
+	return db.RotateContext(context.Background())
+}
+
+// RotateContext is like Rotate but stops waiting for merges and returns
+// ctx.Err() once ctx is done.
+func (db *Db) RotateContext(ctx context.Context) error {
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
 	db.mu.Lock()
-	db.Close()
-	newSegmentPath := db.getSPath(len(db.segments))
-	err := os.Rename(db.outPath, newSegmentPath)
-	if err != nil {
-		db.mu.Unlock()
+	defer db.mu.Unlock()
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if db.outOffset == 0 {
+		return nil
+	}
+	return db.addSegment(ctx)
+}
+
+// rotate seals the current data file as the newest segment. db.mu must be
+// held.
+func (db *Db) rotate() error {
+	// The manifest lists the new segment before the rename, so a crash in
+	// between is repaired by recoverSegments.
+	seg := &segment{gen: db.nextGen, index: db.index, size: db.outOffset}
+	db.nextGen++
+	db.segments = append(db.segments, seg)
+	sealedSeq := db.sealedSeq
+	db.sealedSeq = db.seq
+	if err := db.writeManifest(); err != nil {
+		db.segments = db.segments[:len(db.segments)-1]
+		db.sealedSeq = sealedSeq
+		return err
+	}
+	if err := os.Rename(db.outPath, db.segmentPath(seg.gen)); err != nil {
 		return err
 	}
 	f, err := os.OpenFile(db.outPath, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
 	if err != nil {
-		db.mu.Unlock()
 		return err
 	}
+	if db.durable() {
+		// The sealed file isn't synced by anything else anymore.
+		if err := db.out.Sync(); err != nil {
+			f.Close()
+			return err
+		}
+	}
+	db.out.Close()
 	db.out = f
 	db.outOffset = 0
-	db.segments = append(db.segments, db.index)
 	db.index = make(hashIndex)
-	db.mu.Unlock()
-	if len(db.segments) > 1 {
-		db.segCh <- db.segments[0]
-		db.segCh <- db.segments[1]
-	}
 	return nil
 }
 
-func (db *Db) getSPath(index int) string {
-	segName := strconv.Itoa(index)
-	segPath := path.Join(db.dir, segName)
-	return segPath
+// scheduleMerge queues a merge request unless one is already pending.
+func (db *Db) scheduleMerge() {
+	select {
+	case db.mergeCh <- struct{}{}:
+	default:
+	}
 }
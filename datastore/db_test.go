@@ -1,10 +1,13 @@
 package datastore
 
 import (
+	"context"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
 	"testing"
 	"time"
 
@@ -92,7 +95,7 @@ func TestSegments(t *testing.T) {
 		db.Put(segment[0], segment[1])     // add segment
 		time.Sleep(time.Millisecond * 100) // wait merge
 		assert.Equal(t, 1, len(db.segments), "index has wrong length expected %d, got %d", 1, len(db.segments))
-		filePath := db.getSPath(1)
+		filePath := db.segmentPath(1)
 		_, err = os.Stat(filePath)
 		assert.NotNil(t, err, "segments` files wasn`t merged")
 	})
@@ -129,7 +132,7 @@ func TestSegments(t *testing.T) {
 
 		//after merging
 		assert.Equal(t, 1, len(db.segments), "segments` hashIndexes wasn`t merged")
-		_, err := os.Stat(db.getSPath(1))
+		_, err := os.Stat(db.segmentPath(1))
 		assert.NotNil(t, err, "segments` files wasn`t merged")
 		for _, pair := range assertPairs {
 			value, err := db.Get(pair[0])
@@ -152,3 +155,433 @@ func TestSegments(t *testing.T) {
 		}
 	})
 }
+
+func TestDb_Cache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 80, WithCacheSize(1024))
+	assert.Nil(t, err, err)
+	defer db.Close()
+
+	long := "Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor."
+
+	t.Run("hits and misses", func(t *testing.T) {
+		assert.Nil(t, db.Put("team-name", "v1"))
+		for i := 0; i < 3; i++ {
+			value, err := db.Get("team-name")
+			assert.Nil(t, err, err)
+			assert.Equal(t, "v1", value)
+		}
+		stats := db.Stats()
+		assert.Equal(t, uint64(1), stats.CacheMisses)
+		assert.Equal(t, uint64(2), stats.CacheHits)
+	})
+
+	t.Run("invalidated by put", func(t *testing.T) {
+		assert.Nil(t, db.Put("team-name", "v2"))
+		value, err := db.Get("team-name")
+		assert.Nil(t, err, err)
+		assert.Equal(t, "v2", value)
+	})
+
+	t.Run("valid across merges", func(t *testing.T) {
+		assert.Nil(t, db.Put("key", long))
+		assert.Nil(t, db.Put("key", long+"!"))
+		time.Sleep(time.Millisecond * 100) // wait merge
+		assert.Nil(t, db.Put("team-name", "v3"))
+		value, err := db.Get("team-name")
+		assert.Nil(t, err, err)
+		assert.Equal(t, "v3", value)
+		value, err = db.Get("key")
+		assert.Nil(t, err, err)
+		assert.Equal(t, long+"!", value)
+	})
+}
+
+func TestValueCache_Eviction(t *testing.T) {
+	c := newValueCache(10)
+	c.add("a", "1234")
+	c.add("b", "1234")
+	c.get("a")
+	c.add("c", "1234")
+	_, ok := c.get("b")
+	assert.False(t, ok, "least recently used item wasn't evicted")
+	_, ok = c.get("a")
+	assert.True(t, ok, "recently used item was evicted")
+	c.add("d", "0123456789")
+	_, ok = c.get("d")
+	assert.False(t, ok, "item larger than the cache was stored")
+	assert.True(t, c.size <= c.capacity)
+}
+
+func TestDb_Close(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 80)
+	assert.Nil(t, err, err)
+
+	long := "Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor."
+
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		written []string
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(key string) {
+			defer wg.Done()
+			err := db.Put(key, long)
+			if err != nil {
+				assert.Equal(t, ErrClosed, err)
+				return
+			}
+			mu.Lock()
+			written = append(written, key)
+			mu.Unlock()
+		}(fmt.Sprintf("key%d", i))
+	}
+	time.Sleep(time.Millisecond)
+	assert.Nil(t, db.Close())
+	wg.Wait()
+
+	t.Run("calls after close", func(t *testing.T) {
+		done := make(chan error)
+		go func() { done <- db.Put("key", "value") }()
+		select {
+		case err := <-done:
+			assert.Equal(t, ErrClosed, err)
+		case <-time.After(time.Second):
+			t.Fatal("Put blocked on a closed db")
+		}
+		_, err := db.Get("key0")
+		assert.Equal(t, ErrClosed, err)
+		assert.Equal(t, ErrClosed, db.Close())
+	})
+
+	t.Run("written data survives close", func(t *testing.T) {
+		db, err := NewDb(dir, 80)
+		assert.Nil(t, err, err)
+		defer db.Close()
+		for _, key := range written {
+			value, err := db.Get(key)
+			assert.Nil(t, err, err)
+			assert.Equal(t, long, value)
+		}
+	})
+}
+
+func TestDb_Context(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1000)
+	assert.Nil(t, err, err)
+	defer db.Close()
+
+	assert.Nil(t, db.PutContext(context.Background(), "key", "value"))
+
+	t.Run("cancelled context", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.Equal(t, context.Canceled, db.PutContext(ctx, "key", "other"))
+		_, err := db.GetContext(ctx, "key")
+		assert.Equal(t, context.Canceled, err)
+	})
+
+	t.Run("deadline on a stuck writer", func(t *testing.T) {
+		db.mu.Lock() // block the writer and readers
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		assert.Equal(t, context.DeadlineExceeded, db.PutContext(ctx, "key", "other"))
+		_, err := db.GetContext(ctx, "key")
+		assert.Equal(t, context.DeadlineExceeded, err)
+		db.mu.Unlock()
+	})
+}
+
+func TestDb_MaxSegments(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 80, WithMaxSegments(2))
+	assert.Nil(t, err, err)
+	defer db.Close()
+
+	long := "Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor."
+	for i := 0; i < 50; i++ {
+		// every Put rotates the current data file
+		assert.Nil(t, db.Put(fmt.Sprintf("key%d", i%5), fmt.Sprintf("%s%d", long, i)))
+		db.mu.Lock()
+		assert.True(t, len(db.segments) <= 2, "too many segments: %d", len(db.segments))
+		db.mu.Unlock()
+	}
+	for i := 45; i < 50; i++ {
+		value, err := db.Get(fmt.Sprintf("key%d", i%5))
+		assert.Nil(t, err, err)
+		assert.Equal(t, fmt.Sprintf("%s%d", long, i), value)
+	}
+}
+
+func TestDb_MergeThreshold(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	_, err = NewDb(dir, 80, WithMaxSegments(3), WithMergeThreshold(4))
+	assert.NotNil(t, err)
+
+	db, err := NewDb(dir, 80, WithMaxSegments(4), WithMergeThreshold(4))
+	assert.Nil(t, err, err)
+	defer db.Close()
+
+	long := "Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor."
+	for i := 0; i < 3; i++ {
+		// every Put rotates the current data file
+		assert.Nil(t, db.Put("key", fmt.Sprintf("%s%d", long, i)))
+	}
+	time.Sleep(50 * time.Millisecond)
+	db.mu.Lock()
+	assert.Equal(t, 3, len(db.segments), "segments are merged below the threshold")
+	db.mu.Unlock()
+
+	assert.Nil(t, db.Put("key", long))
+	assert.Eventually(t, func() bool {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return len(db.segments) < 4
+	}, time.Second, 10*time.Millisecond)
+	value, err := db.Get("key")
+	assert.Nil(t, err, err)
+	assert.Equal(t, long, value)
+}
+
+func TestDb_Delete(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 80, WithCacheSize(1024))
+	assert.Nil(t, err, err)
+	defer db.Close()
+
+	long := "Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor."
+	assert.Nil(t, db.Put("a", long))
+	assert.Nil(t, db.Put("b", long))
+	_, err = db.Get("a")
+	assert.Nil(t, err, err)
+
+	assert.Nil(t, db.Delete("a"))
+	_, err = db.Get("a")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Nil(t, db.Put("c", long))
+	time.Sleep(time.Millisecond * 100) // wait merge
+	_, err = db.Get("a")
+	assert.Equal(t, ErrNotFound, err)
+
+	assert.Nil(t, db.Close())
+	db, err = NewDb(dir, 80)
+	assert.Nil(t, err, err)
+	_, err = db.Get("a")
+	assert.Equal(t, ErrNotFound, err)
+	value, err := db.Get("b")
+	assert.Nil(t, err, err)
+	assert.Equal(t, long, value)
+}
+
+func TestDb_PutBatch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<20)
+	assert.Nil(t, err, err)
+	batch := []KeyValue{{"a", "1"}, {"b", "2"}, {"c", "3"}}
+	assert.Nil(t, db.PutBatch(context.Background(), batch))
+	for _, kv := range batch {
+		assertValue(t, db, kv.Key, kv.Value)
+	}
+	assert.Equal(t, uint64(3), db.Seq())
+	assert.Nil(t, db.Close())
+
+	// A batch cut short by a crash, followed by a torn record.
+	outPath := filepath.Join(dir, outFileName)
+	f, err := os.OpenFile(outPath, os.O_APPEND|os.O_WRONLY, 0o600)
+	assert.Nil(t, err, err)
+	for _, key := range []string{"a", "d"} {
+		e := entry{key: key, value: "lost", more: true}
+		_, err = f.Write(e.Encode())
+		assert.Nil(t, err, err)
+	}
+	e := entry{key: "e", value: "lost"}
+	_, err = f.Write(e.Encode()[:10])
+	assert.Nil(t, err, err)
+	assert.Nil(t, f.Close())
+
+	db, err = NewDb(dir, 1<<20)
+	assert.Nil(t, err, err)
+	defer db.Close()
+	for _, kv := range batch {
+		assertValue(t, db, kv.Key, kv.Value)
+	}
+	_, err = db.Get("d")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, uint64(3), db.Seq())
+
+	// New writes go after the complete part of the file.
+	assert.Nil(t, db.Put("d", "4"))
+	assert.Nil(t, db.Close())
+	db, err = NewDb(dir, 1<<20)
+	assert.Nil(t, err, err)
+	defer db.Close()
+	assertValue(t, db, "d", "4")
+	assertValue(t, db, "a", "1")
+}
+
+func TestDb_Compact(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1000, WithMergeThreshold(8))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer db.Close()
+
+	assert.Nil(t, db.Rotate(), "nothing to rotate")
+	assert.Len(t, db.Stats().Segments, 0)
+	for i := 0; i < 3; i++ {
+		assert.Nil(t, db.Put("key", fmt.Sprintf("value%d", i)))
+		assert.Nil(t, db.Put(fmt.Sprintf("deleted%d", i), "value"))
+		assert.Nil(t, db.Delete(fmt.Sprintf("deleted%d", i)))
+		assert.Nil(t, db.Rotate())
+	}
+	assert.Nil(t, db.Put("current", "value"))
+	stats := db.Stats()
+	assert.Len(t, stats.Segments, 3, "segments are below the merge threshold")
+	assert.False(t, stats.Compacting)
+
+	assert.Nil(t, db.Compact())
+	assert.Eventually(t, func() bool {
+		return !db.Stats().Compacting
+	}, time.Second, 10*time.Millisecond)
+	stats = db.Stats()
+	if assert.Len(t, stats.Segments, 1) {
+		assert.Equal(t, 2, stats.Segments[0].Keys, "tombstones are dropped")
+	}
+	assert.Equal(t, int64(0), stats.CurrentBytes)
+	assert.Nil(t, stats.LastMerge.Err)
+	assert.False(t, stats.Merging)
+	value, err := db.Get("key")
+	assert.Nil(t, err, err)
+	assert.Equal(t, "value2", value)
+	value, err = db.Get("current")
+	assert.Nil(t, err, err)
+	assert.Equal(t, "value", value)
+}
+
+func TestDb_CompactRotatesKeys(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1000, WithEncryption(testKeyring(t, 1)))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	assert.Nil(t, db.Put("key", "value"))
+	assert.Nil(t, db.Rotate())
+	assert.Nil(t, db.Close())
+
+	// A single segment is rewritten with the new key.
+	db, err = NewDb(dir, 1000, WithEncryption(testKeyring(t, 1, 2)))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	assert.Nil(t, db.Compact())
+	assert.Eventually(t, func() bool {
+		return !db.Stats().Compacting
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, db.Close())
+
+	db, err = NewDb(dir, 1000, WithEncryption(testKeyring(t, 2)))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer db.Close()
+	value, err := db.Get("key")
+	assert.Nil(t, err, err)
+	assert.Equal(t, "value", value)
+}
+
+func TestDb_MergeFailure(t *testing.T) {
+	defer func(delay time.Duration) { mergeRetryDelay = delay }(mergeRetryDelay)
+	mergeRetryDelay = time.Millisecond
+
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1000, WithMaxSegments(2))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer db.Close()
+
+	assert.Nil(t, db.Put("a", "value"))
+	assert.Nil(t, db.Rotate())
+	// Corrupt the value of the only record of the oldest segment.
+	path := db.segmentPath(db.Stats().Segments[0].Gen)
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err, err)
+	data[13] ^= 1
+	assert.Nil(t, os.WriteFile(path, data, 0o600))
+
+	assert.Nil(t, db.Put("b", "value"))
+	assert.Nil(t, db.Rotate())
+	assert.Nil(t, db.Put("c", "value"))
+	err = db.Rotate()
+	assert.ErrorIs(t, err, ErrMergeFailed, "writers waiting for the merge fail")
+	assert.ErrorIs(t, err, ErrCorrupted)
+	stats := db.Stats()
+	assert.Len(t, stats.Segments, 2)
+	assert.NotNil(t, stats.LastMerge.Err)
+	assert.Equal(t, uint64(maxMergeFailures), stats.MergeFailures)
+	assertValue(t, db, "b", "value")
+
+	assert.ErrorIs(t, db.Compact(), ErrMergeFailed, "the merge is retried")
+	assert.Equal(t, uint64(2*maxMergeFailures), db.Stats().MergeFailures)
+}
+
+// stallMerges fills a Db opened WithMaxSegments(2) with segments that can't
+// be merged, so that the next rotation waits for a merge. The merge isn't
+// retried while the test runs.
+func stallMerges(t *testing.T, db *Db) {
+	mergeRetryDelay = time.Hour
+	assert.Nil(t, db.Put("a", "value"))
+	assert.Nil(t, db.Rotate())
+	path := db.segmentPath(db.Stats().Segments[0].Gen)
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err, err)
+	data[13] ^= 1
+	assert.Nil(t, os.WriteFile(path, data, 0o600))
+	assert.Nil(t, db.Put("b", "value"))
+	assert.Nil(t, db.Rotate())
+	assert.Nil(t, db.Put("c", "value"))
+}
+
+func TestDb_RotateContext(t *testing.T) {
+	defer func(delay time.Duration) { mergeRetryDelay = delay }(mergeRetryDelay)
+	db, err := NewDb(t.TempDir(), 1000, WithMaxSegments(2))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer db.Close()
+	stallMerges(t, db)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, db.RotateContext(ctx))
+	assert.Equal(t, context.DeadlineExceeded, db.CompactContext(ctx))
+	assert.Len(t, db.Stats().Segments, 2)
+	assertValue(t, db, "c", "value")
+}
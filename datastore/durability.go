@@ -0,0 +1,50 @@
+package datastore
+
+import (
+	"log"
+	"time"
+)
+
+// WithSyncWrites makes every write reach the disk before it is acknowledged.
+// Writes survive a crash of the machine, at the cost of an fsync each.
+func WithSyncWrites() Option {
+	return func(db *Db) {
+		db.syncWrites = true
+	}
+}
+
+// WithSyncInterval flushes the writes to disk every d. A crash of the
+// machine loses at most the writes of the last interval. Non-positive
+// values are ignored.
+func WithSyncInterval(d time.Duration) Option {
+	return func(db *Db) {
+		if d > 0 {
+			db.syncInterval = d
+		}
+	}
+}
+
+// durable tells whether writes are flushed to disk at all.
+func (db *Db) durable() bool {
+	return db.syncWrites || db.syncInterval > 0
+}
+
+// syncer flushes the current data file every syncInterval.
+func (db *Db) syncer() {
+	defer db.wg.Done()
+	ticker := time.NewTicker(db.syncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-db.done:
+			return
+		}
+		db.mu.Lock()
+		err := db.out.Sync()
+		db.mu.Unlock()
+		if err != nil {
+			log.Printf("Failed to sync the data file: %s", err)
+		}
+	}
+}
@@ -0,0 +1,41 @@
+package datastore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDb_Durability(t *testing.T) {
+	for name, opt := range map[string]Option{
+		"sync writes":   WithSyncWrites(),
+		"sync interval": WithSyncInterval(5 * time.Millisecond),
+	} {
+		t.Run(name, func(t *testing.T) {
+			dir, err := ioutil.TempDir("", "test-db")
+			assert.Nil(t, err, err)
+			defer os.RemoveAll(dir)
+
+			db, err := NewDb(dir, 100, opt)
+			assert.Nil(t, err, err)
+			for i := 0; i < 10; i++ {
+				assert.Nil(t, db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)))
+			}
+			time.Sleep(20 * time.Millisecond)
+			assert.Nil(t, db.Close())
+
+			db, err = NewDb(dir, 100, opt)
+			assert.Nil(t, err, err)
+			defer db.Close()
+			for i := 0; i < 10; i++ {
+				value, err := db.Get(fmt.Sprintf("key%d", i))
+				assert.Nil(t, err, err)
+				assert.Equal(t, fmt.Sprintf("value%d", i), value)
+			}
+		})
+	}
+}
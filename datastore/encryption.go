@@ -0,0 +1,202 @@
+package datastore
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Encrypted records keep the id of their key and the nonce in front of the
+// ciphertext, and the AEAD tag in place of the hash sum:
+//
+//	size|kl|key|vl|key id|nonce|ciphertext|16|tag
+//
+// vl counts the key id and the nonce, and has flagEncrypted set. The key is
+// the additional data of the AEAD, so records can't be moved between keys.
+const (
+	// EncryptionKeySize is the size of the AES-256 keys.
+	EncryptionKeySize  = 32
+	keyIDSize          = 4
+	nonceSize          = 12
+	tagSize            = 16
+	encryptionOverhead = keyIDSize + nonceSize
+)
+
+// ErrUnknownKey is returned for records encrypted with a key the Db doesn't
+// have.
+var ErrUnknownKey = errors.New("record is encrypted with an unknown key")
+
+var errDecryption = fmt.Errorf("%w: decryption failed", ErrCorrupted)
+
+// Keyring holds the keys a Db encrypts records with. New records are
+// encrypted with the current key, and the others only decrypt the records
+// written before it became current. Merges re-encrypt the records they copy
+// with the current key, so once every old segment is merged, the previous
+// keys are no longer needed.
+type Keyring struct {
+	current uint32
+	aeads   map[uint32]cipher.AEAD
+}
+
+// NewKeyring returns a keyring of keys by their ids, with the current one
+// used for new records.
+func NewKeyring(current uint32, keys map[uint32][]byte) (*Keyring, error) {
+	k := &Keyring{current: current, aeads: make(map[uint32]cipher.AEAD, len(keys))}
+	for id, key := range keys {
+		if len(key) != EncryptionKeySize {
+			return nil, fmt.Errorf("key %d has %d bytes instead of %d", id, len(key), EncryptionKeySize)
+		}
+		block, err := aes.NewCipher(key)
+		if err != nil {
+			return nil, err
+		}
+		if k.aeads[id], err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+	if _, ok := k.aeads[current]; !ok {
+		return nil, fmt.Errorf("current key %d is missing", current)
+	}
+	return k, nil
+}
+
+// ReadKeyFile reads a keyring from a file with a key on every line: its
+// numeric id and its 32 bytes in hex, like
+//
+//	1 4f0c...e2a1
+//
+// The key on the last line is the current one, so a key is rotated by
+// appending a new one. Empty lines and lines starting with # are skipped.
+func ReadKeyFile(path string) (*Keyring, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := make(map[uint32][]byte)
+	var current uint32
+	scanner := bufio.NewScanner(f)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: expected a key id and a hex key", path, n)
+		}
+		id, err := strconv.ParseUint(fields[0], 10, 32)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid key id %q", path, n, fields[0])
+		}
+		key, err := hex.DecodeString(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: invalid hex key", path, n)
+		}
+		if _, ok := keys[uint32(id)]; ok {
+			return nil, fmt.Errorf("%s:%d: key %d is repeated", path, n, id)
+		}
+		keys[uint32(id)] = key
+		current = uint32(id)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%s has no keys", path)
+	}
+	return NewKeyring(current, keys)
+}
+
+// WithEncryption encrypts the values of new records with the current key of
+// keys. Records written before, in plain text or with other keys of the
+// keyring, stay readable and are re-encrypted when merged. Values put with
+// PutReader and read with GetReader are held in memory, as the tag of a
+// value is only known once all of it is encrypted.
+func WithEncryption(keys *Keyring) Option {
+	return func(db *Db) {
+		db.keys = keys
+	}
+}
+
+// encodeRecord encodes e, encrypting its value with the current key of keys
+// unless keys is nil. Tombstones have no value and are never encrypted.
+func encodeRecord(e entry, keys *Keyring) ([]byte, error) {
+	if keys == nil || e.deleted {
+		return e.Encode(), nil
+	}
+	kl, vl := len(e.key), len(e.value)+encryptionOverhead
+	size := kl + vl + tagSize + 16
+	res := make([]byte, size)
+	binary.LittleEndian.PutUint32(res, uint32(size))
+	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
+	copy(res[8:], e.key)
+	vlField := uint32(vl) | flagEncrypted | e.flags()
+	binary.LittleEndian.PutUint32(res[kl+8:], vlField)
+	binary.LittleEndian.PutUint32(res[kl+12:], keys.current)
+	nonce := res[kl+12+keyIDSize : kl+12+encryptionOverhead]
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	// The tag also covers the key and the value length field with the flags.
+	sealed := keys.aeads[keys.current].Seal(nil, nonce, []byte(e.value), res[8:kl+12])
+	copy(res[kl+12+encryptionOverhead:], sealed[:len(e.value)])
+	binary.LittleEndian.PutUint32(res[kl+vl+12:], tagSize)
+	copy(res[kl+vl+16:], sealed[len(e.value):])
+	return res, nil
+}
+
+// decodeRecord checks a record read by readRecord and decodes it, decrypting
+// the value if it is encrypted.
+func decodeRecord(record []byte, keys *Keyring) (entry, error) {
+	kl := int(binary.LittleEndian.Uint32(record[4:]))
+	if kl+12 > len(record) {
+		return entry{}, fmt.Errorf("%w: key length of %d bytes", ErrCorrupted, kl)
+	}
+	vlField := binary.LittleEndian.Uint32(record[kl+8:])
+	vl := int(vlField & valueLenMask)
+	if kl+vl+16 > len(record) || kl+vl+16+int(binary.LittleEndian.Uint32(record[kl+vl+12:])) != len(record) {
+		return entry{}, fmt.Errorf("%w: inconsistent lengths", ErrCorrupted)
+	}
+	if vlField&flagEncrypted == 0 {
+		if !checkHash(record) {
+			return entry{}, errWrongHash
+		}
+		var e entry
+		e.Decode(record)
+		return e, nil
+	}
+
+	if vl < encryptionOverhead || len(record) != kl+vl+16+tagSize {
+		return entry{}, fmt.Errorf("%w: encrypted value is cut short", ErrCorrupted)
+	}
+	key := record[8 : kl+8]
+	region := record[kl+12 : kl+12+vl]
+	id := binary.LittleEndian.Uint32(region)
+	if keys == nil || keys.aeads[id] == nil {
+		return entry{}, fmt.Errorf("%w %d", ErrUnknownKey, id)
+	}
+	nonce := region[keyIDSize:encryptionOverhead]
+	sealed := make([]byte, 0, vl-encryptionOverhead+tagSize)
+	sealed = append(sealed, region[encryptionOverhead:]...)
+	sealed = append(sealed, record[kl+vl+16:]...)
+	value, err := keys.aeads[id].Open(nil, nonce, sealed, record[8:kl+12])
+	if err != nil {
+		return entry{}, errDecryption
+	}
+	return entry{
+		key:     string(key),
+		value:   string(value),
+		deleted: vlField&flagTombstone != 0,
+		more:    vlField&flagBatch != 0,
+	}, nil
+}
@@ -0,0 +1,202 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func testKeyring(t *testing.T, ids ...uint32) *Keyring {
+	keys := make(map[uint32][]byte)
+	for _, id := range ids {
+		keys[id] = bytes.Repeat([]byte{byte(id)}, EncryptionKeySize)
+	}
+	k, err := NewKeyring(ids[len(ids)-1], keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return k
+}
+
+// dirContains tells whether any file in dir contains s.
+func dirContains(t *testing.T, dir, s string) bool {
+	files, err := os.ReadDir(dir)
+	assert.Nil(t, err, err)
+	for _, f := range files {
+		data, err := os.ReadFile(filepath.Join(dir, f.Name()))
+		assert.Nil(t, err, err)
+		if bytes.Contains(data, []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestDb_Encryption(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1000, WithEncryption(testKeyring(t, 1)))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	assert.Nil(t, db.Put("key", "secret value"))
+	assert.Nil(t, db.PutReader(context.Background(), "stream", strings.NewReader("streamed secret")))
+	assert.Nil(t, db.Delete("deleted"))
+
+	value, err := db.Get("key")
+	assert.Nil(t, err, err)
+	assert.Equal(t, "secret value", value)
+	r, size, err := db.GetReader("stream")
+	if assert.Nil(t, err, err) {
+		data, err := io.ReadAll(r)
+		r.Close()
+		assert.Nil(t, err, err)
+		assert.Equal(t, "streamed secret", string(data))
+		assert.Equal(t, int64(len(data)), size)
+	}
+	assert.Nil(t, db.Close())
+	assert.False(t, dirContains(t, dir, "secret"), "values are stored in plain text")
+
+	t.Run("without the key", func(t *testing.T) {
+		db, err := NewDb(dir, 1000)
+		if !assert.Nil(t, err, err) {
+			return
+		}
+		defer db.Close()
+		_, err = db.Get("key")
+		assert.True(t, errors.Is(err, ErrUnknownKey), "unexpected error: %v", err)
+	})
+
+	t.Run("corrupted", func(t *testing.T) {
+		path := filepath.Join(dir, outFileName)
+		data, err := os.ReadFile(path)
+		assert.Nil(t, err, err)
+		// The first record is key's, the last byte of its tag is flipped.
+		data[int(data[0])-1] ^= 1
+		assert.Nil(t, os.WriteFile(path, data, 0o600))
+
+		db, err := NewDb(dir, 1000, WithEncryption(testKeyring(t, 1)))
+		if !assert.Nil(t, err, err) {
+			return
+		}
+		defer db.Close()
+		_, err = db.Get("key")
+		assert.True(t, errors.Is(err, ErrCorrupted), "unexpected error: %v", err)
+	})
+}
+
+func TestDb_KeyRotation(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 80, WithEncryption(testKeyring(t, 1)))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	long := "Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor."
+	for i := 0; i < 5; i++ {
+		// every Put rotates the current data file
+		assert.Nil(t, db.Put(fmt.Sprintf("old%d", i), long))
+	}
+	assert.Nil(t, db.Close())
+
+	db, err = NewDb(dir, 80, WithEncryption(testKeyring(t, 1, 2)))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	for i := 0; i < 5; i++ {
+		assert.Nil(t, db.Put(fmt.Sprintf("new%d", i), long))
+	}
+	assert.Eventually(t, func() bool {
+		db.mu.Lock()
+		defer db.mu.Unlock()
+		return len(db.segments) == 1 && db.outOffset == 0
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, db.Close())
+
+	// All the old records were merged, so the first key is no longer
+	// needed.
+	db, err = NewDb(dir, 80, WithEncryption(testKeyring(t, 2)))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer db.Close()
+	for i := 0; i < 5; i++ {
+		value, err := db.Get(fmt.Sprintf("old%d", i))
+		assert.Nil(t, err, err)
+		assert.Equal(t, long, value)
+	}
+}
+
+func TestDb_EncryptedSnapshot(t *testing.T) {
+	src, err := NewDb(t.TempDir(), 1000, WithEncryption(testKeyring(t, 1)))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer src.Close()
+	assert.Nil(t, src.Put("key", "value"))
+	snapshot, seq, err := src.Snapshot()
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer snapshot.Close()
+
+	dst, err := NewDb(t.TempDir(), 1000, WithEncryption(testKeyring(t, 7)))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer dst.Close()
+	assert.Nil(t, dst.Restore(snapshot, seq))
+	value, err := dst.Get("key")
+	assert.Nil(t, err, err)
+	assert.Equal(t, "value", value)
+}
+
+func TestReadKeyFile(t *testing.T) {
+	dir := t.TempDir()
+	key1, key2 := strings.Repeat("01", EncryptionKeySize), strings.Repeat("02", EncryptionKeySize)
+	path := filepath.Join(dir, "keys")
+	assert.Nil(t, os.WriteFile(path, []byte("# old\n1 "+key1+"\n\n2 "+key2+"\n"), 0o600))
+	k, err := ReadKeyFile(path)
+	if assert.Nil(t, err, err) {
+		assert.Equal(t, uint32(2), k.current)
+		assert.Len(t, k.aeads, 2)
+	}
+
+	for name, content := range map[string]string{
+		"empty":     "# no keys\n",
+		"short key": "1 0102\n",
+		"not hex":   "1 " + strings.Repeat("zz", EncryptionKeySize) + "\n",
+		"no id":     key1 + "\n",
+		"repeated":  "1 " + key1 + "\n1 " + key2 + "\n",
+	} {
+		assert.Nil(t, os.WriteFile(path, []byte(content), 0o600))
+		_, err := ReadKeyFile(path)
+		assert.NotNil(t, err, name)
+	}
+}
+
+func TestDecodeRecord_Flags(t *testing.T) {
+	keys := testKeyring(t, 1)
+	record, err := encodeRecord(entry{key: "key", value: "secret value"}, keys)
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	e, err := decodeRecord(record, keys)
+	assert.Nil(t, err, err)
+	assert.Equal(t, entry{key: "key", value: "secret value"}, e)
+
+	// The value length field follows the 3 bytes of the key.
+	for _, flag := range []byte{0x80, 0x40} {
+		flipped := append([]byte(nil), record...)
+		flipped[14] ^= flag
+		_, err := decodeRecord(flipped, keys)
+		assert.ErrorIs(t, err, errDecryption, "flag %x", flag)
+	}
+}
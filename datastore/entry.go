@@ -6,26 +6,55 @@ import (
 	"crypto/sha256"
 	"encoding/binary"
 	"fmt"
+	"hash"
+	"io"
+)
+
+// The top bits of the value length field are flags. flagTombstone marks a
+// record that deletes its key; tombstones have no value. flagBatch marks a
+// record of a batch that is followed by more records of the same batch, so a
+// batch cut short by a crash can be told apart and dropped. flagEncrypted
+// marks a record with an encrypted value, see encodeRecord. The whole field
+// is covered by the hash sum, or the authentication tag of an encrypted
+// value, so a flipped flag is caught like a flipped value.
+const (
+	flagTombstone = 1 << 31
+	flagBatch     = 1 << 30
+	flagEncrypted = 1 << 29
+	valueLenMask  = flagEncrypted - 1
 )
 
 type entry struct {
 	key, value string
+	deleted    bool
+	// more is set for a record of a batch that more records of it follow.
+	more bool
+}
+
+// flags returns the flags of the value length field of e.
+func (e *entry) flags() uint32 {
+	var flags uint32
+	if e.deleted {
+		flags |= flagTombstone
+	}
+	if e.more {
+		flags |= flagBatch
+	}
+	return flags
 }
 
 func (e *entry) Encode() []byte {
-	data := []byte(e.key + e.value)
-	hasher := sha256.New()
-	hasher.Write(data)
-	hashSum := hasher.Sum(nil)
-	hl := len(hashSum)
 	kl := len(e.key)
 	vl := len(e.value)
+	vlField := uint32(vl) | e.flags()
+	hashSum := recordSum([]byte(e.key), []byte(e.value), vlField)
+	hl := len(hashSum)
 	size := kl + vl + hl + 16
 	res := make([]byte, size)
 	binary.LittleEndian.PutUint32(res, uint32(size))
 	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
 	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
+	binary.LittleEndian.PutUint32(res[kl+8:], vlField)
 	copy(res[kl+12:], e.value)
 	binary.LittleEndian.PutUint32(res[kl+vl+12:], uint32(hl))
 	copy(res[kl+vl+16:], hashSum)
@@ -38,52 +67,92 @@ func (e *entry) Decode(input []byte) {
 	copy(keyBuf, input[8:kl+8])
 	e.key = string(keyBuf)
 
-	vl := binary.LittleEndian.Uint32(input[kl+8:])
+	vlField := binary.LittleEndian.Uint32(input[kl+8:])
+	e.deleted = vlField&flagTombstone != 0
+	e.more = vlField&flagBatch != 0
+	vl := vlField & valueLenMask
 	valBuf := make([]byte, vl)
 	copy(valBuf, input[kl+12:kl+12+vl])
 	e.value = string(valBuf)
 }
 
-func checkHash(input []byte) bool {
-	kl := binary.LittleEndian.Uint32(input[4:])
-	keyBuf := make([]byte, kl)
-	copy(keyBuf, input[8:kl+8])
+var errWrongHash = fmt.Errorf("%w: wrong hash sum", ErrCorrupted)
 
-	vl := binary.LittleEndian.Uint32(input[kl+8:])
-	valBuf := make([]byte, vl)
-	copy(valBuf, input[kl+12:kl+12+vl])
-
-	data := append(keyBuf, valBuf...)
+// recordSum is the hash sum of a record: of its key, its value and the value
+// length field with the flags.
+func recordSum(key, value []byte, vlField uint32) []byte {
 	hasher := sha256.New()
-	hasher.Write(data)
-	counted := hasher.Sum(nil)
+	hasher.Write(key)
+	hasher.Write(value)
+	return sumField(hasher, vlField)
+}
 
-	hl := binary.LittleEndian.Uint32(input[kl+12+vl:])
-	hashBuf := make([]byte, hl)
-	copy(hashBuf, input[kl+vl+16:kl+vl+16+hl])
+// sumField adds the value length field to the key and the value written to
+// hasher and returns the hash sum of the record.
+func sumField(hasher hash.Hash, vlField uint32) []byte {
+	var field [4]byte
+	binary.LittleEndian.PutUint32(field[:], vlField)
+	hasher.Write(field[:])
+	return hasher.Sum(nil)
+}
 
-	if bytes.Equal(hashBuf, counted) {
+// matchSum tells whether sum is the hash sum of a record whose key and value
+// were written to hasher. Records written before there were flags have a sum
+// of the key and the value alone, which is accepted only without flags, so
+// that setting one isn't let through.
+func matchSum(hasher hash.Hash, vlField uint32, sum []byte) bool {
+	legacy := hasher.Sum(nil)
+	if bytes.Equal(sumField(hasher, vlField), sum) {
 		return true
 	}
-	return false
+	return vlField&^valueLenMask == 0 && bytes.Equal(legacy, sum)
+}
+
+func checkHash(input []byte) bool {
+	kl := binary.LittleEndian.Uint32(input[4:])
+	vlField := binary.LittleEndian.Uint32(input[kl+8:])
+	vl := vlField & valueLenMask
+	hl := binary.LittleEndian.Uint32(input[kl+12+vl:])
+
+	hasher := sha256.New()
+	hasher.Write(input[8 : kl+8])
+	hasher.Write(input[kl+12 : kl+12+vl])
+	return matchSum(hasher, vlField, input[kl+vl+16:kl+vl+16+hl])
 }
 
 func readValue(input []byte) string {
 	kl := int(binary.LittleEndian.Uint32(input[4:]))
-	vl := int(binary.LittleEndian.Uint32(input[kl+8:]))
+	vl := int(binary.LittleEndian.Uint32(input[kl+8:]) & valueLenMask)
 	data := make([]byte, vl)
 	copy(data, input[kl+12:kl+12+vl])
 	return string(data)
 }
 
+func isTombstone(input []byte) bool {
+	kl := binary.LittleEndian.Uint32(input[4:])
+	return binary.LittleEndian.Uint32(input[kl+8:])&flagTombstone != 0
+}
+
+// inBatch tells whether more records of the same batch follow a record.
+func inBatch(input []byte) bool {
+	kl := binary.LittleEndian.Uint32(input[4:])
+	return binary.LittleEndian.Uint32(input[kl+8:])&flagBatch != 0
+}
+
+// minRecordSize is the size of a record with an empty key and value.
+const minRecordSize = 16 + sha256.Size
+
 func readRecord(in *bufio.Reader) ([]byte, error) {
 	header, err := in.Peek(4)
 	if err != nil {
 		return nil, err
 	}
 	len := int(binary.LittleEndian.Uint32(header[0:]))
+	if len < minRecordSize {
+		return nil, fmt.Errorf("%w: size of %d bytes", ErrCorrupted, len)
+	}
 	data := make([]byte, len)
-	n, err := in.Read(data)
+	n, err := io.ReadFull(in, data)
 	if err != nil {
 		return nil, err
 	}
@@ -3,11 +3,12 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha256"
 	"testing"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value"}
+	e := entry{key: "key", value: "value"}
 	e.Decode(e.Encode())
 	if e.key != "key" {
 		t.Error("incorrect key")
@@ -18,7 +19,7 @@ func TestEntry_Encode(t *testing.T) {
 }
 
 func TestReadValue(t *testing.T) {
-	e := entry{"key", "test-value"}
+	e := entry{key: "key", value: "test-value"}
 	data := e.Encode()
 	record, err := readRecord(bufio.NewReader(bytes.NewReader(data)))
 	if err != nil {
@@ -31,7 +32,7 @@ func TestReadValue(t *testing.T) {
 }
 
 func TestHashCheck(t *testing.T) {
-	e := entry{"key", "test-value"}
+	e := entry{key: "key", value: "test-value"}
 	data := e.Encode()
 	ok := checkHash(data)
 	if !ok {
@@ -43,3 +44,49 @@ func TestHashCheck(t *testing.T) {
 		t.Errorf("hashCheck passed corrupted data")
 	}
 }
+
+func TestEntry_Tombstone(t *testing.T) {
+	e := entry{key: "key", deleted: true}
+	data := e.Encode()
+	if !isTombstone(data) || !checkHash(data) {
+		t.Error("tombstone wasn't encoded")
+	}
+	var decoded entry
+	decoded.Decode(data)
+	if decoded != e {
+		t.Errorf("incorrect tombstone %v", decoded)
+	}
+}
+
+func TestHashCheck_Flags(t *testing.T) {
+	e := entry{key: "key", value: "test-value"}
+	data := e.Encode()
+	// Turn the record into a tombstone, then into a batch record.
+	for _, flag := range []byte{0x80, 0x40} {
+		flipped := append([]byte(nil), data...)
+		flipped[14] ^= flag
+		if checkHash(flipped) {
+			t.Errorf("hashCheck passed a flipped flag %x", flag)
+		}
+	}
+}
+
+func TestHashCheck_Legacy(t *testing.T) {
+	// Records written before there were flags have a hash sum of the key and
+	// the value alone.
+	e := entry{key: "key", value: "test-value"}
+	data := e.Encode()
+	legacy := sha256.Sum256([]byte("keytest-value"))
+	copy(data[len(data)-sha256.Size:], legacy[:])
+	if !checkHash(data) {
+		t.Error("hashCheck failed a legacy record")
+	}
+	// They have no flags, so one can't be set on them.
+	for _, flag := range []byte{0x80, 0x40} {
+		flipped := append([]byte(nil), data...)
+		flipped[14] ^= flag
+		if checkHash(flipped) {
+			t.Errorf("hashCheck passed a legacy record with flag %x", flag)
+		}
+	}
+}
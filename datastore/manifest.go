@@ -0,0 +1,162 @@
+package datastore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+const (
+	manifestFileName = "MANIFEST"
+	// legacyMergedName is where merges used to be written before manifests.
+	legacyMergedName = "merged"
+)
+
+// manifest lists the live segments of a Db, oldest first, by generation ID.
+// A segment with generation gen is stored in the file named gen. Seq is the
+// sequence number of the last write sealed into a segment.
+type manifest struct {
+	NextGen  uint64   `json:"next_gen"`
+	Seq      uint64   `json:"seq"`
+	Segments []uint64 `json:"segments"`
+}
+
+type segment struct {
+	gen   uint64
+	index hashIndex
+	// size is the size of the segment file in bytes.
+	size int64
+}
+
+func (db *Db) segmentPath(gen uint64) string {
+	return filepath.Join(db.dir, strconv.FormatUint(gen, 10))
+}
+
+// writeManifest atomically replaces the manifest with the current segment
+// set. db.mu must be held.
+func (db *Db) writeManifest() error {
+	m := manifest{NextGen: db.nextGen, Seq: db.sealedSeq, Segments: make([]uint64, len(db.segments))}
+	for i, s := range db.segments {
+		m.Segments[i] = s.gen
+	}
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+
+	manifestPath := filepath.Join(db.dir, manifestFileName)
+	tmpPath := manifestPath + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, manifestPath); err != nil {
+		return err
+	}
+	return syncDir(db.dir)
+}
+
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// readManifest loads the manifest of the Db directory. If there is none, it
+// is built from the numbered segment files the directory used to hold.
+func (db *Db) readManifest() (manifest, error) {
+	var m manifest
+	data, err := os.ReadFile(filepath.Join(db.dir, manifestFileName))
+	if os.IsNotExist(err) {
+		for ; ; m.NextGen++ {
+			if _, err := os.Stat(db.segmentPath(m.NextGen)); err != nil {
+				break
+			}
+			m.Segments = append(m.Segments, m.NextGen)
+		}
+		return m, nil
+	}
+	if err != nil {
+		return m, err
+	}
+	if err := json.Unmarshal(data, &m); err != nil {
+		return m, fmt.Errorf("corrupted manifest: %w", err)
+	}
+	return m, nil
+}
+
+// recoverSegments opens the segments listed in the manifest and removes
+// files left behind by an interrupted merge or manifest update, unless the
+// Db is opened read-only.
+func (db *Db) recoverSegments() error {
+	m, err := db.readManifest()
+	if err != nil {
+		return err
+	}
+
+	live := make(map[string]bool)
+	for i, gen := range m.Segments {
+		segPath := db.segmentPath(gen)
+		live[filepath.Base(segPath)] = true
+		if _, err := os.Stat(segPath); os.IsNotExist(err) {
+			// A rotation lists the new segment before renaming the current
+			// data file, so the newest segment may still be under that name.
+			if i != len(m.Segments)-1 {
+				return fmt.Errorf("segment %d listed in the manifest is missing", gen)
+			}
+			if db.openedReadOnly {
+				return fmt.Errorf("segment %d is still the current data file, open the db writable to repair it", gen)
+			}
+			if err := os.Rename(db.outPath, segPath); err != nil {
+				return fmt.Errorf("segment %d listed in the manifest is missing: %w", gen, err)
+			}
+		}
+		index, size, _, err := recoverFile(segPath)
+		if err != nil && err != io.EOF {
+			return err
+		}
+		db.segments = append(db.segments, &segment{gen: gen, index: index, size: size})
+	}
+	db.nextGen = m.NextGen
+	db.sealedSeq = m.Seq
+	db.seq = m.Seq
+	if db.openedReadOnly {
+		return nil
+	}
+
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return err
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || live[name] {
+			continue
+		}
+		_, numErr := strconv.ParseUint(name, 10, 64)
+		isTmp := strings.HasPrefix(name, snapshotFilePrefix) || strings.HasPrefix(name, spoolFilePrefix) ||
+			name == manifestFileName+".tmp"
+		if numErr == nil || isTmp || name == legacyMergedName {
+			os.Remove(filepath.Join(db.dir, name))
+		}
+	}
+	return db.writeManifest()
+}
@@ -0,0 +1,97 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeRecords(t *testing.T, path string, pairs ...string) {
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY|os.O_CREATE, 0o600)
+	assert.Nil(t, err, err)
+	defer f.Close()
+	for i := 0; i < len(pairs); i += 2 {
+		e := entry{key: pairs[i], value: pairs[i+1]}
+		_, err := f.Write(e.Encode())
+		assert.Nil(t, err, err)
+	}
+}
+
+func assertValue(t *testing.T, db *Db, key, expected string) {
+	value, err := db.Get(key)
+	assert.Nil(t, err, "Cannot get %s: %s", key, err)
+	assert.Equal(t, expected, value)
+}
+
+func TestManifest_LegacyLayout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	writeRecords(t, filepath.Join(dir, "0"), "a", "a0", "b", "b0")
+	writeRecords(t, filepath.Join(dir, "1"), "a", "a1")
+	writeRecords(t, filepath.Join(dir, legacyMergedName), "a", "garbage")
+
+	db, err := NewDb(dir, 1000)
+	assert.Nil(t, err, err)
+	defer db.Close()
+
+	assertValue(t, db, "a", "a1")
+	assertValue(t, db, "b", "b0")
+	_, err = os.Stat(filepath.Join(dir, manifestFileName))
+	assert.Nil(t, err, "manifest wasn't written")
+	_, err = os.Stat(filepath.Join(dir, legacyMergedName))
+	assert.True(t, os.IsNotExist(err), "unfinished merge wasn't removed")
+}
+
+func TestManifest_InterruptedMerge(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	// The merge of segments 0 and 1 into 2 crashed before the manifest
+	// was switched, so segment 2 is an orphan.
+	writeRecords(t, filepath.Join(dir, "0"), "a", "a0")
+	writeRecords(t, filepath.Join(dir, "1"), "a", "a1")
+	writeRecords(t, filepath.Join(dir, "2"), "a", "a0")
+	data := []byte(`{"next_gen": 2, "segments": [0, 1]}`)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, manifestFileName), data, 0o600))
+
+	db, err := NewDb(dir, 1000)
+	assert.Nil(t, err, err)
+	defer db.Close()
+
+	assertValue(t, db, "a", "a1")
+	_, err = os.Stat(filepath.Join(dir, "2"))
+	assert.True(t, os.IsNotExist(err), "orphaned segment wasn't removed")
+}
+
+func TestManifest_InterruptedRotation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	// The rotation listed segment 1 but crashed before renaming the
+	// current data file.
+	writeRecords(t, filepath.Join(dir, "0"), "a", "a0", "b", "b0")
+	writeRecords(t, filepath.Join(dir, outFileName), "a", "a1")
+	data := []byte(`{"next_gen": 2, "segments": [0, 1]}`)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, manifestFileName), data, 0o600))
+
+	db, err := NewDb(dir, 1000)
+	assert.Nil(t, err, err)
+
+	assertValue(t, db, "a", "a1")
+	assertValue(t, db, "b", "b0")
+	assert.Nil(t, db.Put("c", "c1"))
+	assert.Nil(t, db.Close())
+
+	db, err = NewDb(dir, 1000)
+	assert.Nil(t, err, err)
+	defer db.Close()
+	assertValue(t, db, "a", "a1")
+	assertValue(t, db, "c", "c1")
+}
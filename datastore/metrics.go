@@ -0,0 +1,96 @@
+package datastore
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Upper bounds of the histogram buckets in seconds. Reads and writes mostly
+// take well under a millisecond, while merges rewrite whole segments.
+var (
+	latencyBounds = []float64{.0001, .00025, .0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5}
+	mergeBounds   = []float64{.01, .05, .1, .25, .5, 1, 2.5, 5, 10, 30, 60, 120}
+)
+
+// Histogram is a snapshot of a distribution of durations, laid out like a
+// Prometheus histogram.
+type Histogram struct {
+	// Bounds are the upper bounds of the buckets in seconds, and Counts[i]
+	// is the number of durations of at most Bounds[i].
+	Bounds []float64
+	Counts []uint64
+	// Count is the number of all durations and Sum is their total in
+	// seconds.
+	Count uint64
+	Sum   float64
+}
+
+// SegmentStats describes a sealed segment.
+type SegmentStats struct {
+	Gen   uint64
+	Path  string
+	Bytes int64
+	// Keys is the number of keys in the index of the segment.
+	Keys int
+}
+
+// MergeStats describes a merge: when it started, how long it took and why it
+// failed, if it did.
+type MergeStats struct {
+	At       time.Time
+	Duration time.Duration
+	Err      error
+}
+
+// histogram counts durations in buckets. It has its own lock, as writes are
+// timed without holding db.mu.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	// counts[i] is the number of durations in bucket i alone; the last one
+	// is for those over every bound.
+	counts []uint64
+	sum    float64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(d time.Duration) {
+	s := d.Seconds()
+	i := sort.SearchFloat64s(h.bounds, s)
+	h.mu.Lock()
+	h.counts[i]++
+	h.sum += s
+	h.mu.Unlock()
+}
+
+// since observes the time passed since start.
+func (h *histogram) since(start time.Time) {
+	h.observe(time.Since(start))
+}
+
+func (h *histogram) snapshot() Histogram {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	res := Histogram{Bounds: h.bounds, Counts: make([]uint64, len(h.bounds)), Sum: h.sum}
+	for i, n := range h.counts {
+		res.Count += n
+		if i < len(res.Counts) {
+			res.Counts[i] = res.Count
+		}
+	}
+	return res
+}
+
+// countChecksum counts err if a record failed its hash sum or, for encrypted
+// records, its authentication tag. It returns err.
+func (db *Db) countChecksum(err error) error {
+	if errors.Is(err, errWrongHash) || errors.Is(err, errDecryption) {
+		db.checksumFailures.Add(1)
+	}
+	return err
+}
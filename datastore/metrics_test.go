@@ -0,0 +1,73 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestHistogram(t *testing.T) {
+	h := newHistogram([]float64{.001, .01, .1})
+	for _, d := range []time.Duration{500 * time.Microsecond, time.Millisecond, 5 * time.Millisecond, time.Second} {
+		h.observe(d)
+	}
+	s := h.snapshot()
+	assert.Equal(t, []uint64{2, 3, 3}, s.Counts)
+	assert.Equal(t, uint64(4), s.Count)
+	assert.InDelta(t, 1.0065, s.Sum, 1e-9)
+}
+
+func TestDb_Metrics(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 80)
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer db.Close()
+	long := "Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor."
+
+	for i := 0; i < 3; i++ {
+		// every Put rotates the current data file
+		assert.Nil(t, db.Put(fmt.Sprintf("key%d", i), long))
+	}
+	assert.Eventually(t, func() bool {
+		return len(db.Stats().Segments) == 1
+	}, time.Second, 10*time.Millisecond)
+	assert.Nil(t, db.Put("short", "value"))
+	for i := 0; i < 2; i++ {
+		_, err := db.Get("key0")
+		assert.Nil(t, err, err)
+	}
+
+	stats := db.Stats()
+	assert.Equal(t, uint64(4), stats.PutLatency.Count)
+	assert.Equal(t, uint64(2), stats.GetLatency.Count)
+	assert.Equal(t, uint64(2), stats.Merges)
+	assert.Equal(t, stats.Merges, stats.MergeDuration.Count)
+	assert.Equal(t, uint64(0), stats.MergeFailures)
+	var keys int
+	for _, seg := range stats.Segments {
+		info, err := os.Stat(db.segmentPath(seg.Gen))
+		if assert.Nil(t, err, err) {
+			assert.Equal(t, info.Size(), seg.Bytes)
+		}
+		keys += seg.Keys
+	}
+	assert.Equal(t, 3, keys)
+	assert.Equal(t, 1, stats.CurrentKeys)
+	assert.Equal(t, int64(minRecordSize+len("short")+len("value")), stats.CurrentBytes)
+
+	// Flip the last byte of the hash sum of the record of short.
+	path := filepath.Join(dir, outFileName)
+	data, err := os.ReadFile(path)
+	assert.Nil(t, err, err)
+	data[len(data)-1] ^= 1
+	assert.Nil(t, os.WriteFile(path, data, 0o600))
+	_, err = db.Get("short")
+	assert.ErrorIs(t, err, ErrCorrupted)
+	assert.Equal(t, uint64(1), db.Stats().ChecksumFailures)
+}
@@ -0,0 +1,170 @@
+package datastore
+
+import (
+	"encoding/binary"
+	"errors"
+	"os"
+)
+
+// ErrQuotaExceeded is returned for writes that would take a Db over the
+// limits set by WithQuota.
+var ErrQuotaExceeded = errors.New("quota exceeded")
+
+// ErrKeyTooLarge is returned for keys over the size limit set by
+// WithMaxKeySize.
+var ErrKeyTooLarge = errors.New("key is too large")
+
+// Usage is the live data of a Db: the number of keys that have values and
+// the total size of those keys and values in bytes. Stale records waiting to
+// be merged don't count.
+type Usage struct {
+	Keys  int64 `json:"keys"`
+	Bytes int64 `json:"bytes"`
+}
+
+// WithQuota limits the usage of a Db. Writes that would increase the number
+// of keys over maxKeys or their total size over maxBytes fail with
+// ErrQuotaExceeded; deletions and writes that shrink the usage always pass.
+// Zero means no limit. Replicated records are applied regardless, so that a
+// replica always mirrors its primary.
+func WithQuota(maxKeys, maxBytes int64) Option {
+	return func(db *Db) {
+		if maxKeys > 0 {
+			db.maxKeys = maxKeys
+		}
+		if maxBytes > 0 {
+			db.maxBytes = maxBytes
+		}
+	}
+}
+
+// WithMaxKeySize sets the size limit of a key in bytes. Non-positive values
+// are ignored.
+func WithMaxKeySize(n int) Option {
+	return func(db *Db) {
+		if n > 0 {
+			db.maxKeySize = n
+		}
+	}
+}
+
+// Usage returns the current usage of the Db.
+func (db *Db) Usage() Usage {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.usage
+}
+
+// Quota returns the limits set by WithQuota, zero for the unlimited ones.
+func (db *Db) Quota() Usage {
+	return Usage{Keys: db.maxKeys, Bytes: db.maxBytes}
+}
+
+func (db *Db) checkKey(key string) error {
+	if db.maxKeySize > 0 && len(key) > db.maxKeySize {
+		return ErrKeyTooLarge
+	}
+	return nil
+}
+
+// checkQuota tells whether the writes of a message keep the Db within its
+// quota. db.mu must be held.
+func (db *Db) checkQuota(m putMessage) error {
+	if db.maxKeys == 0 && db.maxBytes == 0 {
+		return nil
+	}
+	// Later entries of a batch replace earlier ones.
+	last := make(map[string]entry, len(m.entries))
+	for _, e := range m.entries {
+		last[e.key] = e
+	}
+	var keys, bytes int64
+	for key, e := range last {
+		old, existed := db.sizes[key]
+		bytes -= old
+		if existed {
+			keys--
+		}
+		if !e.deleted {
+			bytes += entrySize(e)
+			if m.spooled != nil {
+				bytes += m.spooled.size
+			}
+			keys++
+		}
+	}
+	if keys > 0 && db.maxKeys > 0 && db.usage.Keys+keys > db.maxKeys {
+		return ErrQuotaExceeded
+	}
+	if bytes > 0 && db.maxBytes > 0 && db.usage.Bytes+bytes > db.maxBytes {
+		return ErrQuotaExceeded
+	}
+	return nil
+}
+
+// entrySize is the size of the key and the value of an entry.
+func entrySize(e entry) int64 {
+	return int64(len(e.key) + len(e.value))
+}
+
+// account records the size of a key and its value after a write. db.mu must
+// be held.
+func (db *Db) account(key string, size int64, deleted bool) {
+	if old, ok := db.sizes[key]; ok {
+		db.usage.Keys--
+		db.usage.Bytes -= old
+		delete(db.sizes, key)
+	}
+	if !deleted {
+		db.sizes[key] = size
+		db.usage.Keys++
+		db.usage.Bytes += size
+	}
+}
+
+// recoverUsage computes the usage from the headers of the latest record of
+// every key. db.mu must be held.
+func (db *Db) recoverUsage() error {
+	latest := make(mergeIndex)
+	for _, seg := range db.segments {
+		for key, offset := range seg.index {
+			latest[key] = mergeItem{path: db.segmentPath(seg.gen), offset: offset}
+		}
+	}
+	for key, offset := range db.index {
+		latest[key] = mergeItem{path: db.outPath, offset: offset}
+	}
+
+	files := make(map[string]*os.File)
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+	db.sizes = make(map[string]int64, len(latest))
+	db.usage = Usage{}
+	var header [4]byte
+	for key, item := range latest {
+		f, ok := files[item.path]
+		if !ok {
+			var err error
+			if f, err = os.Open(item.path); err != nil {
+				return err
+			}
+			files[item.path] = f
+		}
+		if _, err := f.ReadAt(header[:], item.offset+8+int64(len(key))); err != nil {
+			return err
+		}
+		vlField := binary.LittleEndian.Uint32(header[:])
+		if vlField&flagTombstone != 0 {
+			continue
+		}
+		vl := int64(vlField & valueLenMask)
+		if vlField&flagEncrypted != 0 {
+			vl -= encryptionOverhead
+		}
+		db.account(key, int64(len(key))+vl, false)
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package datastore
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDb_Quota(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 100, WithQuota(3, 40), WithMaxKeySize(8))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	ctx := context.Background()
+	assert.Equal(t, Usage{Keys: 3, Bytes: 40}, db.Quota())
+
+	assert.Nil(t, db.Put("a", "123456789"))
+	assert.Nil(t, db.Put("b", "123456789"))
+	assert.Nil(t, db.PutReader(ctx, "c", strings.NewReader("123456789")))
+	assert.Equal(t, Usage{Keys: 3, Bytes: 30}, db.Usage())
+
+	assert.Equal(t, ErrQuotaExceeded, db.Put("d", "1"), "too many keys")
+	assert.Equal(t, ErrQuotaExceeded, db.Put("a", strings.Repeat("x", 20)), "too many bytes")
+	assert.Equal(t, ErrQuotaExceeded, db.PutBatch(ctx, []KeyValue{{"a", "1"}, {"d", "1"}}))
+	assert.Equal(t, ErrKeyTooLarge, db.Put("very long key", "1"))
+
+	// Shrinking writes and deletions always pass.
+	assert.Nil(t, db.Put("a", "1"))
+	assert.Nil(t, db.Delete("b"))
+	assert.Equal(t, Usage{Keys: 2, Bytes: 12}, db.Usage())
+	assert.Nil(t, db.PutBatch(ctx, []KeyValue{{"b", strings.Repeat("x", 30)}, {"b", "12345"}}), "only the last write of a key counts")
+	assert.Equal(t, Usage{Keys: 3, Bytes: 18}, db.Usage())
+
+	// Replicated records ignore the quota.
+	assert.Nil(t, db.Apply(ctx, Record{Seq: db.Seq() + 1, Key: "e", Value: "1"}))
+	assert.Equal(t, int64(4), db.Usage().Keys)
+	assert.Nil(t, db.Close())
+
+	db, err = NewDb(dir, 100)
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer db.Close()
+	assert.Equal(t, Usage{Keys: 4, Bytes: 20}, db.Usage(), "usage is recovered on start")
+}
@@ -0,0 +1,56 @@
+package datastore
+
+import "errors"
+
+// ErrReadOnly is returned for writes to a Db in read-only mode.
+var ErrReadOnly = errors.New("db is read-only")
+
+var errOpenedReadOnly = errors.New("db is opened read-only and can't become writable")
+
+// WithReadOnly opens a Db in read-only mode for good. It leaves the files as
+// they are, even the tail of a write cut short by a crash, which is only
+// left out of the index. The current data file isn't opened for writing and
+// the merger doesn't run.
+func WithReadOnly() Option {
+	return func(db *Db) {
+		db.readOnly = true
+		db.openedReadOnly = true
+	}
+}
+
+// SetReadOnly turns the read-only mode on or off. In read-only mode, writes,
+// replicated records, Compact, Rotate and Restore fail with ErrReadOnly and
+// merges are paused, so the files don't change; reads are served as usual.
+// Turning it on waits for the write and the merge in progress, and writes
+// waiting for a merge fail with ErrReadOnly. A Db opened with WithReadOnly
+// can't be made writable.
+func (db *Db) SetReadOnly(readOnly bool) error {
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if !readOnly && db.openedReadOnly {
+		return errOpenedReadOnly
+	}
+	db.readOnly = readOnly
+	if readOnly {
+		// Writers waiting for a merge give up.
+		db.segCond.Broadcast()
+		for db.merging {
+			db.segCond.Wait()
+		}
+	} else {
+		db.scheduleMerge()
+	}
+	return nil
+}
+
+// ReadOnly tells whether the Db is in read-only mode.
+func (db *Db) ReadOnly() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.readOnly
+}
@@ -0,0 +1,130 @@
+package datastore
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDb_SetReadOnly(t *testing.T) {
+	db, err := NewDb(t.TempDir(), 1000)
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer db.Close()
+
+	ctx := context.Background()
+	assert.Nil(t, db.Put("key", "value"))
+	assert.Nil(t, db.SetReadOnly(true))
+	assert.True(t, db.ReadOnly())
+
+	assert.Equal(t, ErrReadOnly, db.Put("key", "other"))
+	assert.Equal(t, ErrReadOnly, db.Delete("key"))
+	assert.Equal(t, ErrReadOnly, db.PutBatch(ctx, []KeyValue{{Key: "a", Value: "1"}}))
+	assert.Equal(t, ErrReadOnly, db.PutReader(ctx, "a", strings.NewReader("1")))
+	assert.Equal(t, ErrReadOnly, db.Apply(ctx, Record{Seq: 2, Key: "a", Value: "1"}))
+	assert.Equal(t, ErrReadOnly, db.Compact())
+	assert.Equal(t, ErrReadOnly, db.Rotate())
+	assert.Equal(t, ErrReadOnly, db.Restore(strings.NewReader(""), 0))
+	value, err := db.Get("key")
+	assert.Nil(t, err, err)
+	assert.Equal(t, "value", value, "reads are served")
+
+	assert.Nil(t, db.SetReadOnly(false))
+	assert.False(t, db.ReadOnly())
+	assert.Nil(t, db.Put("key", "other"))
+	value, err = db.Get("key")
+	assert.Nil(t, err, err)
+	assert.Equal(t, "other", value)
+}
+
+func TestDb_WithReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1000)
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	assert.Nil(t, db.Put("sealed", "1"))
+	assert.Nil(t, db.Rotate())
+	assert.Nil(t, db.Put("current", "2"))
+	assert.Nil(t, db.Close())
+
+	// The tail of a write cut short by a crash.
+	outPath := filepath.Join(dir, outFileName)
+	f, err := os.OpenFile(outPath, os.O_APPEND|os.O_WRONLY, 0o600)
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	_, err = f.Write([]byte{1, 2, 3})
+	assert.Nil(t, err, err)
+	assert.Nil(t, f.Close())
+	before := dirSizes(t, dir)
+
+	db, err = NewDb(dir, 1000, WithReadOnly())
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	assert.True(t, db.ReadOnly())
+	for key, want := range map[string]string{"sealed": "1", "current": "2"} {
+		value, err := db.Get(key)
+		assert.Nil(t, err, err)
+		assert.Equal(t, want, value)
+	}
+	assert.Equal(t, ErrReadOnly, db.Put("key", "value"))
+	assert.Equal(t, errOpenedReadOnly, db.SetReadOnly(false))
+	assert.Nil(t, db.Sync())
+	assert.Nil(t, db.Close())
+	assert.Equal(t, before, dirSizes(t, dir), "files are left as they are")
+
+	db, err = NewDb(filepath.Join(dir, "missing"), 1000, WithReadOnly())
+	if assert.Nil(t, err, err) {
+		db.Close()
+	}
+	_, err = os.Stat(filepath.Join(dir, "missing"))
+	assert.True(t, os.IsNotExist(err), "no directory is created")
+}
+
+// dirSizes returns the sizes of the files in dir by name.
+func dirSizes(t *testing.T, dir string) map[string]int64 {
+	entries, err := os.ReadDir(dir)
+	assert.Nil(t, err, err)
+	res := make(map[string]int64)
+	for _, entry := range entries {
+		info, err := entry.Info()
+		assert.Nil(t, err, err)
+		res[entry.Name()] = info.Size()
+	}
+	return res
+}
+
+func TestDb_SetReadOnlyWhileWaiting(t *testing.T) {
+	defer func(delay time.Duration) { mergeRetryDelay = delay }(mergeRetryDelay)
+	db, err := NewDb(t.TempDir(), 1000, WithMaxSegments(2))
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer db.Close()
+	stallMerges(t, db)
+
+	res := make(chan error, 1)
+	go func() {
+		res <- db.Rotate()
+	}()
+	select {
+	case err := <-res:
+		t.Fatalf("rotation didn't wait for a merge: %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+	assert.Nil(t, db.SetReadOnly(true))
+	select {
+	case err := <-res:
+		assert.Equal(t, ErrReadOnly, err)
+	case <-time.After(time.Second):
+		t.Fatal("rotation still waits for a merge")
+	}
+}
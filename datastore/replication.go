@@ -0,0 +1,419 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+const (
+	defaultHistorySize  = 10000
+	defaultHistoryBytes = 64 << 20
+	snapshotFilePrefix  = "snapshot-"
+)
+
+// ErrLogTruncated is returned by ReadLog when the requested records are no
+// longer kept in memory. The reader has to start over from a snapshot.
+var ErrLogTruncated = errors.New("log is truncated")
+
+// ErrSeqGap is returned by Apply when a record doesn't follow the last
+// applied one.
+var ErrSeqGap = errors.New("gap in sequence numbers")
+
+// Record is a write together with the sequence number it got in the Db.
+// Deleted is set for deletions, which have no value. Large is set for values
+// put by PutReader that are too large to be passed around; they have no value
+// either and have to be read with GetReader, and applied with ApplyReader.
+type Record struct {
+	Seq     uint64 `json:"seq"`
+	Key     string `json:"key"`
+	Value   string `json:"value"`
+	Deleted bool   `json:"deleted,omitempty"`
+	Large   bool   `json:"large,omitempty"`
+}
+
+// WithHistorySize sets how many of the latest writes are kept for ReadLog.
+func WithHistorySize(n int) Option {
+	return func(db *Db) {
+		if n > 0 {
+			db.historySize = n
+		}
+	}
+}
+
+// WithHistoryBytes sets how many bytes of keys and values the writes kept for
+// ReadLog may take at most.
+func WithHistoryBytes(n int64) Option {
+	return func(db *Db) {
+		if n > 0 {
+			db.historyLimit = n
+		}
+	}
+}
+
+// appendHistory assigns the next sequence number to a written entry. db.mu
+// must be held.
+func (db *Db) appendHistory(e entry) {
+	db.appendRecord(Record{Key: e.key, Value: e.value, Deleted: e.deleted})
+}
+
+// appendLargeHistory assigns the next sequence number to a written value
+// that is too large to keep in memory. The history only names its key, and
+// readers fetch the value themselves. db.mu must be held.
+func (db *Db) appendLargeHistory(key string) {
+	db.appendRecord(Record{Key: key, Large: true})
+}
+
+// appendRecord assigns the next sequence number to r, keeps it in history
+// and wakes up log readers and watchers. db.mu must be held.
+func (db *Db) appendRecord(r Record) {
+	db.seq++
+	r.Seq = db.seq
+	db.history = append(db.history, r)
+	db.historyBytes += recordBytes(r)
+	for len(db.history) > db.historySize || db.historyBytes > db.historyLimit {
+		db.historyBytes -= recordBytes(db.history[0])
+		// Let the dropped value be freed before the array is reallocated.
+		db.history[0] = Record{}
+		db.history = db.history[1:]
+	}
+	db.notifyWatchers(r)
+	close(db.notify)
+	db.notify = make(chan struct{})
+}
+
+// recordBytes is how much of the history limit r takes.
+func recordBytes(r Record) int64 {
+	return int64(len(r.Key) + len(r.Value))
+}
+
+// replicaSeqError checks a replicated record that can't be applied next.
+// Records that were already applied are skipped without an error.
+func (db *Db) replicaSeqError(seq uint64) error {
+	if seq <= db.seq {
+		return nil
+	}
+	return fmt.Errorf("%w: got %d after %d", ErrSeqGap, seq, db.seq)
+}
+
+// Seq returns the sequence number of the last write.
+func (db *Db) Seq() uint64 {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.seq
+}
+
+// ReadLog returns up to max records starting with sequence number from.
+// If there are no such records yet, it waits for the next write.
+func (db *Db) ReadLog(ctx context.Context, from uint64, max int) ([]Record, error) {
+	if from == 0 {
+		from = 1
+	}
+	for {
+		db.mu.Lock()
+		if from <= db.seq {
+			oldest := db.seq - uint64(len(db.history)) + 1
+			if from < oldest {
+				db.mu.Unlock()
+				return nil, ErrLogTruncated
+			}
+			start := int(from - oldest)
+			end := len(db.history)
+			if end-start > max {
+				end = start + max
+			}
+			res := make([]Record, end-start)
+			copy(res, db.history[start:end])
+			db.mu.Unlock()
+			return res, nil
+		}
+		notify := db.notify
+		db.mu.Unlock()
+
+		select {
+		case <-notify:
+		case <-db.done:
+			return nil, ErrClosed
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// Apply writes a record received from another Db. Records must be applied
+// in order; already applied ones are ignored.
+func (db *Db) Apply(ctx context.Context, r Record) error {
+	return db.write(ctx, []entry{{key: r.Key, value: r.Value, deleted: r.Deleted}}, r.Seq)
+}
+
+// Snapshot returns the latest value of every key in the record format of the
+// data files, along with the sequence number of the last write it includes.
+// The snapshot is copied to a temporary file without blocking reads and
+// writes, and merges keep the files it is copied from meanwhile. Encrypted
+// values are decrypted as the snapshot is
+// read, so it can be restored with other keys.
+func (db *Db) Snapshot() (io.ReadCloser, uint64, error) {
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.closed {
+		return nil, 0, ErrClosed
+	}
+
+	f, err := os.CreateTemp(db.dir, snapshotFilePrefix+"*")
+	if err != nil {
+		return nil, 0, err
+	}
+	snapshot := &snapshotFile{file: f, keys: db.keys, in: bufio.NewReader(f)}
+
+	db.mu.Lock()
+	mi := make(mergeIndex)
+	files := make(map[string]*os.File)
+	for _, seg := range db.segments {
+		path := db.segmentPath(seg.gen)
+		for key, offset := range seg.index {
+			mi[key] = mergeItem{path: path, offset: offset}
+		}
+		files[path] = nil
+	}
+	for key, offset := range db.index {
+		mi[key] = mergeItem{path: db.outPath, offset: offset}
+	}
+	if len(db.index) > 0 {
+		// The open file is still read if the current data file is
+		// renamed to a segment during the copy.
+		files[db.outPath] = nil
+	}
+	for path := range files {
+		if files[path], err = os.Open(path); err != nil {
+			break
+		}
+	}
+	seq := db.seq
+	db.snapshots++
+	db.mu.Unlock()
+
+	if err == nil {
+		err = db.countChecksum(copyRecords(mi, files, f, db.keys))
+	}
+	for _, file := range files {
+		if file != nil {
+			file.Close()
+		}
+	}
+	db.mu.Lock()
+	db.snapshots--
+	db.removeStaleFiles()
+	db.mu.Unlock()
+
+	if err == nil {
+		_, err = f.Seek(0, io.SeekStart)
+	}
+	if err != nil {
+		snapshot.Close()
+		return nil, 0, err
+	}
+	return snapshot, seq, nil
+}
+
+// snapshotFile reads the records of a snapshot, decrypting them if keys is
+// set.
+type snapshotFile struct {
+	file *os.File
+	keys *Keyring
+	in   *bufio.Reader
+	// buf is the rest of the last decrypted record.
+	buf []byte
+}
+
+func (f *snapshotFile) Read(p []byte) (int, error) {
+	if f.keys == nil {
+		return f.file.Read(p)
+	}
+	for len(f.buf) == 0 {
+		record, err := readRecord(f.in)
+		if err != nil {
+			return 0, err
+		}
+		e, err := decodeRecord(record, f.keys)
+		if err != nil {
+			return 0, err
+		}
+		f.buf = e.Encode()
+	}
+	n := copy(p, f.buf)
+	f.buf = f.buf[n:]
+	return n, nil
+}
+
+func (f *snapshotFile) Close() error {
+	err := f.file.Close()
+	os.Remove(f.file.Name())
+	return err
+}
+
+// removeSegmentFile removes the file of a segment that is no longer used, or
+// leaves it to the last snapshot being copied. db.mu must be held.
+func (db *Db) removeSegmentFile(gen uint64) {
+	path := db.segmentPath(gen)
+	if db.snapshots > 0 {
+		db.staleFiles = append(db.staleFiles, path)
+		return
+	}
+	os.Remove(path)
+}
+
+// removeStaleFiles removes the segment files kept for snapshots once none
+// is being copied. db.mu must be held.
+func (db *Db) removeStaleFiles() {
+	if db.snapshots > 0 {
+		return
+	}
+	for _, path := range db.staleFiles {
+		os.Remove(path)
+	}
+	db.staleFiles = nil
+}
+
+// copyRecords writes the records found by mi to out, reading them from the
+// files opened at their paths and checking them with keys. Tombstones are
+// left out.
+func copyRecords(mi mergeIndex, files map[string]*os.File, out io.Writer, keys *Keyring) error {
+	w := bufio.NewWriter(out)
+	for _, item := range mi {
+		record, err := readRecord(bufio.NewReader(io.NewSectionReader(files[item.path], item.offset, 1<<62)))
+		if err != nil {
+			return err
+		}
+		e, err := decodeRecord(record, keys)
+		if err != nil {
+			return err
+		}
+		if e.deleted {
+			continue
+		}
+		if e.more {
+			// Batches don't survive the copy, so none must look
+			// unfinished.
+			e.more = false
+			if record, err = encodeRecord(e, keys); err != nil {
+				return err
+			}
+		}
+		if _, err := w.Write(record); err != nil {
+			return err
+		}
+	}
+	return w.Flush()
+}
+
+// Restore replaces the contents of the Db with a snapshot taken by Snapshot
+// at sequence number seq.
+func (db *Db) Restore(r io.Reader, seq uint64) error {
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.closed {
+		return ErrClosed
+	}
+
+	db.mu.Lock()
+	if db.readOnly {
+		db.mu.Unlock()
+		return ErrReadOnly
+	}
+	restored := &segment{gen: db.nextGen}
+	db.nextGen++
+	db.mu.Unlock()
+
+	segPath := db.segmentPath(restored.gen)
+	index, size, err := writeSnapshot(r, segPath, db.keys)
+	if err != nil {
+		os.Remove(segPath)
+		return err
+	}
+	restored.index, restored.size = index, size
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.readOnly {
+		os.Remove(segPath)
+		return ErrReadOnly
+	}
+	// Seal the current data file first, so that switching the manifest to
+	// the restored segment is the only step that changes the contents.
+	if db.outOffset > 0 {
+		if err := db.rotate(); err != nil {
+			os.Remove(segPath)
+			return err
+		}
+	}
+	old := db.segments
+	db.segments = []*segment{restored}
+	// The segments the merger gave up on are gone.
+	db.mergeErr = nil
+	db.seq, db.sealedSeq = seq, seq
+	if err := db.writeManifest(); err != nil {
+		os.Remove(segPath)
+		return err
+	}
+	for _, seg := range old {
+		db.removeSegmentFile(seg.gen)
+	}
+	if db.cache != nil {
+		db.cache = newValueCache(db.cache.capacity)
+	}
+	if err := db.recoverUsage(); err != nil {
+		return err
+	}
+	db.history = nil
+	db.historyBytes = 0
+	// Watchers can't be told what the snapshot changed.
+	db.closeWatchers(ErrLogTruncated)
+	close(db.notify)
+	db.notify = make(chan struct{})
+	db.segCond.Broadcast()
+	return nil
+}
+
+// writeSnapshot writes the records of a snapshot to a new segment at segPath,
+// encrypting their values with keys, if any. It returns the index and the
+// size of the segment.
+func writeSnapshot(r io.Reader, segPath string, keys *Keyring) (hashIndex, int64, error) {
+	f, err := os.OpenFile(segPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o600)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer f.Close()
+
+	index := make(hashIndex)
+	in := bufio.NewReader(r)
+	w := bufio.NewWriter(f)
+	var offset int64
+	for {
+		record, err := readRecord(in)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		e, err := decodeRecord(record, keys)
+		if err != nil {
+			return nil, 0, err
+		}
+		if record, err = encodeRecord(e, keys); err != nil {
+			return nil, 0, err
+		}
+		if _, err := w.Write(record); err != nil {
+			return nil, 0, err
+		}
+		index[e.key] = offset
+		offset += int64(len(record))
+	}
+	if err := w.Flush(); err != nil {
+		return nil, 0, err
+	}
+	return index, offset, f.Sync()
+}
@@ -0,0 +1,170 @@
+package datastore
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDb_ReadLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1000, WithHistorySize(3))
+	assert.Nil(t, err, err)
+	defer db.Close()
+
+	ctx := context.Background()
+	for i := 1; i <= 4; i++ {
+		assert.Nil(t, db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)))
+	}
+	assert.Equal(t, uint64(4), db.Seq())
+
+	t.Run("read retained records", func(t *testing.T) {
+		records, err := db.ReadLog(ctx, 3, 10)
+		assert.Nil(t, err, err)
+		assert.Equal(t, []Record{{Seq: 3, Key: "key3", Value: "value3"}, {Seq: 4, Key: "key4", Value: "value4"}}, records)
+	})
+
+	t.Run("truncated", func(t *testing.T) {
+		_, err := db.ReadLog(ctx, 1, 10)
+		assert.Equal(t, ErrLogTruncated, err)
+	})
+
+	t.Run("history bytes", func(t *testing.T) {
+		db, err := NewDb(t.TempDir(), 1000, WithHistoryBytes(25))
+		if !assert.Nil(t, err, err) {
+			return
+		}
+		defer db.Close()
+		for i := 1; i <= 3; i++ {
+			assert.Nil(t, db.Put(fmt.Sprintf("key%d", i), fmt.Sprintf("value%d", i)))
+		}
+		records, err := db.ReadLog(ctx, 2, 10)
+		assert.Nil(t, err, err)
+		assert.Equal(t, []Record{{Seq: 2, Key: "key2", Value: "value2"}, {Seq: 3, Key: "key3", Value: "value3"}}, records)
+		_, err = db.ReadLog(ctx, 1, 10)
+		assert.Equal(t, ErrLogTruncated, err)
+	})
+
+	t.Run("wait for writes", func(t *testing.T) {
+		go func() {
+			time.Sleep(10 * time.Millisecond)
+			db.Put("key5", "value5")
+		}()
+		records, err := db.ReadLog(ctx, 5, 10)
+		assert.Nil(t, err, err)
+		assert.Equal(t, []Record{{Seq: 5, Key: "key5", Value: "value5"}}, records)
+
+		ctx, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+		_, err = db.ReadLog(ctx, 6, 10)
+		assert.Equal(t, context.DeadlineExceeded, err)
+	})
+
+	t.Run("sequence survives restart", func(t *testing.T) {
+		assert.Nil(t, db.Close())
+		db, err = NewDb(dir, 1000)
+		assert.Nil(t, err, err)
+		assert.Equal(t, uint64(5), db.Seq())
+	})
+}
+
+func TestDb_Replicate(t *testing.T) {
+	primaryDir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(primaryDir)
+	replicaDir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(replicaDir)
+
+	primary, err := NewDb(primaryDir, 80)
+	assert.Nil(t, err, err)
+	defer primary.Close()
+	replica, err := NewDb(replicaDir, 80)
+	assert.Nil(t, err, err)
+	defer replica.Close()
+
+	long := "Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor.Lorem, ipsum dolor."
+	ctx := context.Background()
+	assert.Nil(t, primary.Put("a", "a1"))
+	assert.Nil(t, primary.Put("b", long))
+	assert.Nil(t, primary.Put("a", "a2"))
+	assert.Nil(t, replica.Put("stale", "value"))
+
+	t.Run("restore snapshot", func(t *testing.T) {
+		snapshot, seq, err := primary.Snapshot()
+		assert.Nil(t, err, err)
+		assert.Equal(t, uint64(3), seq)
+		assert.Nil(t, replica.Restore(snapshot, seq))
+		assert.Nil(t, snapshot.Close())
+
+		assert.Equal(t, uint64(3), replica.Seq())
+		assertValue(t, replica, "a", "a2")
+		assertValue(t, replica, "b", long)
+		_, err = replica.Get("stale")
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("apply records", func(t *testing.T) {
+		assert.Nil(t, primary.Put("c", "c1"))
+		records, err := primary.ReadLog(ctx, replica.Seq()+1, 10)
+		assert.Nil(t, err, err)
+		for _, r := range records {
+			assert.Nil(t, replica.Apply(ctx, r))
+		}
+		// applying the same records again is a no-op
+		assert.Nil(t, replica.Apply(ctx, records[0]))
+		assert.ErrorIs(t, replica.Apply(ctx, Record{Seq: 10, Key: "x"}), ErrSeqGap)
+		assertValue(t, replica, "c", "c1")
+		assert.Equal(t, primary.Seq(), replica.Seq())
+	})
+
+	t.Run("restored data survives restart", func(t *testing.T) {
+		assert.Nil(t, replica.Close())
+		replica, err = NewDb(replicaDir, 80)
+		assert.Nil(t, err, err)
+		assert.Equal(t, uint64(4), replica.Seq())
+		assertValue(t, replica, "a", "a2")
+		assertValue(t, replica, "c", "c1")
+	})
+}
+
+func TestDb_SnapshotKeepsSegments(t *testing.T) {
+	dir := t.TempDir()
+	db, err := NewDb(dir, 1000)
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer db.Close()
+
+	assert.Nil(t, db.Put("a", "a1"))
+	assert.Nil(t, db.Rotate())
+	// A snapshot is being copied from the first segment.
+	db.mu.Lock()
+	db.snapshots++
+	db.mu.Unlock()
+	oldest := db.segmentPath(db.Stats().Segments[0].Gen)
+
+	assert.Nil(t, db.Put("a", "a2"))
+	assert.Nil(t, db.Rotate())
+	assert.Eventually(t, func() bool {
+		return db.Stats().Merges == 1
+	}, time.Second, 10*time.Millisecond)
+	_, err = os.Stat(oldest)
+	assert.Nil(t, err, "merged segments are kept for the snapshot")
+
+	db.mu.Lock()
+	db.snapshots--
+	db.removeStaleFiles()
+	db.mu.Unlock()
+	_, err = os.Stat(oldest)
+	assert.True(t, os.IsNotExist(err))
+	assertValue(t, db, "a", "a2")
+}
@@ -0,0 +1,61 @@
+package datastore
+
+import (
+	"sort"
+	"strings"
+)
+
+// KeyValue is a key with its value as returned by Scan.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// Scan returns up to limit keys starting with prefix that sort after the key
+// after, in order, together with their values. Passing the last returned key
+// as after continues the scan.
+func (db *Db) Scan(prefix, after string, limit int) ([]KeyValue, error) {
+	db.closeMu.RLock()
+	if db.closed {
+		db.closeMu.RUnlock()
+		return nil, ErrClosed
+	}
+	db.mu.Lock()
+	candidates := make(map[string]struct{})
+	addKeys := func(index hashIndex) {
+		for key := range index {
+			if key > after && strings.HasPrefix(key, prefix) {
+				candidates[key] = struct{}{}
+			}
+		}
+	}
+	for _, seg := range db.segments {
+		addKeys(seg.index)
+	}
+	addKeys(db.index)
+	db.mu.Unlock()
+	db.closeMu.RUnlock()
+
+	keys := make([]string, 0, len(candidates))
+	for key := range candidates {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	var res []KeyValue
+	for _, key := range keys {
+		if len(res) == limit {
+			break
+		}
+		// The key may have been deleted since the indexes were read.
+		value, err := db.Get(key)
+		if err == ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, KeyValue{Key: key, Value: value})
+	}
+	return res, nil
+}
@@ -0,0 +1,37 @@
+package datastore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDb_Scan(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 60)
+	assert.Nil(t, err, err)
+	defer db.Close()
+
+	for _, key := range []string{"team-c", "team-a", "other", "team-b", "team-d"} {
+		assert.Nil(t, db.Put(key, key+"-value"))
+	}
+	assert.Nil(t, db.Put("team-a", "new"))
+	assert.Nil(t, db.Delete("team-c"))
+
+	res, err := db.Scan("team-", "", 2)
+	assert.Nil(t, err, err)
+	assert.Equal(t, []KeyValue{{"team-a", "new"}, {"team-b", "team-b-value"}}, res)
+
+	res, err = db.Scan("team-", res[len(res)-1].Key, 2)
+	assert.Nil(t, err, err)
+	assert.Equal(t, []KeyValue{{"team-d", "team-d-value"}}, res)
+
+	res, err = db.Scan("", "team-d", 10)
+	assert.Nil(t, err, err)
+	assert.Empty(t, res)
+}
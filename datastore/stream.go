@@ -0,0 +1,269 @@
+package datastore
+
+import (
+	"bufio"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"hash"
+	"io"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	defaultMaxValueSize = 64 << 20
+	spoolFilePrefix     = "spool-"
+	// maxHistoryValueSize is the largest streamed value that is still kept
+	// in the replication history.
+	maxHistoryValueSize = 64 << 10
+)
+
+// MaxValueSizeLimit is the largest value a record can hold, encrypted or
+// not.
+const MaxValueSizeLimit = valueLenMask - encryptionOverhead
+
+// ErrValueTooLarge is returned for values over the size limit of a Db.
+var ErrValueTooLarge = errors.New("value is too large")
+
+// WithMaxValueSize sets the size limit of a value in bytes. Values over
+// MaxValueSizeLimit are ignored.
+func WithMaxValueSize(n int64) Option {
+	return func(db *Db) {
+		if n > 0 && n <= MaxValueSizeLimit {
+			db.maxValueSize = n
+		}
+	}
+}
+
+// MaxValueSize returns the size limit of a value in bytes.
+func (db *Db) MaxValueSize() int64 {
+	return db.maxValueSize
+}
+
+// spooledValue is a value copied to a temporary file before it is written
+// to the log, so the writer never waits on a slow client.
+type spooledValue struct {
+	file *os.File
+	size int64
+	hash []byte
+}
+
+// PutReader stores the value read from r until EOF without holding it in
+// memory. It returns ErrValueTooLarge if the value exceeds the limit.
+func (db *Db) PutReader(ctx context.Context, key string, r io.Reader) error {
+	return db.putReader(ctx, key, r, 0)
+}
+
+// ApplyReader writes a Large record received from another Db, with its value
+// read from value until EOF. Like Apply, records must be applied in order.
+func (db *Db) ApplyReader(ctx context.Context, r Record, value io.Reader) error {
+	return db.putReader(ctx, r.Key, value, r.Seq)
+}
+
+// putReader spools the value read from r and writes it under key, with the
+// sequence number seq of a replicated record or zero for local writes.
+func (db *Db) putReader(ctx context.Context, key string, r io.Reader, seq uint64) error {
+	if err := db.checkKey(key); err != nil {
+		return err
+	}
+	if db.ReadOnly() {
+		// Don't spool a value that can't be written.
+		return ErrReadOnly
+	}
+	if db.keys != nil {
+		// The value is encrypted in one piece, and a spool file would keep
+		// it on disk in plain text.
+		value, err := io.ReadAll(io.LimitReader(r, db.maxValueSize+1))
+		if err != nil {
+			return err
+		}
+		return db.write(ctx, []entry{{key: key, value: string(value)}}, seq)
+	}
+	f, err := os.CreateTemp(db.dir, spoolFilePrefix)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		f.Close()
+		os.Remove(f.Name())
+	}()
+
+	hasher := sha256.New()
+	hasher.Write([]byte(key))
+	size, err := io.Copy(io.MultiWriter(f, hasher), io.LimitReader(r, db.maxValueSize+1))
+	if err != nil {
+		return err
+	}
+	if size > db.maxValueSize {
+		return ErrValueTooLarge
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	spooled := &spooledValue{file: f, size: size, hash: sumField(hasher, uint32(size))}
+	return db.send(ctx, putMessage{entries: []entry{{key: key}}, spooled: spooled, seq: seq})
+}
+
+// writeSpooled appends a record with a spooled value to the current data
+// file. db.mu must be held.
+func (db *Db) writeSpooled(key string, v *spooledValue) error {
+	kl, hl := len(key), len(v.hash)
+	size := int64(kl+hl+16) + v.size
+	out := bufio.NewWriter(db.out)
+	var field [4]byte
+	writeField := func(n int64) {
+		binary.LittleEndian.PutUint32(field[:], uint32(n))
+		out.Write(field[:])
+	}
+	writeField(size)
+	writeField(int64(kl))
+	out.WriteString(key)
+	writeField(v.size)
+	if _, err := io.CopyN(out, v.file, v.size); err != nil {
+		db.out.Truncate(db.outOffset)
+		return err
+	}
+	writeField(int64(hl))
+	out.Write(v.hash)
+	if err := out.Flush(); err != nil {
+		// Don't leave a partial write for the next one to follow.
+		db.out.Truncate(db.outOffset)
+		return err
+	}
+
+	db.index[key] = db.outOffset
+	db.account(key, int64(kl)+v.size, false)
+	db.cache.remove(key)
+	db.outOffset += size
+	if v.size > maxHistoryValueSize {
+		db.appendLargeHistory(key)
+		return nil
+	}
+	value := make([]byte, v.size)
+	if _, err := v.file.ReadAt(value, 0); err != nil {
+		return err
+	}
+	db.appendHistory(entry{key: key, value: string(value)})
+	return nil
+}
+
+// GetReader returns a reader of the value of key along with its size. The
+// value is checked against its hash sum once it has been read to the end.
+// The reader must be closed.
+func (db *Db) GetReader(key string) (io.ReadCloser, int64, error) {
+	defer db.getLatency.since(time.Now())
+	db.closeMu.RLock()
+	defer db.closeMu.RUnlock()
+	if db.closed {
+		return nil, 0, ErrClosed
+	}
+	db.mu.Lock()
+	path, position, ok := db.locate(key)
+	if !ok {
+		db.mu.Unlock()
+		return nil, 0, ErrNotFound
+	}
+	// An open file keeps its data even if the merger removes the segment.
+	file, err := os.Open(path)
+	db.mu.Unlock()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	r, size, err := db.openValue(file, position)
+	if err != nil {
+		file.Close()
+		return nil, 0, err
+	}
+	return r, size, nil
+}
+
+func (db *Db) openValue(file *os.File, position int64) (io.ReadCloser, int64, error) {
+	var header [8]byte
+	if _, err := file.ReadAt(header[:], position); err != nil {
+		return nil, 0, err
+	}
+	kl := int64(binary.LittleEndian.Uint32(header[4:]))
+	key := make([]byte, kl+4)
+	if _, err := file.ReadAt(key, position+8); err != nil {
+		return nil, 0, err
+	}
+	vlField := binary.LittleEndian.Uint32(key[kl:])
+	if vlField&flagTombstone != 0 {
+		return nil, 0, ErrNotFound
+	}
+	if vlField&flagEncrypted != 0 {
+		record, err := readRecord(bufio.NewReader(io.NewSectionReader(file, position, 1<<62)))
+		if err != nil {
+			return nil, 0, err
+		}
+		e, err := decodeRecord(record, db.keys)
+		if err != nil {
+			return nil, 0, db.countChecksum(err)
+		}
+		file.Close()
+		return io.NopCloser(strings.NewReader(e.value)), int64(len(e.value)), nil
+	}
+	vl := int64(vlField & valueLenMask)
+	valuePos := position + 12 + kl
+
+	var hl [4]byte
+	if _, err := file.ReadAt(hl[:], valuePos+vl); err != nil {
+		return nil, 0, err
+	}
+	sum := make([]byte, binary.LittleEndian.Uint32(hl[:]))
+	if _, err := file.ReadAt(sum, valuePos+vl+4); err != nil {
+		return nil, 0, err
+	}
+
+	hasher := sha256.New()
+	hasher.Write(key[:kl])
+	return &valueReader{
+		db:      db,
+		file:    file,
+		r:       io.NewSectionReader(file, valuePos, vl),
+		hasher:  hasher,
+		vlField: vlField,
+		sum:     sum,
+	}, vl, nil
+}
+
+// valueReader reads a value straight from a data file.
+type valueReader struct {
+	db     *Db
+	file   *os.File
+	r      io.Reader
+	hasher hash.Hash
+	// vlField is the value length field, which the sum covers after the
+	// value.
+	vlField uint32
+	sum     []byte
+	// checked is set once the value is read to the end, and sumErr tells
+	// whether it didn't match the sum.
+	checked bool
+	sumErr  error
+}
+
+func (v *valueReader) Read(p []byte) (int, error) {
+	n, err := v.r.Read(p)
+	v.hasher.Write(p[:n])
+	if err == io.EOF {
+		if !v.checked {
+			v.checked = true
+			if !matchSum(v.hasher, v.vlField, v.sum) {
+				v.sumErr = v.db.countChecksum(errWrongHash)
+			}
+		}
+		if v.sumErr != nil {
+			return n, v.sumErr
+		}
+	}
+	return n, err
+}
+
+func (v *valueReader) Close() error {
+	return v.file.Close()
+}
@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDb_Stream(t *testing.T) {
+	dir, err := ioutil.TempDir("", "test-db")
+	assert.Nil(t, err, err)
+	defer os.RemoveAll(dir)
+
+	db, err := NewDb(dir, 1<<20, WithMaxValueSize(1<<18))
+	assert.Nil(t, err, err)
+	defer db.Close()
+	ctx := context.Background()
+
+	t.Run("small value", func(t *testing.T) {
+		assert.Nil(t, db.PutReader(ctx, "small", strings.NewReader("value")))
+		assertValue(t, db, "small", "value")
+		records, err := db.ReadLog(ctx, 1, 10)
+		assert.Nil(t, err, err)
+		assert.Equal(t, []Record{{Seq: 1, Key: "small", Value: "value"}}, records)
+	})
+
+	t.Run("large value", func(t *testing.T) {
+		value := bytes.Repeat([]byte("0123456789abcdef"), 1<<14)
+		assert.Nil(t, db.PutReader(ctx, "large", bytes.NewReader(value)))
+		r, size, err := db.GetReader("large")
+		if !assert.Nil(t, err, err) {
+			return
+		}
+		defer r.Close()
+		assert.Equal(t, int64(len(value)), size)
+		read, err := io.ReadAll(r)
+		assert.Nil(t, err, err)
+		assert.Equal(t, value, read)
+
+		records, err := db.ReadLog(ctx, 1, 10)
+		assert.Nil(t, err, err, "the log is kept")
+		assert.Equal(t, []Record{{Seq: 1, Key: "small", Value: "value"}, {Seq: 2, Key: "large", Large: true}}, records)
+
+		replica, err := NewDb(t.TempDir(), 1<<20, WithMaxValueSize(1<<18))
+		if !assert.Nil(t, err, err) {
+			return
+		}
+		defer replica.Close()
+		assert.Nil(t, replica.Apply(ctx, records[0]))
+		assert.Nil(t, replica.ApplyReader(ctx, records[1], bytes.NewReader(value)))
+		assert.Equal(t, uint64(2), replica.Seq())
+		records, err = replica.ReadLog(ctx, 2, 10)
+		assert.Nil(t, err, err)
+		assert.Equal(t, []Record{{Seq: 2, Key: "large", Large: true}}, records)
+		assert.Nil(t, replica.ApplyReader(ctx, records[0], strings.NewReader("old")), "applied records are skipped")
+		r, _, err = replica.GetReader("large")
+		if assert.Nil(t, err, err) {
+			read, err = io.ReadAll(r)
+			r.Close()
+			assert.Nil(t, err, err)
+			assert.Equal(t, value, read)
+		}
+	})
+
+	t.Run("too large", func(t *testing.T) {
+		value := bytes.Repeat([]byte("x"), 1<<18+1)
+		assert.Equal(t, ErrValueTooLarge, db.PutReader(ctx, "huge", bytes.NewReader(value)))
+		assert.Equal(t, ErrValueTooLarge, db.Put("huge", string(value)))
+		_, _, err := db.GetReader("huge")
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	t.Run("deleted", func(t *testing.T) {
+		assert.Nil(t, db.Delete("small"))
+		_, _, err := db.GetReader("small")
+		assert.Equal(t, ErrNotFound, err)
+	})
+
+	files, err := os.ReadDir(dir)
+	assert.Nil(t, err, err)
+	for _, f := range files {
+		assert.False(t, strings.HasPrefix(f.Name(), spoolFilePrefix), f.Name())
+	}
+}
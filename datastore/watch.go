@@ -0,0 +1,138 @@
+package datastore
+
+import (
+	"errors"
+	"strings"
+)
+
+const watcherBufferSize = 16
+
+// ErrWatcherLagged ends a watch whose receiver didn't keep up with writes.
+var ErrWatcherLagged = errors.New("watcher fell behind")
+
+// Watcher receives the writes to a single key or to all keys with a prefix
+// as they are made. C is closed when the watch ends and Err tells why.
+type Watcher struct {
+	C <-chan Record
+
+	ch     chan Record
+	db     *Db
+	key    string
+	prefix bool
+	err    error
+}
+
+// watchers holds the active watches of a Db. It is guarded by db.mu.
+type watchers struct {
+	keys     map[string]map[*Watcher]struct{}
+	prefixes map[*Watcher]struct{}
+}
+
+// Watch notifies about the writes to key made after the call.
+func (db *Db) Watch(key string) *Watcher {
+	return db.addWatcher(key, false)
+}
+
+// WatchPrefix notifies about the writes to the keys starting with prefix
+// made after the call.
+func (db *Db) WatchPrefix(prefix string) *Watcher {
+	return db.addWatcher(prefix, true)
+}
+
+func (db *Db) addWatcher(key string, prefix bool) *Watcher {
+	ch := make(chan Record, watcherBufferSize)
+	w := &Watcher{C: ch, ch: ch, db: db, key: key, prefix: prefix}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.closing {
+		w.err = ErrClosed
+		close(ch)
+		return w
+	}
+	if prefix {
+		if db.watchers.prefixes == nil {
+			db.watchers.prefixes = make(map[*Watcher]struct{})
+		}
+		db.watchers.prefixes[w] = struct{}{}
+		return w
+	}
+	if db.watchers.keys == nil {
+		db.watchers.keys = make(map[string]map[*Watcher]struct{})
+	}
+	set := db.watchers.keys[key]
+	if set == nil {
+		set = make(map[*Watcher]struct{})
+		db.watchers.keys[key] = set
+	}
+	set[w] = struct{}{}
+	return w
+}
+
+// Close ends the watch.
+func (w *Watcher) Close() {
+	w.db.mu.Lock()
+	defer w.db.mu.Unlock()
+	w.db.removeWatcher(w, nil)
+}
+
+// Err returns the reason the watch ended, or nil while it is active.
+func (w *Watcher) Err() error {
+	w.db.mu.Lock()
+	defer w.db.mu.Unlock()
+	return w.err
+}
+
+// removeWatcher unregisters w and closes its channel. db.mu must be held.
+func (db *Db) removeWatcher(w *Watcher, err error) {
+	if w.prefix {
+		if _, ok := db.watchers.prefixes[w]; !ok {
+			return
+		}
+		delete(db.watchers.prefixes, w)
+	} else {
+		set := db.watchers.keys[w.key]
+		if _, ok := set[w]; !ok {
+			return
+		}
+		delete(set, w)
+		if len(set) == 0 {
+			delete(db.watchers.keys, w.key)
+		}
+	}
+	w.err = err
+	close(w.ch)
+}
+
+// notifyWatchers hands a write to the watchers interested in it. A watcher
+// whose buffer is full is dropped. db.mu must be held.
+func (db *Db) notifyWatchers(r Record) {
+	for w := range db.watchers.keys[r.Key] {
+		db.sendToWatcher(w, r)
+	}
+	for w := range db.watchers.prefixes {
+		if strings.HasPrefix(r.Key, w.key) {
+			db.sendToWatcher(w, r)
+		}
+	}
+}
+
+func (db *Db) sendToWatcher(w *Watcher, r Record) {
+	select {
+	case w.ch <- r:
+	default:
+		db.removeWatcher(w, ErrWatcherLagged)
+	}
+}
+
+// closeWatchers ends all watches with err. db.mu must be held.
+func (db *Db) closeWatchers(err error) {
+	for _, set := range db.watchers.keys {
+		for w := range set {
+			db.removeWatcher(w, err)
+		}
+	}
+	for w := range db.watchers.prefixes {
+		db.removeWatcher(w, err)
+	}
+}
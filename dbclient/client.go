@@ -0,0 +1,293 @@
+// Package dbclient is a client of the HTTP API of the database.
+package dbclient
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultRetries    = 3
+	defaultBackoff    = 100 * time.Millisecond
+	maxBackoff        = 2 * time.Second
+	defaultTimeout    = 10 * time.Second
+	maxIdleConns      = 64
+	maxErrorBodyBytes = 64 * 1024
+)
+
+// ErrNotFound is returned for keys that have no value.
+var ErrNotFound = errors.New("record does not exist")
+
+// Error is a request the database failed. Code is one of the error codes of
+// the API, like "timeout" or "value_too_large", if the response had one.
+type Error struct {
+	StatusCode int
+	Code       string
+	Message    string
+}
+
+func (e *Error) Error() string {
+	if e.Code == "" {
+		return fmt.Sprintf("db: status %d: %s", e.StatusCode, e.Message)
+	}
+	return fmt.Sprintf("db: status %d, %s: %s", e.StatusCode, e.Code, e.Message)
+}
+
+// KeyValue is a key with its value.
+type KeyValue struct {
+	Key   string `json:"key"`
+	Value string `json:"value"`
+}
+
+// ScanPage is a page of scanned keys. Next is the after argument for the
+// next page, empty on the last one.
+type ScanPage struct {
+	Items []KeyValue `json:"items"`
+	Next  string     `json:"next,omitempty"`
+}
+
+// Client is safe for concurrent use. Its connections are pooled.
+type Client struct {
+	base       string
+	httpClient *http.Client
+	retries    int
+	backoff    time.Duration
+	token      string
+	tlsConfig  *tls.Config
+}
+
+// Option configures optional Client behaviour.
+type Option func(*Client)
+
+// WithHTTPClient makes the client send requests with c.
+func WithHTTPClient(c *http.Client) Option {
+	return func(client *Client) {
+		client.httpClient = c
+	}
+}
+
+// WithRetries sets how many times a request is repeated after a network
+// error or a response telling to retry. Negative values are ignored.
+func WithRetries(n int) Option {
+	return func(c *Client) {
+		if n >= 0 {
+			c.retries = n
+		}
+	}
+}
+
+// WithBackoff sets the delay before the first retry. The delay doubles for
+// every next one.
+func WithBackoff(d time.Duration) Option {
+	return func(c *Client) {
+		if d > 0 {
+			c.backoff = d
+		}
+	}
+}
+
+// WithTLS makes the client connect to https URLs with config, like a CA
+// pool of the database or a client certificate. It has no effect with
+// WithHTTPClient, whose transport is used as is.
+func WithTLS(config *tls.Config) Option {
+	return func(c *Client) {
+		c.tlsConfig = config
+	}
+}
+
+// WithToken makes the client authenticate with an API token of the database.
+func WithToken(token string) Option {
+	return func(c *Client) {
+		c.token = token
+	}
+}
+
+// New returns a client of the database at baseURL, like
+// http://database:9000.
+func New(baseURL string, opts ...Option) *Client {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.MaxIdleConns = maxIdleConns
+	transport.MaxIdleConnsPerHost = maxIdleConns
+	c := &Client{
+		base:       baseURL,
+		httpClient: &http.Client{Transport: transport, Timeout: defaultTimeout},
+		retries:    defaultRetries,
+		backoff:    defaultBackoff,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.tlsConfig != nil {
+		transport.TLSClientConfig = c.tlsConfig
+	}
+	return c
+}
+
+func (c *Client) keyURL(key string) string {
+	return c.base + "/db/" + url.PathEscape(key)
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	var res KeyValue
+	if err := c.do(ctx, "GET", c.keyURL(key), nil, &res); err != nil {
+		return "", err
+	}
+	return res.Value, nil
+}
+
+// Put sets the value of key.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	body, err := json.Marshal(struct {
+		Value string `json:"value"`
+	}{value})
+	if err != nil {
+		return err
+	}
+	return c.do(ctx, "POST", c.keyURL(key), body, nil)
+}
+
+// Delete removes key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.do(ctx, "DELETE", c.keyURL(key), nil, nil)
+}
+
+// Scan returns up to limit keys with prefix that sort after the given key,
+// in order. Zero limit leaves it to the database.
+func (c *Client) Scan(ctx context.Context, prefix, after string, limit int) (ScanPage, error) {
+	query := url.Values{}
+	if prefix != "" {
+		query.Set("prefix", prefix)
+	}
+	if after != "" {
+		query.Set("after", after)
+	}
+	if limit > 0 {
+		query.Set("limit", strconv.Itoa(limit))
+	}
+	u := c.base + "/db/_scan"
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	var page ScanPage
+	err := c.do(ctx, "GET", u, nil, &page)
+	return page, err
+}
+
+// do sends a request, retrying it if it may succeed later, and decodes the
+// JSON response into res unless it is nil. All the requests of the API are
+// idempotent, so retrying them is safe.
+func (c *Client) do(ctx context.Context, method, u string, body []byte, res interface{}) error {
+	backoff := c.backoff
+	for attempt := 0; ; attempt++ {
+		wait, err := c.try(ctx, method, u, body, res)
+		if wait < 0 || attempt == c.retries {
+			return err
+		}
+		if wait == 0 {
+			// Jitter keeps the clients that failed at once from retrying
+			// in lockstep.
+			wait = time.Duration(rand.Int63n(int64(backoff))) + backoff/2
+			backoff *= 2
+			if backoff > maxBackoff {
+				backoff = maxBackoff
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		case <-timer.C:
+		}
+	}
+}
+
+// try sends a request once. A non-negative wait means the request should be
+// retried: after that delay if it is positive, or after the backoff.
+func (c *Client) try(ctx context.Context, method, u string, body []byte, res interface{}) (time.Duration, error) {
+	var reader io.Reader
+	if body != nil {
+		reader = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, reader)
+	if err != nil {
+		return -1, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, ctx.Err()
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 300 {
+		if res == nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			return -1, nil
+		}
+		if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+			return -1, fmt.Errorf("db: bad response: %w", err)
+		}
+		return -1, nil
+	}
+
+	apiErr := readError(resp)
+	switch resp.StatusCode {
+	case http.StatusNotFound:
+		if apiErr.Code == "" || apiErr.Code == "not_found" {
+			return -1, ErrNotFound
+		}
+		return -1, apiErr
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return retryAfter(resp), apiErr
+	}
+	return -1, apiErr
+}
+
+func readError(resp *http.Response) *Error {
+	apiErr := &Error{StatusCode: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
+	var body struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(data, &body) == nil && body.Code != "" {
+		apiErr.Code, apiErr.Message = body.Code, body.Message
+	} else {
+		apiErr.Message = string(bytes.TrimSpace(data))
+	}
+	return apiErr
+}
+
+// retryAfter reads the Retry-After header in seconds. It returns zero if
+// there's none, leaving the delay to the backoff.
+func retryAfter(resp *http.Response) time.Duration {
+	seconds, err := strconv.Atoi(resp.Header.Get("Retry-After"))
+	if err != nil || seconds <= 0 {
+		return 0
+	}
+	d := time.Duration(seconds) * time.Second
+	if d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
@@ -0,0 +1,80 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestClient(t *testing.T) {
+	var failures int32 = 2
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.EscapedPath() {
+		case "/db/flaky":
+			if atomic.AddInt32(&failures, -1) >= 0 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_ = json.NewEncoder(w).Encode(KeyValue{"flaky", "ok"})
+		case "/db/a%2Fb%20c":
+			assert.Equal(t, "POST", r.Method)
+			var body struct{ Value string }
+			assert.Nil(t, json.NewDecoder(r.Body).Decode(&body))
+			assert.Equal(t, "v", body.Value)
+			w.WriteHeader(http.StatusAccepted)
+		case "/db/missing":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(`{"code": "not_found", "message": "record does not exist"}`))
+		case "/db/big":
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusRequestEntityTooLarge)
+			w.Write([]byte(`{"code": "value_too_large", "message": "value is too large"}`))
+		case "/db/_scan":
+			assert.Equal(t, "p", r.URL.Query().Get("prefix"))
+			assert.Equal(t, "2", r.URL.Query().Get("limit"))
+			_ = json.NewEncoder(w).Encode(ScanPage{Items: []KeyValue{{"p1", "1"}, {"p2", "2"}}, Next: "p2"})
+		default:
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	c := New(srv.URL, WithBackoff(time.Millisecond))
+	ctx := context.Background()
+
+	value, err := c.Get(ctx, "flaky")
+	assert.Nil(t, err, err)
+	assert.Equal(t, "ok", value)
+
+	assert.Nil(t, c.Put(ctx, "a/b c", "v"))
+
+	_, err = c.Get(ctx, "missing")
+	assert.Equal(t, ErrNotFound, err)
+
+	err = c.Put(ctx, "big", "v")
+	assert.Equal(t, &Error{StatusCode: http.StatusRequestEntityTooLarge, Code: "value_too_large", Message: "value is too large"}, err)
+
+	page, err := c.Scan(ctx, "p", "", 2)
+	assert.Nil(t, err, err)
+	assert.Equal(t, ScanPage{Items: []KeyValue{{"p1", "1"}, {"p2", "2"}}, Next: "p2"}, page)
+
+	t.Run("gives up", func(t *testing.T) {
+		err := New(srv.URL, WithRetries(1), WithBackoff(time.Millisecond)).Delete(ctx, "down")
+		if assert.IsType(t, &Error{}, err) {
+			assert.Equal(t, http.StatusServiceUnavailable, err.(*Error).StatusCode)
+		}
+
+		ctx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err = New(srv.URL, WithRetries(100), WithBackoff(time.Second)).Delete(ctx, "down")
+		assert.NotNil(t, err)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+}
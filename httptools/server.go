@@ -1,6 +1,7 @@
 package httptools
 
 import (
+	"crypto/tls"
 	"fmt"
 	"log"
 	"net/http"
@@ -15,22 +16,46 @@ type server struct {
 	httpServer *http.Server
 }
 
+// ServerOption configures optional server behaviour.
+type ServerOption func(*http.Server)
+
+// WithTLS makes the server serve HTTPS with config. A nil config is ignored.
+func WithTLS(config *tls.Config) ServerOption {
+	return func(s *http.Server) {
+		s.TLSConfig = config
+	}
+}
+
 func (s server) Start() {
 	go func() {
-		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
+		var err error
+		if s.httpServer.TLSConfig != nil {
+			log.Println("Staring the HTTPS server...")
+			// The certificates are in the TLS config already.
+			err = s.httpServer.ListenAndServeTLS("", "")
+		} else {
+			log.Println("Staring the HTTP server...")
+			err = s.httpServer.ListenAndServe()
+		}
 		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
 	}()
 }
 
-func CreateServer(port int, handler http.Handler) Server {
-	return server{
-		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
-			Handler:        handler,
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		},
+func CreateServer(port int, handler http.Handler, opts ...ServerOption) Server {
+	return CreateServerAt(fmt.Sprintf(":%d", port), handler, opts...)
+}
+
+// CreateServerAt creates a server listening on addr, like 127.0.0.1:8080.
+func CreateServerAt(addr string, handler http.Handler, opts ...ServerOption) Server {
+	s := &http.Server{
+		Addr:           addr,
+		Handler:        handler,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	for _, opt := range opts {
+		opt(s)
 	}
+	return server{httpServer: s}
 }
@@ -0,0 +1,121 @@
+package httptools
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+)
+
+// TLSConfig names the PEM files of a TLS endpoint. For a server, CertFile
+// and KeyFile are its certificate, and CAFile, if set, verifies client
+// certificates, which are then required (mutual TLS). For a client, CAFile
+// verifies the servers instead of the system roots, and CertFile and KeyFile
+// are the certificate it presents to servers requiring one.
+type TLSConfig struct {
+	CertFile string
+	KeyFile  string
+	CAFile   string
+}
+
+// ServerTLSFlags registers the -<prefix>cert, -<prefix>key and -<prefix>ca
+// flags of a server.
+func ServerTLSFlags(prefix string) *TLSConfig {
+	c := new(TLSConfig)
+	flag.StringVar(&c.CertFile, prefix+"cert", "", "certificate file; serves HTTPS when set")
+	flag.StringVar(&c.KeyFile, prefix+"key", "", "private key file of the certificate")
+	flag.StringVar(&c.CAFile, prefix+"ca", "", "CA file verifying client certificates; requires them when set")
+	return c
+}
+
+// ClientTLSFlags registers the -<prefix>ca, -<prefix>cert and -<prefix>key
+// flags of a client talking to what.
+func ClientTLSFlags(prefix, what string) *TLSConfig {
+	c := new(TLSConfig)
+	flag.StringVar(&c.CAFile, prefix+"ca", "", "CA file verifying "+what+" instead of the system roots")
+	flag.StringVar(&c.CertFile, prefix+"cert", "", "client certificate file presented to "+what)
+	flag.StringVar(&c.KeyFile, prefix+"key", "", "private key file of the client certificate")
+	return c
+}
+
+// Enabled tells whether any of the files is set.
+func (c *TLSConfig) Enabled() bool {
+	return c.CertFile != "" || c.KeyFile != "" || c.CAFile != ""
+}
+
+// ServerConfig loads the files of a server. It returns nil if none are set.
+func (c *TLSConfig) ServerConfig() (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, errors.New("serving TLS requires both a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}
+	if c.CAFile != "" {
+		if config.ClientCAs, err = loadCertPool(c.CAFile); err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientConfig loads the files of a client. It returns nil if none are set,
+// leaving the defaults of the standard library.
+func (c *TLSConfig) ClientConfig() (*tls.Config, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if (c.CertFile == "") != (c.KeyFile == "") {
+		return nil, errors.New("a client certificate requires both a certificate and a key")
+	}
+	if c.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	if c.CAFile != "" {
+		var err error
+		if config.RootCAs, err = loadCertPool(c.CAFile); err != nil {
+			return nil, err
+		}
+	}
+	return config, nil
+}
+
+// Transport returns a clone of the default transport using the client
+// configuration.
+func (c *TLSConfig) Transport() (*http.Transport, error) {
+	config, err := c.ClientConfig()
+	if err != nil {
+		return nil, err
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if config != nil {
+		transport.TLSClientConfig = config
+	}
+	return transport, nil
+}
+
+func loadCertPool(file string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificates found in %s", file)
+	}
+	return pool, nil
+}
@@ -0,0 +1,116 @@
+package httptools
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCert writes a certificate and its key signed by parent, or a
+// self-signed CA if parent is nil, and returns their paths.
+func writeCert(t *testing.T, dir, name string, parent *x509.Certificate, parentKey *ecdsa.PrivateKey) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+	if parent == nil {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage = x509.KeyUsageCertSign
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := filepath.Join(dir, name+".crt"), filepath.Join(dir, name+".key")
+	assert.Nil(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600))
+	assert.Nil(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0o600))
+	return cert, key, certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca, caKey, caFile, _ := writeCert(t, dir, "ca", nil, nil)
+	_, _, serverCert, serverKey := writeCert(t, dir, "server", ca, caKey)
+	_, _, clientCert, clientKey := writeCert(t, dir, "client", ca, caKey)
+
+	serverConfig, err := (&TLSConfig{CertFile: serverCert, KeyFile: serverKey, CAFile: caFile}).ServerConfig()
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	srv := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.TLS.PeerCertificates[0].Subject.CommonName))
+	}))
+	srv.TLS = serverConfig
+	srv.StartTLS()
+	defer srv.Close()
+
+	t.Run("mutual TLS", func(t *testing.T) {
+		transport, err := (&TLSConfig{CertFile: clientCert, KeyFile: clientKey, CAFile: caFile}).Transport()
+		if !assert.Nil(t, err, err) {
+			return
+		}
+		resp, err := (&http.Client{Transport: transport}).Get(srv.URL)
+		if assert.Nil(t, err, err) {
+			resp.Body.Close()
+			assert.Equal(t, http.StatusOK, resp.StatusCode)
+		}
+	})
+
+	t.Run("no client certificate", func(t *testing.T) {
+		transport, err := (&TLSConfig{CAFile: caFile}).Transport()
+		if !assert.Nil(t, err, err) {
+			return
+		}
+		_, err = (&http.Client{Transport: transport}).Get(srv.URL)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("unknown CA", func(t *testing.T) {
+		transport, err := (&TLSConfig{CertFile: clientCert, KeyFile: clientKey}).Transport()
+		if !assert.Nil(t, err, err) {
+			return
+		}
+		_, err = (&http.Client{Transport: transport}).Get(srv.URL)
+		assert.NotNil(t, err)
+	})
+
+	t.Run("invalid", func(t *testing.T) {
+		config, err := (&TLSConfig{}).ServerConfig()
+		assert.Nil(t, err)
+		assert.Nil(t, config, "TLS is off without files")
+		_, err = (&TLSConfig{CertFile: serverCert}).ServerConfig()
+		assert.NotNil(t, err)
+		_, err = (&TLSConfig{CertFile: clientCert}).ClientConfig()
+		assert.NotNil(t, err)
+		_, err = (&TLSConfig{CAFile: serverKey}).ClientConfig()
+		assert.NotNil(t, err)
+	})
+}
@@ -0,0 +1,36 @@
+package integration
+
+import (
+	"context"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/design-practice-2-template/dbclient"
+	"github.com/stretchr/testify/assert"
+)
+
+const dbAddress = "http://database:9000"
+
+func TestDatabase(t *testing.T) {
+	if _, exists := os.LookupEnv("INTEGRATION_TEST"); !exists {
+		t.Skip("Integration test is not enabled")
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	db := dbclient.New(dbAddress)
+
+	// The servers store their start date under team-name.
+	value, err := db.Get(ctx, "team-name")
+	assert.Nil(t, err, err)
+	assert.NotEqual(t, "", value)
+
+	key := "integration/key with spaces"
+	assert.Nil(t, db.Put(ctx, key, "value"))
+	value, err = db.Get(ctx, key)
+	assert.Nil(t, err, err)
+	assert.Equal(t, "value", value)
+	assert.Nil(t, db.Delete(ctx, key))
+	_, err = db.Get(ctx, key)
+	assert.Equal(t, dbclient.ErrNotFound, err)
+}
@@ -0,0 +1,96 @@
+package raft
+
+import (
+	"context"
+	"sync"
+)
+
+// Network connects the nodes of a cluster running in one process. Nodes can
+// be cut off from it to simulate crashes and partitions.
+type Network struct {
+	mu           sync.Mutex
+	nodes        map[string]*Node
+	disconnected map[string]bool
+}
+
+func NewNetwork() *Network {
+	return &Network{
+		nodes:        make(map[string]*Node),
+		disconnected: make(map[string]bool),
+	}
+}
+
+// Add makes a node reachable by its ID, replacing the node with the same
+// ID.
+func (nw *Network) Add(n *Node) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.nodes[n.ID()] = n
+}
+
+// Disconnect drops all messages from and to the node with id.
+func (nw *Network) Disconnect(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.disconnected[id] = true
+}
+
+// Connect undoes Disconnect.
+func (nw *Network) Connect(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	delete(nw.disconnected, id)
+}
+
+// Transport returns the transport of the node with id.
+func (nw *Network) Transport(id string) Transport {
+	return &memTransport{nw: nw, from: id}
+}
+
+func (nw *Network) node(from, to string) (*Node, error) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	n, ok := nw.nodes[to]
+	if !ok || nw.disconnected[from] || nw.disconnected[to] {
+		return nil, ErrUnreachable
+	}
+	return n, nil
+}
+
+type memTransport struct {
+	nw   *Network
+	from string
+}
+
+// deliver calls a handler of the peer node. A response is lost if either
+// node was disconnected while the request was handled.
+func deliver[Resp any](ctx context.Context, t *memTransport, peer string, handle func(*Node) (Resp, error)) (Resp, error) {
+	var zero Resp
+	if err := ctx.Err(); err != nil {
+		return zero, err
+	}
+	n, err := t.nw.node(t.from, peer)
+	if err != nil {
+		return zero, err
+	}
+	resp, err := handle(n)
+	if err != nil {
+		return zero, err
+	}
+	if _, err := t.nw.node(t.from, peer); err != nil {
+		return zero, err
+	}
+	return resp, nil
+}
+
+func (t *memTransport) RequestVote(ctx context.Context, peer string, req VoteRequest) (VoteResponse, error) {
+	return deliver(ctx, t, peer, func(n *Node) (VoteResponse, error) { return n.HandleVote(req) })
+}
+
+func (t *memTransport) AppendEntries(ctx context.Context, peer string, req AppendRequest) (AppendResponse, error) {
+	return deliver(ctx, t, peer, func(n *Node) (AppendResponse, error) { return n.HandleAppend(req) })
+}
+
+func (t *memTransport) InstallSnapshot(ctx context.Context, peer string, req SnapshotRequest) (SnapshotResponse, error) {
+	return deliver(ctx, t, peer, func(n *Node) (SnapshotResponse, error) { return n.HandleSnapshot(req) })
+}
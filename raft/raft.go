@@ -0,0 +1,996 @@
+// Package raft replicates a log of commands between the nodes of a cluster
+// with the Raft consensus algorithm and applies the committed commands to a
+// state machine on every node.
+package raft
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+const (
+	defaultElectionTimeout   = 300 * time.Millisecond
+	defaultHeartbeatInterval = 50 * time.Millisecond
+	defaultSnapshotThreshold = 10000
+	maxAppendEntries         = 500
+	applyRetryDelay          = time.Second
+)
+
+// ErrStopped is returned by the calls on a stopped Node.
+var ErrStopped = errors.New("raft node is stopped")
+
+// ErrLeadershipLost is returned by Propose when the proposed entry was
+// replaced by one of a new leader.
+var ErrLeadershipLost = errors.New("leadership lost before the entry was committed")
+
+// RejectedError is returned by StateMachine.Apply for a command that every
+// node rejects the same way, like an invalid one. See Reject.
+type RejectedError struct {
+	Err error
+}
+
+func (e *RejectedError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *RejectedError) Unwrap() error {
+	return e.Err
+}
+
+// Reject marks err as the outcome of applying a command on every node.
+func Reject(err error) error {
+	return &RejectedError{Err: err}
+}
+
+// NotLeaderError is returned by the calls that only the leader can serve.
+// Leader is the ID of the current leader if the node knows it.
+type NotLeaderError struct {
+	Leader string
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "not the leader, the leader is unknown"
+	}
+	return "not the leader, the leader is " + e.Leader
+}
+
+// StateMachine is the state replicated by the cluster.
+type StateMachine interface {
+	// Apply executes a committed command. Commands may be applied again
+	// after a restart, so applying a sequence of them twice must give the
+	// same state as applying it once. A command that fails with an error
+	// made by Reject counts as applied, and the error goes to the proposer.
+	// Any other error, like one of I/O, stops applying, and the command is
+	// retried, so that the nodes don't diverge.
+	Apply(data []byte) error
+	// Snapshot returns the state with all the commands applied so far.
+	Snapshot() (io.ReadCloser, error)
+	// Restore replaces the state with a snapshot.
+	Restore(r io.Reader) error
+	// Sync makes the applied commands durable, so they can be removed from
+	// the log.
+	Sync() error
+}
+
+type Config struct {
+	// ID identifies the node to its peers.
+	ID string
+	// Peers are the IDs of all the nodes of the cluster. ID may be among
+	// them.
+	Peers []string
+	// Dir is where the log and the vote are kept. Nothing is kept when it
+	// is empty.
+	Dir          string
+	Transport    Transport
+	StateMachine StateMachine
+	// ElectionTimeout is the minimal time without a leader after which a
+	// follower starts an election.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold is the number of applied entries after which the
+	// log is compacted.
+	SnapshotThreshold int
+}
+
+type role int
+
+const (
+	follower role = iota
+	candidate
+	leader
+)
+
+func (r role) String() string {
+	switch r {
+	case candidate:
+		return "candidate"
+	case leader:
+		return "leader"
+	}
+	return "follower"
+}
+
+// Status describes the state of a Node.
+type Status struct {
+	ID            string `json:"id"`
+	Role          string `json:"role"`
+	Leader        string `json:"leader"`
+	Term          uint64 `json:"term"`
+	LastIndex     uint64 `json:"last_index"`
+	CommitIndex   uint64 `json:"commit_index"`
+	AppliedIndex  uint64 `json:"applied_index"`
+	SnapshotIndex uint64 `json:"snapshot_index"`
+}
+
+type waiter struct {
+	term uint64
+	ch   chan error
+}
+
+// Node is a member of a Raft cluster.
+type Node struct {
+	id        string
+	peers     []string
+	cfg       Config
+	transport Transport
+	sm        StateMachine
+	store     *storage
+
+	// applyMu serializes the calls on the state machine. It is taken before
+	// mu.
+	applyMu sync.Mutex
+
+	mu                       sync.Mutex
+	role                     role
+	term                     uint64
+	vote                     string
+	leader                   string
+	log                      []Entry // entries after snapIndex
+	snapIndex, snapTerm      uint64
+	commitIndex, lastApplied uint64
+
+	nextIndex  map[string]uint64
+	matchIndex map[string]uint64
+	// A read started in readRound is confirmed by the peers that answered a
+	// request sent in that round or later.
+	readRound uint64
+	acked     map[string]uint64
+
+	electionDeadline time.Time
+	waiters          map[uint64]waiter
+	triggers         map[string]chan struct{}
+	// changed is closed and replaced whenever the state changes.
+	changed chan struct{}
+	rand    *rand.Rand
+	stopped bool
+
+	done chan struct{}
+	wg   sync.WaitGroup
+}
+
+// NewNode restores the node state from cfg.Dir and starts the node.
+func NewNode(cfg Config) (*Node, error) {
+	if cfg.ID == "" || cfg.Transport == nil || cfg.StateMachine == nil {
+		return nil, errors.New("raft: ID, Transport and StateMachine are required")
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = defaultElectionTimeout
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = defaultHeartbeatInterval
+	}
+	if cfg.SnapshotThreshold <= 0 {
+		cfg.SnapshotThreshold = defaultSnapshotThreshold
+	}
+	store, st, entries, err := openStorage(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	n := &Node{
+		id:          cfg.ID,
+		cfg:         cfg,
+		transport:   cfg.Transport,
+		sm:          cfg.StateMachine,
+		store:       store,
+		term:        st.Term,
+		vote:        st.Vote,
+		log:         entries,
+		snapIndex:   st.SnapshotIndex,
+		snapTerm:    st.SnapshotTerm,
+		commitIndex: st.SnapshotIndex,
+		lastApplied: st.SnapshotIndex,
+		nextIndex:   make(map[string]uint64),
+		matchIndex:  make(map[string]uint64),
+		acked:       make(map[string]uint64),
+		waiters:     make(map[uint64]waiter),
+		triggers:    make(map[string]chan struct{}),
+		changed:     make(chan struct{}),
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		done:        make(chan struct{}),
+	}
+	for _, peer := range cfg.Peers {
+		if peer != n.id {
+			n.peers = append(n.peers, peer)
+			n.triggers[peer] = make(chan struct{}, 1)
+		}
+	}
+	n.resetElection()
+
+	n.wg.Add(2 + len(n.peers))
+	go n.run()
+	go n.applier()
+	for _, peer := range n.peers {
+		go n.replicator(peer)
+	}
+	return n, nil
+}
+
+// Stop stops the node. The state machine isn't used after it returns.
+func (n *Node) Stop() error {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return nil
+	}
+	n.stopped = true
+	n.mu.Unlock()
+
+	close(n.done)
+	n.wg.Wait()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.store.close()
+}
+
+// ID returns the ID of the node.
+func (n *Node) ID() string {
+	return n.id
+}
+
+// Leader returns the ID of the current leader, or an empty string if it is
+// unknown.
+func (n *Node) Leader() string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.leader
+}
+
+// IsLeader tells whether the node is the leader.
+func (n *Node) IsLeader() bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.role == leader
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:            n.id,
+		Role:          n.role.String(),
+		Leader:        n.leader,
+		Term:          n.term,
+		LastIndex:     n.lastIndex(),
+		CommitIndex:   n.commitIndex,
+		AppliedIndex:  n.lastApplied,
+		SnapshotIndex: n.snapIndex,
+	}
+}
+
+// Propose appends a command to the log and waits until it is committed and
+// applied on this node. It returns the error of the state machine. Only the
+// leader accepts proposals.
+func (n *Node) Propose(ctx context.Context, data []byte) error {
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return ErrStopped
+	}
+	if n.role != leader {
+		err := &NotLeaderError{Leader: n.leader}
+		n.mu.Unlock()
+		return err
+	}
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term, Data: data}
+	if err := n.store.append([]Entry{e}); err != nil {
+		n.mu.Unlock()
+		return err
+	}
+	n.log = append(n.log, e)
+	ch := make(chan error, 1)
+	n.waiters[e.Index] = waiter{term: e.Term, ch: ch}
+	n.advanceCommit()
+	n.triggerAll()
+	n.mu.Unlock()
+
+	select {
+	case err := <-ch:
+		return err
+	case <-ctx.Done():
+		n.mu.Lock()
+		if w, ok := n.waiters[e.Index]; ok && w.ch == ch {
+			delete(n.waiters, e.Index)
+		}
+		n.mu.Unlock()
+		return ctx.Err()
+	case <-n.done:
+		return ErrStopped
+	}
+}
+
+// ReadIndex waits until the state machine of the leader reflects all the
+// commands committed before the call, so that a read made after it is
+// linearizable. The leader checks with a majority of the cluster that it
+// hasn't been replaced.
+func (n *Node) ReadIndex(ctx context.Context) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	var term, readIndex, round uint64
+	started := false
+	for {
+		if n.stopped {
+			return ErrStopped
+		}
+		if n.role != leader || (started && n.term != term) {
+			return &NotLeaderError{Leader: n.leader}
+		}
+		// The commit index is only known to be up to date once an entry of
+		// the current term is committed.
+		if !started && n.termAt(n.commitIndex) == n.term {
+			started = true
+			term, readIndex = n.term, n.commitIndex
+			n.readRound++
+			round = n.readRound
+			n.triggerAll()
+		}
+		if started && n.confirmed(round) && n.lastApplied >= readIndex {
+			return nil
+		}
+
+		changed := n.changed
+		n.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			n.mu.Lock()
+			return ctx.Err()
+		case <-n.done:
+			n.mu.Lock()
+			return ErrStopped
+		}
+		n.mu.Lock()
+	}
+}
+
+// HandleVote serves a VoteRequest of a candidate.
+func (n *Node) HandleVote(req VoteRequest) (VoteResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return VoteResponse{}, ErrStopped
+	}
+	if req.Term > n.term {
+		if err := n.stepDown(req.Term); err != nil {
+			return VoteResponse{}, err
+		}
+	}
+	resp := VoteResponse{Term: n.term}
+	if req.Term < n.term {
+		return resp, nil
+	}
+	lastTerm := n.termAt(n.lastIndex())
+	upToDate := req.LastLogTerm > lastTerm ||
+		(req.LastLogTerm == lastTerm && req.LastLogIndex >= n.lastIndex())
+	if (n.vote == "" || n.vote == req.Candidate) && upToDate {
+		n.vote = req.Candidate
+		if err := n.persistState(); err != nil {
+			return VoteResponse{}, err
+		}
+		n.resetElection()
+		resp.Granted = true
+	}
+	return resp, nil
+}
+
+// HandleAppend serves an AppendRequest of the leader.
+func (n *Node) HandleAppend(req AppendRequest) (AppendResponse, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.stopped {
+		return AppendResponse{}, ErrStopped
+	}
+	if req.Term < n.term {
+		return AppendResponse{Term: n.term}, nil
+	}
+	if err := n.followLeader(req.Term, req.Leader); err != nil {
+		return AppendResponse{}, err
+	}
+	resp := AppendResponse{Term: n.term}
+
+	prev, entries := req.PrevLogIndex, req.Entries
+	if prev > n.lastIndex() {
+		resp.ConflictIndex = n.lastIndex() + 1
+		return resp, nil
+	}
+	if prev < n.snapIndex {
+		// Entries up to the snapshot are committed, so they match.
+		skip := n.snapIndex - prev
+		if uint64(len(entries)) <= skip {
+			entries = nil
+		} else {
+			entries = entries[skip:]
+		}
+		prev = n.snapIndex
+	} else if conflictTerm := n.termAt(prev); conflictTerm != req.PrevLogTerm {
+		// Skip the whole conflicting term at once.
+		i := prev
+		for i > n.snapIndex+1 && n.termAt(i-1) == conflictTerm {
+			i--
+		}
+		resp.ConflictIndex = i
+		return resp, nil
+	}
+
+	for j, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue
+			}
+			kept := n.log[:e.Index-n.snapIndex-1]
+			newLog := append(append([]Entry(nil), kept...), entries[j:]...)
+			if err := n.store.rewrite(newLog); err != nil {
+				return AppendResponse{}, err
+			}
+			n.log = newLog
+			n.failWaiters(e.Index)
+		} else {
+			if err := n.store.append(entries[j:]); err != nil {
+				return AppendResponse{}, err
+			}
+			n.log = append(n.log, entries[j:]...)
+		}
+		break
+	}
+
+	match := prev + uint64(len(entries))
+	if commit := min(req.LeaderCommit, match); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.broadcast()
+	}
+	resp.Success, resp.MatchIndex = true, match
+	return resp, nil
+}
+
+// HandleSnapshot serves a SnapshotRequest of the leader.
+func (n *Node) HandleSnapshot(req SnapshotRequest) (SnapshotResponse, error) {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	if n.stopped {
+		n.mu.Unlock()
+		return SnapshotResponse{}, ErrStopped
+	}
+	if req.Term < n.term {
+		resp := SnapshotResponse{Term: n.term}
+		n.mu.Unlock()
+		return resp, nil
+	}
+	if err := n.followLeader(req.Term, req.Leader); err != nil {
+		n.mu.Unlock()
+		return SnapshotResponse{}, err
+	}
+	resp := SnapshotResponse{Term: n.term}
+	stale := req.LastIndex <= n.lastApplied
+	n.mu.Unlock()
+	if stale {
+		return resp, nil
+	}
+
+	if err := n.sm.Restore(bytes.NewReader(req.Data)); err != nil {
+		return SnapshotResponse{}, err
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.LastIndex < n.lastIndex() && n.termAt(req.LastIndex) == req.LastTerm {
+		n.log = append([]Entry(nil), n.log[req.LastIndex-n.snapIndex:]...)
+	} else {
+		n.failWaiters(n.snapIndex + 1)
+		n.log = nil
+	}
+	n.snapIndex, n.snapTerm = req.LastIndex, req.LastTerm
+	n.lastApplied = req.LastIndex
+	if n.commitIndex < req.LastIndex {
+		n.commitIndex = req.LastIndex
+	}
+	if err := n.persistState(); err != nil {
+		return SnapshotResponse{}, err
+	}
+	if err := n.store.rewrite(n.log); err != nil {
+		return SnapshotResponse{}, err
+	}
+	n.broadcast()
+	return resp, nil
+}
+
+// run starts elections and sends heartbeats.
+func (n *Node) run() {
+	defer n.wg.Done()
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-n.done:
+			return
+		}
+		n.mu.Lock()
+		if n.role == leader {
+			n.triggerAll()
+		} else if time.Now().After(n.electionDeadline) {
+			n.startElection()
+		}
+		n.mu.Unlock()
+	}
+}
+
+// startElection asks the peers to vote for the node. n.mu must be held.
+func (n *Node) startElection() {
+	n.role = candidate
+	n.term++
+	n.vote = n.id
+	n.leader = ""
+	n.resetElection()
+	if err := n.persistState(); err != nil {
+		log.Printf("raft: failed to start an election: %s", err)
+		n.role = follower
+		return
+	}
+	n.broadcast()
+
+	req := VoteRequest{
+		Term:         n.term,
+		Candidate:    n.id,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.termAt(n.lastIndex()),
+	}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.peers {
+		n.wg.Add(1)
+		go func(peer string) {
+			defer n.wg.Done()
+			ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+			resp, err := n.transport.RequestVote(ctx, peer, req)
+			cancel()
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.term {
+				n.stepDownOrLog(resp.Term)
+				return
+			}
+			if n.role != candidate || n.term != req.Term || !resp.Granted {
+				return
+			}
+			votes++
+			if votes >= n.quorum() {
+				n.becomeLeader()
+			}
+		}(peer)
+	}
+}
+
+// becomeLeader takes over the cluster. The leader appends an empty entry to
+// commit the entries of the previous terms. n.mu must be held.
+func (n *Node) becomeLeader() {
+	e := Entry{Index: n.lastIndex() + 1, Term: n.term}
+	if err := n.store.append([]Entry{e}); err != nil {
+		log.Printf("raft: failed to become the leader: %s", err)
+		n.role = follower
+		return
+	}
+	n.log = append(n.log, e)
+	n.role = leader
+	n.leader = n.id
+	for _, peer := range n.peers {
+		n.nextIndex[peer] = e.Index
+		n.matchIndex[peer] = 0
+		n.acked[peer] = 0
+	}
+	log.Printf("raft: %s is the leader of term %d", n.id, n.term)
+	n.advanceCommit()
+	n.triggerAll()
+	n.broadcast()
+}
+
+// followLeader makes the node a follower of the leader of term. n.mu must be
+// held.
+func (n *Node) followLeader(term uint64, id string) error {
+	if term > n.term || n.role != follower {
+		if err := n.stepDown(term); err != nil {
+			return err
+		}
+	}
+	if n.leader != id {
+		n.leader = id
+		n.broadcast()
+	}
+	n.resetElection()
+	return nil
+}
+
+// stepDown makes the node a follower in a term at least as big as its own.
+// n.mu must be held.
+func (n *Node) stepDown(term uint64) error {
+	if term > n.term {
+		n.term = term
+		n.vote = ""
+		n.leader = ""
+		if err := n.persistState(); err != nil {
+			return err
+		}
+	}
+	if n.role != follower {
+		n.role = follower
+		n.resetElection()
+	}
+	n.broadcast()
+	return nil
+}
+
+func (n *Node) stepDownOrLog(term uint64) {
+	if err := n.stepDown(term); err != nil {
+		log.Printf("raft: failed to step down: %s", err)
+	}
+}
+
+// replicator sends the log to a peer whenever it is triggered.
+func (n *Node) replicator(peer string) {
+	defer n.wg.Done()
+	for {
+		select {
+		case <-n.triggers[peer]:
+		case <-n.done:
+			return
+		}
+		for n.replicate(peer) {
+			select {
+			case <-n.done:
+				return
+			default:
+			}
+		}
+	}
+}
+
+// replicate sends a batch of entries or a snapshot to a peer. It returns
+// true if there's more to send.
+func (n *Node) replicate(peer string) bool {
+	n.mu.Lock()
+	if n.role != leader {
+		n.mu.Unlock()
+		return false
+	}
+	next := n.nextIndex[peer]
+	if next <= n.snapIndex {
+		n.mu.Unlock()
+		return n.sendSnapshot(peer)
+	}
+	req := AppendRequest{
+		Term:         n.term,
+		Leader:       n.id,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.termAt(next - 1),
+		Entries:      n.entries(next, min(n.lastIndex(), next+maxAppendEntries-1)),
+		LeaderCommit: n.commitIndex,
+	}
+	round := n.readRound
+	n.mu.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), n.cfg.ElectionTimeout)
+	resp, err := n.transport.AppendEntries(ctx, peer, req)
+	cancel()
+	if err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.stepDownOrLog(resp.Term)
+		return false
+	}
+	if n.role != leader || n.term != req.Term {
+		return false
+	}
+	if round > n.acked[peer] {
+		n.acked[peer] = round
+		n.broadcast()
+	}
+	if !resp.Success {
+		if resp.ConflictIndex > 0 && resp.ConflictIndex < next {
+			n.nextIndex[peer] = resp.ConflictIndex
+		} else if next > 1 {
+			n.nextIndex[peer] = next - 1
+		}
+		return true
+	}
+	if resp.MatchIndex > n.matchIndex[peer] {
+		n.matchIndex[peer] = resp.MatchIndex
+		n.advanceCommit()
+	}
+	n.nextIndex[peer] = resp.MatchIndex + 1
+	return n.nextIndex[peer] <= n.lastIndex()
+}
+
+// sendSnapshot sends the state machine to a peer that needs compacted
+// entries.
+func (n *Node) sendSnapshot(peer string) bool {
+	n.applyMu.Lock()
+	rc, err := n.sm.Snapshot()
+	n.mu.Lock()
+	req := SnapshotRequest{
+		Term:      n.term,
+		Leader:    n.id,
+		LastIndex: n.lastApplied,
+		LastTerm:  n.termAt(n.lastApplied),
+	}
+	isLeader := n.role == leader
+	n.mu.Unlock()
+	n.applyMu.Unlock()
+	if err != nil {
+		log.Printf("raft: failed to take a snapshot: %s", err)
+		return false
+	}
+	req.Data, err = io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		log.Printf("raft: failed to read a snapshot: %s", err)
+		return false
+	}
+	if !isLeader {
+		return false
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*n.cfg.ElectionTimeout)
+	resp, err := n.transport.InstallSnapshot(ctx, peer, req)
+	cancel()
+	if err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.term {
+		n.stepDownOrLog(resp.Term)
+		return false
+	}
+	if n.role != leader || n.term != req.Term {
+		return false
+	}
+	if req.LastIndex > n.matchIndex[peer] {
+		n.matchIndex[peer] = req.LastIndex
+		n.advanceCommit()
+	}
+	n.nextIndex[peer] = n.matchIndex[peer] + 1
+	return n.nextIndex[peer] <= n.lastIndex()
+}
+
+// advanceCommit commits the entries stored by a majority. Only entries of
+// the current term are committed by counting; the older ones are committed
+// along with them. n.mu must be held.
+func (n *Node) advanceCommit() {
+	for i := n.lastIndex(); i > n.commitIndex && n.termAt(i) == n.term; i-- {
+		count := 1
+		for _, peer := range n.peers {
+			if n.matchIndex[peer] >= i {
+				count++
+			}
+		}
+		if count >= n.quorum() {
+			n.commitIndex = i
+			n.broadcast()
+			return
+		}
+	}
+}
+
+// applier applies committed entries to the state machine.
+func (n *Node) applier() {
+	defer n.wg.Done()
+	for {
+		n.mu.Lock()
+		for n.lastApplied >= n.commitIndex {
+			changed := n.changed
+			n.mu.Unlock()
+			select {
+			case <-changed:
+			case <-n.done:
+				return
+			}
+			n.mu.Lock()
+		}
+		n.mu.Unlock()
+
+		if err := n.applyCommitted(); err != nil {
+			log.Printf("raft: failed to apply a committed entry, retrying: %s", err)
+			select {
+			case <-time.After(applyRetryDelay):
+			case <-n.done:
+				return
+			}
+			continue
+		}
+		n.maybeCompact()
+	}
+}
+
+// applyCommitted applies the committed entries in order. It stops at the
+// first one the state machine fails to apply without rejecting it and
+// returns the error.
+func (n *Node) applyCommitted() error {
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	n.mu.Lock()
+	entries := n.entries(n.lastApplied+1, n.commitIndex)
+	n.mu.Unlock()
+
+	for _, e := range entries {
+		var err error
+		if len(e.Data) > 0 {
+			err = n.sm.Apply(e.Data)
+		}
+		var rejected *RejectedError
+		if errors.As(err, &rejected) {
+			err = rejected.Err
+		} else if err != nil {
+			return err
+		}
+		n.mu.Lock()
+		n.lastApplied = e.Index
+		if w, ok := n.waiters[e.Index]; ok {
+			delete(n.waiters, e.Index)
+			if w.term != e.Term {
+				err = ErrLeadershipLost
+			}
+			w.ch <- err
+		}
+		n.broadcast()
+		n.mu.Unlock()
+	}
+	return nil
+}
+
+// maybeCompact removes the applied entries from the log once there are
+// enough of them. The state machine serves as the snapshot.
+func (n *Node) maybeCompact() {
+	n.mu.Lock()
+	needed := n.lastApplied-n.snapIndex > uint64(n.cfg.SnapshotThreshold)
+	n.mu.Unlock()
+	if !needed {
+		return
+	}
+
+	n.applyMu.Lock()
+	defer n.applyMu.Unlock()
+	if err := n.sm.Sync(); err != nil {
+		log.Printf("raft: failed to sync the state machine: %s", err)
+		return
+	}
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	index := n.lastApplied
+	n.snapTerm = n.termAt(index)
+	n.log = append([]Entry(nil), n.log[index-n.snapIndex:]...)
+	n.snapIndex = index
+	// A crash in between is fine: entries up to the snapshot are skipped
+	// when the log is read.
+	if err := n.persistState(); err != nil {
+		log.Printf("raft: failed to save the snapshot index: %s", err)
+	}
+	if err := n.store.rewrite(n.log); err != nil {
+		log.Printf("raft: failed to compact the log: %s", err)
+	}
+}
+
+// failWaiters fails the proposals from index on, which were removed from
+// the log. n.mu must be held.
+func (n *Node) failWaiters(from uint64) {
+	for index, w := range n.waiters {
+		if index >= from {
+			delete(n.waiters, index)
+			w.ch <- ErrLeadershipLost
+		}
+	}
+}
+
+func (n *Node) lastIndex() uint64 {
+	return n.snapIndex + uint64(len(n.log))
+}
+
+// termAt returns the term of the entry at index, or 0 if it isn't known.
+func (n *Node) termAt(index uint64) uint64 {
+	if index == n.snapIndex {
+		return n.snapTerm
+	}
+	if index < n.snapIndex || index > n.lastIndex() {
+		return 0
+	}
+	return n.log[index-n.snapIndex-1].Term
+}
+
+// entries copies the entries from index from to index to inclusive.
+func (n *Node) entries(from, to uint64) []Entry {
+	if from > to {
+		return nil
+	}
+	return append([]Entry(nil), n.log[from-n.snapIndex-1:to-n.snapIndex]...)
+}
+
+func (n *Node) quorum() int {
+	return (len(n.peers)+1)/2 + 1
+}
+
+func (n *Node) confirmed(round uint64) bool {
+	count := 1
+	for _, peer := range n.peers {
+		if n.acked[peer] >= round {
+			count++
+		}
+	}
+	return count >= n.quorum()
+}
+
+func (n *Node) triggerAll() {
+	for _, trigger := range n.triggers {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (n *Node) broadcast() {
+	close(n.changed)
+	n.changed = make(chan struct{})
+}
+
+func (n *Node) resetElection() {
+	timeout := n.cfg.ElectionTimeout + time.Duration(n.rand.Int63n(int64(n.cfg.ElectionTimeout)))
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+func (n *Node) persistState() error {
+	err := n.store.saveState(hardState{
+		Term:          n.term,
+		Vote:          n.vote,
+		SnapshotIndex: n.snapIndex,
+		SnapshotTerm:  n.snapTerm,
+	})
+	if err != nil {
+		return fmt.Errorf("raft: saving state: %w", err)
+	}
+	return nil
+}
+
+func min(a, b uint64) uint64 {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,293 @@
+package raft
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// kvMachine applies commands of the form key=value to a map. It fails to
+// apply the next failures commands, like a disk that is full for a while.
+type kvMachine struct {
+	mu       sync.Mutex
+	values   map[string]string
+	failures int
+}
+
+func newKvMachine() *kvMachine {
+	return &kvMachine{values: make(map[string]string)}
+}
+
+func (m *kvMachine) Apply(data []byte) error {
+	key, value, ok := strings.Cut(string(data), "=")
+	if !ok {
+		return Reject(errors.New("bad command"))
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.failures > 0 {
+		m.failures--
+		return errors.New("no space left on device")
+	}
+	m.values[key] = value
+	return nil
+}
+
+func (m *kvMachine) Snapshot() (io.ReadCloser, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	data, err := json.Marshal(m.values)
+	return io.NopCloser(bytes.NewReader(data)), err
+}
+
+func (m *kvMachine) Restore(r io.Reader) error {
+	values := make(map[string]string)
+	if err := json.NewDecoder(r).Decode(&values); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.values = values
+	return nil
+}
+
+func (m *kvMachine) Sync() error {
+	return nil
+}
+
+func (m *kvMachine) get(key string) string {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.values[key]
+}
+
+type cluster struct {
+	t        *testing.T
+	network  *Network
+	ids      []string
+	nodes    map[string]*Node
+	machines map[string]*kvMachine
+	dirs     map[string]string
+	cfg      Config
+}
+
+func newCluster(t *testing.T, size int, cfg Config) *cluster {
+	c := &cluster{
+		t:        t,
+		network:  NewNetwork(),
+		nodes:    make(map[string]*Node),
+		machines: make(map[string]*kvMachine),
+		dirs:     make(map[string]string),
+		cfg:      cfg,
+	}
+	for i := 0; i < size; i++ {
+		c.ids = append(c.ids, fmt.Sprintf("node%d", i))
+	}
+	for _, id := range c.ids {
+		c.start(id)
+	}
+	t.Cleanup(func() {
+		for _, n := range c.nodes {
+			n.Stop()
+		}
+	})
+	return c
+}
+
+func (c *cluster) start(id string) {
+	cfg := c.cfg
+	cfg.ID = id
+	cfg.Peers = c.ids
+	cfg.Transport = c.network.Transport(id)
+	cfg.StateMachine = newKvMachine()
+	cfg.ElectionTimeout = 100 * time.Millisecond
+	cfg.HeartbeatInterval = 20 * time.Millisecond
+	if cfg.Dir != "" {
+		cfg.Dir = filepath.Join(c.cfg.Dir, id)
+	}
+	n, err := NewNode(cfg)
+	if err != nil {
+		c.t.Fatal(err)
+	}
+	c.nodes[id] = n
+	c.machines[id] = cfg.StateMachine.(*kvMachine)
+	c.network.Add(n)
+}
+
+// leader waits for one of the connected nodes to become the leader.
+func (c *cluster) leader(except ...string) *Node {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		for _, id := range c.ids {
+			if n := c.nodes[id]; n.IsLeader() && !contains(except, id) {
+				return n
+			}
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("no leader elected")
+	return nil
+}
+
+func (c *cluster) waitValue(id, key, value string) {
+	c.t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for c.machines[id].get(key) != value {
+		if time.Now().After(deadline) {
+			c.t.Fatalf("%s has %s=%q, want %q", id, key, c.machines[id].get(key), value)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func contains(ids []string, id string) bool {
+	for _, i := range ids {
+		if i == id {
+			return true
+		}
+	}
+	return false
+}
+
+func propose(n *Node, cmd string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	return n.Propose(ctx, []byte(cmd))
+}
+
+func TestRaft_Replication(t *testing.T) {
+	c := newCluster(t, 3, Config{})
+	leader := c.leader()
+
+	for i := 0; i < 20; i++ {
+		assert.NoError(t, propose(leader, fmt.Sprintf("key%d=value%d", i, i)))
+	}
+	assert.Equal(t, "value19", c.machines[leader.ID()].get("key19"))
+	for _, id := range c.ids {
+		c.waitValue(id, "key19", "value19")
+		assert.Equal(t, "value0", c.machines[id].get("key0"))
+	}
+
+	for _, n := range c.nodes {
+		if n != leader {
+			err := propose(n, "a=b")
+			var notLeader *NotLeaderError
+			if assert.ErrorAs(t, err, &notLeader) {
+				assert.Equal(t, leader.ID(), notLeader.Leader)
+			}
+		}
+	}
+	assert.EqualError(t, propose(leader, "bad"), "bad command")
+	assert.NoError(t, propose(leader, "after=bad"), "rejected commands count as applied")
+}
+
+func TestRaft_ApplyFailure(t *testing.T) {
+	c := newCluster(t, 3, Config{})
+	leader := c.leader()
+	var follower string
+	for _, id := range c.ids {
+		if id != leader.ID() {
+			follower = id
+			break
+		}
+	}
+	m := c.machines[follower]
+	m.mu.Lock()
+	m.failures = 2
+	m.mu.Unlock()
+
+	assert.NoError(t, propose(leader, "a=1"))
+	assert.NoError(t, propose(leader, "b=2"))
+	// The follower retries the command that failed rather than skip it.
+	c.waitValue(follower, "b", "2")
+	assert.Equal(t, "1", m.get("a"))
+	m.mu.Lock()
+	assert.Equal(t, 0, m.failures)
+	m.mu.Unlock()
+}
+
+func TestRaft_LeaderFailure(t *testing.T) {
+	c := newCluster(t, 3, Config{})
+	old := c.leader()
+	assert.NoError(t, propose(old, "key=1"))
+
+	c.network.Disconnect(old.ID())
+	leader := c.leader(old.ID())
+	assert.NoError(t, propose(leader, "key=2"))
+
+	// The old leader can't commit or serve reads without a majority.
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	assert.Error(t, old.ReadIndex(ctx))
+	assert.Error(t, old.Propose(ctx, []byte("key=stale")))
+	assert.NoError(t, leader.ReadIndex(context.Background()))
+	assert.Equal(t, "2", c.machines[leader.ID()].get("key"))
+
+	c.network.Connect(old.ID())
+	c.waitValue(old.ID(), "key", "2")
+	assert.False(t, old.IsLeader())
+	for _, id := range c.ids {
+		assert.NotEqual(t, "stale", c.machines[id].get("key"))
+	}
+}
+
+func TestRaft_Snapshot(t *testing.T) {
+	c := newCluster(t, 3, Config{SnapshotThreshold: 5})
+	leader := c.leader()
+	var lagging string
+	for _, id := range c.ids {
+		if id != leader.ID() {
+			lagging = id
+			break
+		}
+	}
+
+	c.network.Disconnect(lagging)
+	for i := 0; i < 30; i++ {
+		assert.NoError(t, propose(leader, fmt.Sprintf("key%d=%d", i, i)))
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for leader.Status().SnapshotIndex == 0 && time.Now().Before(deadline) {
+		time.Sleep(10 * time.Millisecond)
+	}
+	assert.NotZero(t, leader.Status().SnapshotIndex)
+
+	c.network.Connect(lagging)
+	c.waitValue(lagging, "key29", "29")
+	assert.Equal(t, "0", c.machines[lagging].get("key0"))
+	assert.NotZero(t, c.nodes[lagging].Status().SnapshotIndex)
+}
+
+func TestRaft_Restart(t *testing.T) {
+	c := newCluster(t, 3, Config{Dir: t.TempDir()})
+	leader := c.leader()
+	for i := 0; i < 10; i++ {
+		assert.NoError(t, propose(leader, fmt.Sprintf("key%d=%d", i, i)))
+	}
+	term := leader.Status().Term
+
+	for _, id := range c.ids {
+		assert.NoError(t, c.nodes[id].Stop())
+	}
+	for _, id := range c.ids {
+		c.start(id)
+	}
+	leader = c.leader()
+	assert.True(t, leader.Status().Term > term)
+	// Committed entries are replayed to the new state machines.
+	for _, id := range c.ids {
+		c.waitValue(id, "key9", "9")
+		assert.Equal(t, "0", c.machines[id].get("key0"))
+	}
+}
@@ -0,0 +1,71 @@
+package raft
+
+import (
+	"context"
+	"errors"
+)
+
+// ErrUnreachable is returned by a Transport when a peer can't be reached.
+var ErrUnreachable = errors.New("peer is unreachable")
+
+// Entry is a command in the replicated log. Entries with no data are
+// appended by new leaders and are not passed to the state machine.
+type Entry struct {
+	Index uint64 `json:"index"`
+	Term  uint64 `json:"term"`
+	Data  []byte `json:"data,omitempty"`
+}
+
+type VoteRequest struct {
+	Term         uint64 `json:"term"`
+	Candidate    string `json:"candidate"`
+	LastLogIndex uint64 `json:"last_log_index"`
+	LastLogTerm  uint64 `json:"last_log_term"`
+}
+
+type VoteResponse struct {
+	Term    uint64 `json:"term"`
+	Granted bool   `json:"granted"`
+}
+
+type AppendRequest struct {
+	Term         uint64  `json:"term"`
+	Leader       string  `json:"leader"`
+	PrevLogIndex uint64  `json:"prev_log_index"`
+	PrevLogTerm  uint64  `json:"prev_log_term"`
+	Entries      []Entry `json:"entries,omitempty"`
+	LeaderCommit uint64  `json:"leader_commit"`
+}
+
+// AppendResponse tells the leader how far the log of a follower matches its
+// own. When Success is false, ConflictIndex is where the leader should
+// continue sending entries from.
+type AppendResponse struct {
+	Term          uint64 `json:"term"`
+	Success       bool   `json:"success"`
+	MatchIndex    uint64 `json:"match_index"`
+	ConflictIndex uint64 `json:"conflict_index"`
+}
+
+// SnapshotRequest carries the whole state machine as of LastIndex to a
+// follower that is missing compacted entries.
+type SnapshotRequest struct {
+	Term      uint64 `json:"term"`
+	Leader    string `json:"leader"`
+	LastIndex uint64 `json:"last_index"`
+	LastTerm  uint64 `json:"last_term"`
+	Data      []byte `json:"data"`
+}
+
+type SnapshotResponse struct {
+	Term uint64 `json:"term"`
+}
+
+// Transport delivers requests to the other nodes of the cluster, which are
+// addressed by their IDs. The receiving side passes them to the Handle
+// methods of its Node.
+type Transport interface {
+	RequestVote(ctx context.Context, peer string, req VoteRequest) (VoteResponse, error)
+	AppendEntries(ctx context.Context, peer string, req AppendRequest) (AppendResponse, error)
+	InstallSnapshot(ctx context.Context, peer string, req SnapshotRequest) (SnapshotResponse, error)
+}
@@ -0,0 +1,181 @@
+package raft
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+const (
+	stateFileName = "raft-state"
+	logFileName   = "raft-log"
+)
+
+// hardState is what a node must remember across restarts besides its log.
+type hardState struct {
+	Term          uint64 `json:"term"`
+	Vote          string `json:"vote,omitempty"`
+	SnapshotIndex uint64 `json:"snapshot_index"`
+	SnapshotTerm  uint64 `json:"snapshot_term"`
+}
+
+// storage keeps the state and the log of a node in dir. The log file has an
+// entry per line and is only appended to, unless entries are removed by a
+// conflict or a compaction, when it is rewritten. A storage without a dir
+// keeps nothing, which is enough for nodes that never restart.
+type storage struct {
+	dir string
+	log *os.File
+}
+
+func openStorage(dir string) (*storage, hardState, []Entry, error) {
+	s := &storage{dir: dir}
+	var st hardState
+	if dir == "" {
+		return s, st, nil, nil
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, st, nil, err
+	}
+	data, err := os.ReadFile(filepath.Join(dir, stateFileName))
+	if err == nil {
+		err = json.Unmarshal(data, &st)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return nil, st, nil, err
+	}
+
+	entries, err := readLog(filepath.Join(dir, logFileName), st.SnapshotIndex)
+	if err != nil {
+		return nil, st, nil, err
+	}
+	// Rewriting drops the compacted entries and a line torn by a crash.
+	if err := s.rewrite(entries); err != nil {
+		return nil, st, nil, err
+	}
+	return s, st, entries, nil
+}
+
+// readLog reads the entries after snapshotIndex. A partially written last
+// line is ignored.
+func readLog(path string, snapshotIndex uint64) ([]Entry, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []Entry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 64<<20)
+	for scanner.Scan() {
+		var e Entry
+		if err := json.Unmarshal(scanner.Bytes(), &e); err != nil {
+			break
+		}
+		if e.Index > snapshotIndex && e.Index == snapshotIndex+uint64(len(entries))+1 {
+			entries = append(entries, e)
+		}
+	}
+	return entries, nil
+}
+
+func (s *storage) saveState(st hardState) error {
+	if s.dir == "" {
+		return nil
+	}
+	data, err := json.Marshal(st)
+	if err != nil {
+		return err
+	}
+	return writeFileSync(filepath.Join(s.dir, stateFileName), data)
+}
+
+func (s *storage) append(entries []Entry) error {
+	if s.dir == "" || len(entries) == 0 {
+		return nil
+	}
+	w := bufio.NewWriter(s.log)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err := enc.Encode(e); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	return s.log.Sync()
+}
+
+// rewrite replaces the log file with entries.
+func (s *storage) rewrite(entries []Entry) error {
+	if s.dir == "" {
+		return nil
+	}
+	path := filepath.Join(s.dir, logFileName)
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(f)
+	enc := json.NewEncoder(w)
+	for _, e := range entries {
+		if err = enc.Encode(e); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if s.log != nil {
+		s.log.Close()
+	}
+	s.log = f
+	return nil
+}
+
+func (s *storage) close() error {
+	if s.log == nil {
+		return nil
+	}
+	return s.log.Close()
+}
+
+func writeFileSync(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+	}
+	return err
+}
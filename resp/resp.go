@@ -0,0 +1,168 @@
+// Package resp implements the server side of RESP, the protocol of Redis, so
+// that Redis tools and client libraries can talk to the database.
+//
+// Clients send commands as arrays of bulk strings, or as inline commands
+// separated by spaces. Replies are written with a Writer.
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Limits of a command, so a broken client can't make the server allocate
+// arbitrary amounts of memory.
+const (
+	maxArgs      = 1024 * 1024
+	maxBulkSize  = 512 * 1024 * 1024
+	maxInlineLen = 64 * 1024
+)
+
+// ErrProtocol is returned by ReadCommand for input that isn't RESP.
+var ErrProtocol = errors.New("protocol error")
+
+// ReadCommand reads the next command with its arguments. Empty inline
+// commands are skipped.
+func ReadCommand(r *bufio.Reader) ([]string, error) {
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		if b[0] == '*' {
+			return readArray(r)
+		}
+		line, err := readLine(r, maxInlineLen)
+		if err != nil {
+			return nil, err
+		}
+		if args := strings.Fields(line); len(args) > 0 {
+			return args, nil
+		}
+	}
+}
+
+func readArray(r *bufio.Reader) ([]string, error) {
+	n, err := readLength(r, '*', maxArgs)
+	if err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		size, err := readLength(r, '$', maxBulkSize)
+		if err != nil {
+			return nil, err
+		}
+		data := make([]byte, size+2)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return nil, unexpectedEOF(err)
+		}
+		if data[size] != '\r' || data[size+1] != '\n' {
+			return nil, fmt.Errorf("%w: bulk string isn't terminated", ErrProtocol)
+		}
+		args[i] = string(data[:size])
+	}
+	return args, nil
+}
+
+// readLength reads a line like *3 or $5.
+func readLength(r *bufio.Reader, prefix byte, max int) (int, error) {
+	line, err := readLine(r, 32)
+	if err != nil {
+		return 0, err
+	}
+	if len(line) < 2 || line[0] != prefix {
+		return 0, fmt.Errorf("%w: expected '%c', got '%s'", ErrProtocol, prefix, line)
+	}
+	n, err := strconv.Atoi(line[1:])
+	if err != nil || n < 0 || n > max {
+		return 0, fmt.Errorf("%w: invalid length '%s'", ErrProtocol, line[1:])
+	}
+	return n, nil
+}
+
+// readLine reads a line ending with \r\n, or just \n as redis-cli allows in
+// inline commands.
+func readLine(r *bufio.Reader, max int) (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > max+2 {
+			return "", fmt.Errorf("%w: line is too long", ErrProtocol)
+		}
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			if len(line) > 0 {
+				return "", unexpectedEOF(err)
+			}
+			return "", err
+		}
+	}
+	line = line[:len(line)-1]
+	if n := len(line); n > 0 && line[n-1] == '\r' {
+		line = line[:n-1]
+	}
+	return string(line), nil
+}
+
+func unexpectedEOF(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// Writer writes replies. Errors are sticky: once a write fails, the rest
+// are skipped and Flush returns the error.
+type Writer struct {
+	w *bufio.Writer
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: bufio.NewWriter(w)}
+}
+
+// Simple writes a status reply like OK.
+func (w *Writer) Simple(s string) {
+	w.w.WriteString("+" + s + "\r\n")
+}
+
+// Error writes an error reply. msg starts with an error kind like ERR or
+// WRONGTYPE.
+func (w *Writer) Error(msg string) {
+	// Replies are line-based, so the message must stay on one line.
+	msg = strings.NewReplacer("\r", " ", "\n", " ").Replace(msg)
+	w.w.WriteString("-" + msg + "\r\n")
+}
+
+func (w *Writer) Int(n int64) {
+	w.w.WriteString(":" + strconv.FormatInt(n, 10) + "\r\n")
+}
+
+// Bulk writes a binary-safe string.
+func (w *Writer) Bulk(s string) {
+	w.w.WriteString("$" + strconv.Itoa(len(s)) + "\r\n")
+	w.w.WriteString(s)
+	w.w.WriteString("\r\n")
+}
+
+// Null writes the null bulk string, the reply for missing values.
+func (w *Writer) Null() {
+	w.w.WriteString("$-1\r\n")
+}
+
+// Array starts an array reply of n items, which have to be written next.
+func (w *Writer) Array(n int) {
+	w.w.WriteString("*" + strconv.Itoa(n) + "\r\n")
+}
+
+func (w *Writer) Flush() error {
+	return w.w.Flush()
+}
@@ -0,0 +1,46 @@
+package resp
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReadCommand(t *testing.T) {
+	r := bufio.NewReader(strings.NewReader("*3\r\n$3\r\nSET\r\n$3\r\nk\r\n\r\n$0\r\n\r\n\r\nget  key\n"))
+	args, err := ReadCommand(r)
+	assert.Nil(t, err, err)
+	assert.Equal(t, []string{"SET", "k\r\n", ""}, args)
+
+	args, err = ReadCommand(r)
+	assert.Nil(t, err, err)
+	assert.Equal(t, []string{"get", "key"}, args)
+
+	_, err = ReadCommand(r)
+	assert.Equal(t, io.EOF, err)
+
+	for _, input := range []string{"*1\r\n:1\r\n", "*-1\r\n", "*1\r\n$2\r\nabc\r\n"} {
+		_, err := ReadCommand(bufio.NewReader(strings.NewReader(input)))
+		assert.True(t, errors.Is(err, ErrProtocol), input)
+	}
+	_, err = ReadCommand(bufio.NewReader(strings.NewReader("*1\r\n$5\r\nab")))
+	assert.Equal(t, io.ErrUnexpectedEOF, err)
+}
+
+func TestWriter(t *testing.T) {
+	var out bytes.Buffer
+	w := NewWriter(&out)
+	w.Array(5)
+	w.Simple("OK")
+	w.Error("ERR bad\nthing")
+	w.Int(-2)
+	w.Bulk("a\r\nb")
+	w.Null()
+	assert.Nil(t, w.Flush())
+	assert.Equal(t, "*5\r\n+OK\r\n-ERR bad thing\r\n:-2\r\n$4\r\na\r\nb\r\n$-1\r\n", out.String())
+}
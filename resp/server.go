@@ -0,0 +1,127 @@
+package resp
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"net"
+	"strings"
+	"sync"
+)
+
+// Handler executes commands. The command name in args[0] is upper-cased.
+// ServeRESP must write exactly one reply.
+type Handler interface {
+	ServeRESP(w *Writer, args []string)
+}
+
+// HandlerFunc adapts a function to Handler.
+type HandlerFunc func(w *Writer, args []string)
+
+func (f HandlerFunc) ServeRESP(w *Writer, args []string) {
+	f(w, args)
+}
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("resp: server closed")
+
+// Server accepts RESP connections. Commands of one connection run one after
+// another, and replies to pipelined commands are sent together. QUIT is
+// handled by the server itself.
+type Server struct {
+	Handler Handler
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// Serve accepts connections on l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			if err == nil {
+				conn.Close()
+			}
+			return ErrServerClosed
+		}
+		if err != nil {
+			s.mu.Unlock()
+			return err
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listeners and closes the connections, waiting for the
+// commands being run to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+	r := bufio.NewReader(conn)
+	w := NewWriter(conn)
+	for {
+		args, err := ReadCommand(r)
+		if errors.Is(err, ErrProtocol) {
+			w.Error("ERR " + err.Error())
+			w.Flush()
+			log.Printf("Closing RESP connection from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+		if err != nil {
+			return
+		}
+		args[0] = strings.ToUpper(args[0])
+		if args[0] == "QUIT" {
+			w.Simple("OK")
+			w.Flush()
+			return
+		}
+		s.Handler.ServeRESP(w, args)
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
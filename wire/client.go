@@ -0,0 +1,265 @@
+package wire
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
+	"sync"
+)
+
+// ErrClientClosed is returned by the calls of a closed Client.
+var ErrClientClosed = errors.New("wire: client closed")
+
+// Client talks to a server over one connection. It is safe for concurrent
+// use: the requests of concurrent calls are pipelined on the connection.
+type Client struct {
+	conn net.Conn
+
+	// wmu serializes the writes of request frames.
+	wmu sync.Mutex
+	w   *bufio.Writer
+
+	mu      sync.Mutex
+	nextID  uint32
+	pending map[uint32]chan []byte
+	// err is set once the connection fails; every call after that fails
+	// with it.
+	err error
+}
+
+// Dial connects to the server at addr.
+func Dial(ctx context.Context, addr string) (*Client, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// DialTLS connects to the server at addr over TLS with config.
+func DialTLS(ctx context.Context, addr string, config *tls.Config) (*Client, error) {
+	d := tls.Dialer{Config: config}
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewClient(conn), nil
+}
+
+// NewClient returns a Client using conn. The Client owns the connection and
+// closes it in Close.
+func NewClient(conn net.Conn) *Client {
+	c := &Client{
+		conn:    conn,
+		w:       bufio.NewWriter(conn),
+		pending: make(map[uint32]chan []byte),
+	}
+	go c.readLoop()
+	return c
+}
+
+// Close closes the connection. Calls in progress fail with ErrClientClosed.
+func (c *Client) Close() error {
+	c.fail(ErrClientClosed)
+	return c.conn.Close()
+}
+
+func (c *Client) readLoop() {
+	r := bufio.NewReader(c.conn)
+	for {
+		frame, err := readFrame(r)
+		if err != nil {
+			c.fail(err)
+			return
+		}
+		d := &decoder{buf: frame}
+		id := d.uint32()
+		if d.err != nil {
+			c.fail(d.err)
+			c.conn.Close()
+			return
+		}
+		c.mu.Lock()
+		ch, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mu.Unlock()
+		// Responses to abandoned calls are dropped.
+		if ok {
+			ch <- d.buf
+		}
+	}
+}
+
+// fail ends the pending calls with err, unless the client has already
+// failed.
+func (c *Client) fail(err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return
+	}
+	c.err = err
+	for id, ch := range c.pending {
+		close(ch)
+		delete(c.pending, id)
+	}
+}
+
+// call sends a request and returns the decoder of the response positioned
+// after the status, along with the status.
+func (c *Client) call(ctx context.Context, op byte, args func(e *encoder)) (*decoder, byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, 0, err
+	}
+	c.mu.Lock()
+	if c.err != nil {
+		err := c.err
+		c.mu.Unlock()
+		return nil, 0, err
+	}
+	c.nextID++
+	id := c.nextID
+	// Buffered, so the reader never waits on an abandoned call.
+	ch := make(chan []byte, 1)
+	c.pending[id] = ch
+	c.mu.Unlock()
+
+	e := newEncoder(id, op)
+	args(e)
+	frame, err := e.frame()
+	if err == nil {
+		c.wmu.Lock()
+		if _, err = c.w.Write(frame); err == nil {
+			err = c.w.Flush()
+		}
+		c.wmu.Unlock()
+	}
+	if err != nil {
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		if !errors.Is(err, errFrameTooLarge) {
+			// A partly written frame leaves the connection unusable.
+			c.fail(err)
+			c.conn.Close()
+		}
+		return nil, 0, err
+	}
+
+	select {
+	case res, ok := <-ch:
+		if !ok {
+			c.mu.Lock()
+			err := c.err
+			c.mu.Unlock()
+			return nil, 0, err
+		}
+		d := &decoder{buf: res}
+		status := d.byte()
+		if d.err != nil {
+			return nil, 0, d.err
+		}
+		return d, status, nil
+	case <-ctx.Done():
+		c.mu.Lock()
+		delete(c.pending, id)
+		c.mu.Unlock()
+		return nil, 0, ctx.Err()
+	}
+}
+
+// result turns the status of a response into an error.
+func result(d *decoder, status byte, err error) error {
+	if err != nil {
+		return err
+	}
+	switch status {
+	case StatusOK:
+		return nil
+	case StatusNotFound:
+		return ErrNotFound
+	}
+	werr := d.error()
+	if d.err != nil {
+		return d.err
+	}
+	return werr
+}
+
+// Get returns the value of key, or ErrNotFound.
+func (c *Client) Get(ctx context.Context, key string) (string, error) {
+	d, status, err := c.call(ctx, OpGet, func(e *encoder) { e.string(key) })
+	if err := result(d, status, err); err != nil {
+		return "", err
+	}
+	value := d.string()
+	return value, d.err
+}
+
+// Put sets the value of key.
+func (c *Client) Put(ctx context.Context, key, value string) error {
+	d, status, err := c.call(ctx, OpPut, func(e *encoder) {
+		e.string(key)
+		e.string(value)
+	})
+	return result(d, status, err)
+}
+
+// Delete removes key.
+func (c *Client) Delete(ctx context.Context, key string) error {
+	d, status, err := c.call(ctx, OpDelete, func(e *encoder) { e.string(key) })
+	return result(d, status, err)
+}
+
+// Scan returns up to limit keys with prefix that sort after the given key,
+// in order. Zero limit leaves it to the server.
+func (c *Client) Scan(ctx context.Context, prefix, after string, limit int) ([]KeyValue, error) {
+	d, status, err := c.call(ctx, OpScan, func(e *encoder) {
+		e.string(prefix)
+		e.string(after)
+		e.uint32(uint32(limit))
+	})
+	if err := result(d, status, err); err != nil {
+		return nil, err
+	}
+	items := d.pairs()
+	return items, d.err
+}
+
+// PutBatch writes pairs atomically: either all of them are stored or none.
+func (c *Client) PutBatch(ctx context.Context, pairs []KeyValue) error {
+	d, status, err := c.call(ctx, OpPutBatch, func(e *encoder) { e.pairs(pairs) })
+	return result(d, status, err)
+}
+
+// GetBatch reads the keys, returning a result for every one of them in
+// their order.
+func (c *Client) GetBatch(ctx context.Context, keys []string) ([]Result, error) {
+	d, status, err := c.call(ctx, OpGetBatch, func(e *encoder) {
+		e.uint32(uint32(len(keys)))
+		for _, key := range keys {
+			e.string(key)
+		}
+	})
+	if err := result(d, status, err); err != nil {
+		return nil, err
+	}
+	results := make([]Result, d.count(1))
+	for i := range results {
+		switch d.byte() {
+		case StatusOK:
+			results[i].Value = d.string()
+		case StatusNotFound:
+			results[i].Err = ErrNotFound
+		default:
+			results[i].Err = d.error()
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	return results, nil
+}
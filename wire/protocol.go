@@ -0,0 +1,199 @@
+// Package wire implements a compact binary protocol for the database over
+// TCP, for clients that do many small requests and can't afford JSON over
+// HTTP.
+//
+// Every message is a frame: a little-endian uint32 length followed by that
+// many bytes. A request frame holds the request id (uint32), the operation
+// (one byte) and its arguments; a response frame holds the id of the request
+// it answers, a status byte and the result. Strings are encoded as a uint32
+// length followed by the bytes. Responses come in the order of the requests,
+// so a client may send many requests without waiting for the responses.
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// MaxFrameSize bounds the size of a frame, so a broken peer can't make the
+// other side allocate arbitrary amounts of memory.
+const MaxFrameSize = 128 << 20
+
+// Operations.
+const (
+	OpGet      byte = 1
+	OpPut      byte = 2
+	OpDelete   byte = 3
+	OpScan     byte = 4
+	OpPutBatch byte = 5
+	OpGetBatch byte = 6
+)
+
+// Response statuses. An error response carries an Error.
+const (
+	StatusOK       byte = 0
+	StatusNotFound byte = 1
+	StatusError    byte = 2
+)
+
+// ErrNotFound is returned by the client for keys that have no value.
+var ErrNotFound = errors.New("record does not exist")
+
+var (
+	errShortFrame    = errors.New("wire: frame is too short")
+	errFrameTooLarge = errors.New("wire: frame is too large")
+)
+
+// Error is a failure reported by the server. Code is one of the error codes
+// of the HTTP interface, like "timeout" or "value_too_large".
+type Error struct {
+	Code    string
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// KeyValue is a key with its value.
+type KeyValue struct {
+	Key   string
+	Value string
+}
+
+// Result is the outcome for one key of a batch get. Err is ErrNotFound or an
+// *Error if there's no value.
+type Result struct {
+	Value string
+	Err   error
+}
+
+func readFrame(r *bufio.Reader) ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", errFrameTooLarge, n)
+	}
+	frame := make([]byte, n)
+	if _, err := io.ReadFull(r, frame); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return frame, nil
+}
+
+// encoder builds a frame. The first four bytes are left for its length.
+type encoder struct {
+	buf []byte
+}
+
+func newEncoder(id uint32, kind byte) *encoder {
+	e := &encoder{buf: make([]byte, 4, 64)}
+	e.uint32(id)
+	e.buf = append(e.buf, kind)
+	return e
+}
+
+func (e *encoder) uint32(n uint32) {
+	e.buf = binary.LittleEndian.AppendUint32(e.buf, n)
+}
+
+func (e *encoder) string(s string) {
+	e.uint32(uint32(len(s)))
+	e.buf = append(e.buf, s...)
+}
+
+func (e *encoder) pairs(pairs []KeyValue) {
+	e.uint32(uint32(len(pairs)))
+	for _, kv := range pairs {
+		e.string(kv.Key)
+		e.string(kv.Value)
+	}
+}
+
+func (e *encoder) error(err *Error) {
+	e.string(err.Code)
+	e.string(err.Message)
+}
+
+// frame returns the encoded frame with its length set.
+func (e *encoder) frame() ([]byte, error) {
+	n := len(e.buf) - 4
+	if n > MaxFrameSize {
+		return nil, fmt.Errorf("%w: %d bytes", errFrameTooLarge, n)
+	}
+	binary.LittleEndian.PutUint32(e.buf, uint32(n))
+	return e.buf, nil
+}
+
+// decoder reads the fields of a frame. The first error sticks, and the
+// fields read after it are zero.
+type decoder struct {
+	buf []byte
+	err error
+}
+
+func (d *decoder) byte() byte {
+	if d.err != nil || len(d.buf) < 1 {
+		d.err = errShortFrame
+		return 0
+	}
+	b := d.buf[0]
+	d.buf = d.buf[1:]
+	return b
+}
+
+func (d *decoder) uint32() uint32 {
+	if d.err != nil || len(d.buf) < 4 {
+		d.err = errShortFrame
+		return 0
+	}
+	n := binary.LittleEndian.Uint32(d.buf)
+	d.buf = d.buf[4:]
+	return n
+}
+
+func (d *decoder) string() string {
+	n := d.uint32()
+	if d.err != nil || uint32(len(d.buf)) < n {
+		d.err = errShortFrame
+		return ""
+	}
+	s := string(d.buf[:n])
+	d.buf = d.buf[n:]
+	return s
+}
+
+// count reads the length of a list whose items take at least itemSize
+// bytes each, checking it against the rest of the frame.
+func (d *decoder) count(itemSize int) int {
+	n := d.uint32()
+	if d.err == nil && uint64(n)*uint64(itemSize) > uint64(len(d.buf)) {
+		d.err = errShortFrame
+	}
+	if d.err != nil {
+		return 0
+	}
+	return int(n)
+}
+
+func (d *decoder) pairs() []KeyValue {
+	pairs := make([]KeyValue, d.count(8))
+	for i := range pairs {
+		pairs[i].Key = d.string()
+		pairs[i].Value = d.string()
+	}
+	return pairs
+}
+
+func (d *decoder) error() *Error {
+	return &Error{Code: d.string(), Message: d.string()}
+}
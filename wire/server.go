@@ -0,0 +1,261 @@
+package wire
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Handler serves the operations of the protocol. Get returns ErrNotFound for
+// keys that have no value. Other errors reach the client as an *Error; a
+// Handler returns one itself to choose the code, or gets "internal".
+type Handler interface {
+	Get(ctx context.Context, key string) (string, error)
+	Put(ctx context.Context, key, value string) error
+	Delete(ctx context.Context, key string) error
+	Scan(ctx context.Context, prefix, after string, limit int) ([]KeyValue, error)
+	PutBatch(ctx context.Context, pairs []KeyValue) error
+}
+
+// Server accepts connections speaking the protocol. Requests of one
+// connection are served one after another in the order they come.
+type Server struct {
+	Handler Handler
+	// Timeout bounds the handling of every request. Zero means no limit.
+	Timeout time.Duration
+	// MaxBatchKeys bounds the number of keys of a batch get. Zero means no
+	// limit.
+	MaxBatchKeys int
+
+	mu        sync.Mutex
+	listeners map[net.Listener]struct{}
+	conns     map[net.Conn]struct{}
+	closed    bool
+	wg        sync.WaitGroup
+}
+
+// ErrServerClosed is returned by Serve after Close.
+var ErrServerClosed = errors.New("wire: server closed")
+
+// Serve accepts connections on l until Close is called.
+func (s *Server) Serve(l net.Listener) error {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		l.Close()
+		return ErrServerClosed
+	}
+	if s.listeners == nil {
+		s.listeners = make(map[net.Listener]struct{})
+		s.conns = make(map[net.Conn]struct{})
+	}
+	s.listeners[l] = struct{}{}
+	s.mu.Unlock()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.mu.Lock()
+			closed := s.closed
+			s.mu.Unlock()
+			if closed {
+				return ErrServerClosed
+			}
+			return err
+		}
+		s.mu.Lock()
+		if s.closed {
+			s.mu.Unlock()
+			conn.Close()
+			return ErrServerClosed
+		}
+		s.conns[conn] = struct{}{}
+		s.wg.Add(1)
+		s.mu.Unlock()
+		go s.serveConn(conn)
+	}
+}
+
+// Close stops the listeners and closes the connections, waiting for the
+// requests being handled to finish.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	s.closed = true
+	for l := range s.listeners {
+		l.Close()
+	}
+	for c := range s.conns {
+		c.Close()
+	}
+	s.mu.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Server) serveConn(conn net.Conn) {
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+		s.wg.Done()
+	}()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		frame, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		res, err := s.handle(frame)
+		if err != nil {
+			log.Printf("Closing wire connection from %s: %s", conn.RemoteAddr(), err)
+			return
+		}
+		if _, err := w.Write(res); err != nil {
+			return
+		}
+		// Responses to pipelined requests are sent together.
+		if r.Buffered() == 0 {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// handle serves a request frame and returns the response frame. An error
+// means the frame is malformed and the connection can't be trusted anymore.
+func (s *Server) handle(frame []byte) ([]byte, error) {
+	d := &decoder{buf: frame}
+	id := d.uint32()
+	op := d.byte()
+	if d.err != nil {
+		return nil, d.err
+	}
+	res, err := s.serve(d, id, op)
+	if errors.Is(err, errFrameTooLarge) {
+		return errorFrame(id, &Error{Code: "value_too_large", Message: err.Error()})
+	}
+	return res, err
+}
+
+func (s *Server) serve(d *decoder, id uint32, op byte) ([]byte, error) {
+	ctx := context.Background()
+	if s.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.Timeout)
+		defer cancel()
+	}
+
+	switch op {
+	case OpGet:
+		key := d.string()
+		if d.err != nil {
+			return nil, d.err
+		}
+		value, err := s.Handler.Get(ctx, key)
+		if err != nil {
+			return errorFrame(id, err)
+		}
+		e := newEncoder(id, StatusOK)
+		e.string(value)
+		return e.frame()
+
+	case OpPut:
+		key, value := d.string(), d.string()
+		if d.err != nil {
+			return nil, d.err
+		}
+		return resultFrame(id, s.Handler.Put(ctx, key, value))
+
+	case OpDelete:
+		key := d.string()
+		if d.err != nil {
+			return nil, d.err
+		}
+		return resultFrame(id, s.Handler.Delete(ctx, key))
+
+	case OpScan:
+		prefix, after, limit := d.string(), d.string(), d.uint32()
+		if d.err != nil {
+			return nil, d.err
+		}
+		items, err := s.Handler.Scan(ctx, prefix, after, int(limit))
+		if err != nil {
+			return errorFrame(id, err)
+		}
+		e := newEncoder(id, StatusOK)
+		e.pairs(items)
+		return e.frame()
+
+	case OpPutBatch:
+		pairs := d.pairs()
+		if d.err != nil {
+			return nil, d.err
+		}
+		return resultFrame(id, s.Handler.PutBatch(ctx, pairs))
+
+	case OpGetBatch:
+		n := d.count(4)
+		if s.MaxBatchKeys > 0 && n > s.MaxBatchKeys {
+			return errorFrame(id, &Error{Code: "bad_request", Message: fmt.Sprintf("At most %d keys are allowed", s.MaxBatchKeys)})
+		}
+		keys := make([]string, n)
+		for i := range keys {
+			keys[i] = d.string()
+		}
+		if d.err != nil {
+			return nil, d.err
+		}
+		e := newEncoder(id, StatusOK)
+		e.uint32(uint32(len(keys)))
+		for _, key := range keys {
+			value, err := s.Handler.Get(ctx, key)
+			status, werr := errorStatus(err)
+			e.buf = append(e.buf, status)
+			switch status {
+			case StatusOK:
+				e.string(value)
+			case StatusError:
+				e.error(werr)
+			}
+		}
+		return e.frame()
+	}
+	return errorFrame(id, &Error{Code: "bad_request", Message: fmt.Sprintf("unknown operation %d", op)})
+}
+
+func errorStatus(err error) (byte, *Error) {
+	var werr *Error
+	switch {
+	case err == nil:
+		return StatusOK, nil
+	case errors.Is(err, ErrNotFound):
+		return StatusNotFound, nil
+	case errors.As(err, &werr):
+		return StatusError, werr
+	}
+	return StatusError, &Error{Code: "internal", Message: err.Error()}
+}
+
+func resultFrame(id uint32, err error) ([]byte, error) {
+	if err != nil {
+		return errorFrame(id, err)
+	}
+	return newEncoder(id, StatusOK).frame()
+}
+
+func errorFrame(id uint32, err error) ([]byte, error) {
+	status, werr := errorStatus(err)
+	e := newEncoder(id, status)
+	if werr != nil {
+		e.error(werr)
+	}
+	return e.frame()
+}
@@ -0,0 +1,172 @@
+package wire
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type mapHandler struct {
+	mu     sync.Mutex
+	values map[string]string
+}
+
+func (h *mapHandler) Get(ctx context.Context, key string) (string, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	value, ok := h.values[key]
+	if !ok {
+		return "", ErrNotFound
+	}
+	return value, nil
+}
+
+func (h *mapHandler) Put(ctx context.Context, key, value string) error {
+	if key == "" {
+		return &Error{Code: "bad_request", Message: "empty key"}
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.values[key] = value
+	return nil
+}
+
+func (h *mapHandler) Delete(ctx context.Context, key string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.values, key)
+	return nil
+}
+
+func (h *mapHandler) Scan(ctx context.Context, prefix, after string, limit int) ([]KeyValue, error) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var items []KeyValue
+	for k, v := range h.values {
+		if strings.HasPrefix(k, prefix) && k > after {
+			items = append(items, KeyValue{k, v})
+		}
+	}
+	sort.Slice(items, func(i, j int) bool { return items[i].Key < items[j].Key })
+	if len(items) > limit {
+		items = items[:limit]
+	}
+	return items, nil
+}
+
+func (h *mapHandler) PutBatch(ctx context.Context, pairs []KeyValue) error {
+	for _, kv := range pairs {
+		if err := h.Put(ctx, kv.Key, kv.Value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func startServer(t *testing.T) (*Server, string) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err, err) {
+		t.FailNow()
+	}
+	srv := &Server{Handler: &mapHandler{values: make(map[string]string)}}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return srv, l.Addr().String()
+}
+
+func TestClient(t *testing.T) {
+	_, addr := startServer(t)
+	ctx := context.Background()
+	c, err := Dial(ctx, addr)
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer c.Close()
+
+	assert.Nil(t, c.Put(ctx, "a", "1"))
+	value, err := c.Get(ctx, "a")
+	assert.Nil(t, err, err)
+	assert.Equal(t, "1", value)
+	_, err = c.Get(ctx, "missing")
+	assert.Equal(t, ErrNotFound, err)
+	assert.Equal(t, &Error{Code: "bad_request", Message: "empty key"}, c.Put(ctx, "", "x"))
+
+	assert.Nil(t, c.PutBatch(ctx, []KeyValue{{"b", "2"}, {"c", "3"}}))
+	assert.Nil(t, c.Delete(ctx, "a"))
+	items, err := c.Scan(ctx, "", "b", 10)
+	assert.Nil(t, err, err)
+	assert.Equal(t, []KeyValue{{"c", "3"}}, items)
+
+	results, err := c.GetBatch(ctx, []string{"c", "a"})
+	assert.Nil(t, err, err)
+	assert.Equal(t, []Result{{Value: "3"}, {Err: ErrNotFound}}, results)
+}
+
+func TestClient_MaxBatchKeys(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	srv := &Server{Handler: &mapHandler{values: make(map[string]string)}, MaxBatchKeys: 2}
+	go srv.Serve(l)
+	defer srv.Close()
+	ctx := context.Background()
+	c, err := Dial(ctx, l.Addr().String())
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer c.Close()
+
+	_, err = c.GetBatch(ctx, []string{"a", "b"})
+	assert.Nil(t, err, err)
+	_, err = c.GetBatch(ctx, []string{"a", "b", "c"})
+	assert.Equal(t, &Error{Code: "bad_request", Message: "At most 2 keys are allowed"}, err)
+	_, err = c.GetBatch(ctx, []string{"a"})
+	assert.Nil(t, err, err, "the connection is still usable")
+}
+
+func TestClient_Pipelining(t *testing.T) {
+	_, addr := startServer(t)
+	ctx := context.Background()
+	c, err := Dial(ctx, addr)
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	defer c.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			key := fmt.Sprintf("key%d", i)
+			assert.Nil(t, c.Put(ctx, key, fmt.Sprint(i)))
+			value, err := c.Get(ctx, key)
+			assert.Nil(t, err, err)
+			assert.Equal(t, fmt.Sprint(i), value)
+		}(i)
+	}
+	wg.Wait()
+}
+
+func TestClient_Closed(t *testing.T) {
+	srv, addr := startServer(t)
+	ctx := context.Background()
+	c, err := Dial(ctx, addr)
+	if !assert.Nil(t, err, err) {
+		return
+	}
+	srv.Close()
+	_, err = c.Get(ctx, "a")
+	assert.NotNil(t, err)
+
+	c.Close()
+	_, err = c.Get(ctx, "a")
+	assert.NotNil(t, err)
+}